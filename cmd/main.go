@@ -34,7 +34,7 @@ import (
 )
 
 func main() {
-	log.Println("Start application, use ctrl+c to stop it")
+	log.Println("Start application, use ctrl+c to stop it or send SIGHUP to reload config")
 
 	cfg, err := config.NewConfigFromCmdLineArgs(os.Args[1:])
 	if err != nil {
@@ -44,22 +44,51 @@ func main() {
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 
+	rly := relay.New(ctx)
+
+	if result := rly.Apply(cfg); len(result.Added) == 0 {
+		log.Println("no route is started")
+		cancelFunc()
+		return
+	}
+
 	go monitorSyscall(func() {
 		cancelFunc()
+	}, func() {
+		reloadConfig(rly)
 	})
 
 	// Will block here until user hits ctrl+c
-	relay.Run(ctx, cfg)
+	rly.Wait()
 }
 
-func monitorSyscall(doClose func()) {
+// Re-read config and apply it, running config is kept as is if new one is not valid
+func reloadConfig(rly *relay.Relay) {
+	log.Println("reload config")
+
+	cfg, err := config.NewConfigFromCmdLineArgs(os.Args[1:])
+	if err != nil {
+		log.Printf("failed to reload config, keep running one err=%v", err)
+		return
+	}
+
+	rly.Apply(cfg)
+}
+
+func monitorSyscall(doClose func(), doReload func()) {
 	defer doClose()
 
 	done := make(chan os.Signal, 1)
 
-	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range done {
+		if sig != syscall.SIGHUP {
+			break
+		}
 
-	<-done
+		doReload()
+	}
 
 	signal.Reset()
 }
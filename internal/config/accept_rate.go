@@ -0,0 +1,74 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// Rate limit of new connections from single client ip, client exceeding it could be banned for a while
+type AcceptRate struct {
+	// New connections per second, disabled if zero
+	Rate float64
+	// New connections allowed at once
+	Burst int
+	// Client exceeding rate is banned for this long, over-rate connections are just rejected if zero
+	BanTime time.Duration
+}
+
+// Accept rate as it is described in config file or command line args
+type acceptRateSpec struct {
+	Rate    float64 `yaml:"rate"`
+	Burst   int     `yaml:"burst"`
+	BanTime string  `yaml:"ban_time"`
+}
+
+// Validate accept rate spec, burst is defaulted to rate rounded up
+func newAcceptRate(spec acceptRateSpec, fail func(field, value string, err error)) AcceptRate {
+	rate := AcceptRate{Rate: spec.Rate, Burst: spec.Burst}
+
+	var err error
+
+	if spec.Rate < 0 || math.IsNaN(spec.Rate) || math.IsInf(spec.Rate, 0) {
+		fail("accept_rate.rate", strconv.FormatFloat(spec.Rate, 'g', -1, 64), ErrInvalidNumber)
+	}
+
+	if spec.Burst < 0 {
+		fail("accept_rate.burst", strconv.Itoa(spec.Burst), ErrInvalidNumber)
+	}
+
+	if spec.BanTime != "" {
+		if rate.BanTime, err = parseTimeout(spec.BanTime); err != nil {
+			fail("accept_rate.ban_time", spec.BanTime, err)
+		}
+	}
+
+	if spec.Rate > 0 && spec.Burst == 0 {
+		rate.Burst = int(math.Ceil(spec.Rate))
+	}
+
+	return rate
+}
@@ -0,0 +1,79 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAcceptRate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   acceptRateSpec
+		rate   AcceptRate
+		fields []string
+	}{
+		"disabled": {
+			spec: acceptRateSpec{},
+			rate: AcceptRate{},
+		},
+		"default burst": {
+			spec: acceptRateSpec{Rate: 2.5},
+			rate: AcceptRate{Rate: 2.5, Burst: 3},
+		},
+		"ban": {
+			spec: acceptRateSpec{Rate: 10, Burst: 50, BanTime: "5m"},
+			rate: AcceptRate{Rate: 10, Burst: 50, BanTime: 5 * time.Minute},
+		},
+		"all failed": {
+			spec:   acceptRateSpec{Rate: math.Inf(1), Burst: -1, BanTime: "-5m"},
+			fields: []string{"accept_rate.rate", "accept_rate.burst", "accept_rate.ban_time"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fields := []string{}
+
+			rate := newAcceptRate(test.spec, func(field, _ string, _ error) {
+				fields = append(fields, field)
+			})
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.rate, rate)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Source address filter of route. Client is denied if it matches any deny prefix,
+// otherwise it is allowed if allow list is empty or it matches any allow prefix.
+type ACL struct {
+	// Allowed client prefixes, everyone is allowed if empty
+	Allow []netip.Prefix
+	// Denied client prefixes, they win over allowed ones
+	Deny []netip.Prefix
+}
+
+// Filter as it is described in config file or command line args
+type aclSpec struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// Validate acl spec, fail is called for every invalid prefix
+func newACL(spec aclSpec, fail func(field, value string, err error)) ACL {
+	acl := ACL{}
+
+	for _, arg := range spec.Allow {
+		prefix, err := parsePrefix(strings.TrimSpace(arg))
+		if err != nil {
+			fail("allow", arg, err)
+			continue
+		}
+
+		acl.Allow = append(acl.Allow, prefix)
+	}
+
+	for _, arg := range spec.Deny {
+		prefix, err := parsePrefix(strings.TrimSpace(arg))
+		if err != nil {
+			fail("deny", arg, err)
+			continue
+		}
+
+		acl.Deny = append(acl.Deny, prefix)
+	}
+
+	return acl
+}
+
+// Parse cidr prefix e.g. 10.0.0.0/8 or fd00::/8, single address is prefix of its full length
+func parsePrefix(arg string) (netip.Prefix, error) {
+	if arg == "" {
+		return netip.Prefix{}, ErrMissingValue
+	}
+
+	if addr, err := netip.ParseAddr(arg); err == nil {
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(arg)
+	if err != nil {
+		return netip.Prefix{}, ErrInvalidPrefix
+	}
+
+	if prefix.Addr().Is4In6() {
+		return netip.Prefix{}, ErrInvalidPrefix
+	}
+
+	return prefix.Masked(), nil
+}
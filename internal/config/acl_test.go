@@ -0,0 +1,84 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewACL(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   aclSpec
+		acl    ACL
+		fields []string
+	}{
+		"empty": {
+			spec: aclSpec{},
+			acl:  ACL{},
+		},
+		"prefixes and addresses": {
+			spec: aclSpec{Allow: []string{"10.1.2.3/8", " fd00::/8", "192.168.0.7"}, Deny: []string{"::ffff:10.0.0.13", "2001:db8::1"}},
+			acl: ACL{
+				Allow: []netip.Prefix{
+					netip.MustParsePrefix("10.0.0.0/8"),
+					netip.MustParsePrefix("fd00::/8"),
+					netip.MustParsePrefix("192.168.0.7/32"),
+				},
+				Deny: []netip.Prefix{
+					netip.MustParsePrefix("10.0.0.13/32"),
+					netip.MustParsePrefix("2001:db8::1/128"),
+				},
+			},
+		},
+		"all failed": {
+			spec:   aclSpec{Allow: []string{"10.0.0.0/33", ""}, Deny: []string{"db.vpn", "::ffff:10.0.0.0/104"}},
+			fields: []string{"allow", "allow", "deny", "deny"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fields := []string{}
+
+			acl := newACL(test.spec, func(field, _ string, _ error) {
+				fields = append(fields, field)
+			})
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.acl, acl)
+		})
+	}
+}
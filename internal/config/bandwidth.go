@@ -0,0 +1,117 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Bandwidth limits in bytes per second, every limit is unlimited if zero
+type Bandwidth struct {
+	// From client to remote, shared by all connections
+	Upload int64
+	// From remote to client, shared by all connections
+	Download int64
+	// From client to remote, of every single connection
+	ConnUpload int64
+	// From remote to client, of every single connection
+	ConnDownload int64
+}
+
+// Route bandwidth as it is described in config file or command line args
+type bandwidthSpec struct {
+	Upload       string `yaml:"upload"`
+	Download     string `yaml:"download"`
+	ConnUpload   string `yaml:"conn_upload"`
+	ConnDownload string `yaml:"conn_download"`
+}
+
+// Global bandwidth as it is described in config file, connection limits are set per route
+type globalBandwidthSpec struct {
+	Upload   string `yaml:"upload"`
+	Download string `yaml:"download"`
+}
+
+// Validate bandwidth spec, fail is called for every invalid field
+func newBandwidth(spec bandwidthSpec, fail func(field, value string, err error)) Bandwidth {
+	bandwidth := Bandwidth{}
+
+	var err error
+
+	if bandwidth.Upload, err = parseRate(spec.Upload); err != nil {
+		fail("bandwidth.upload", spec.Upload, err)
+	}
+
+	if bandwidth.Download, err = parseRate(spec.Download); err != nil {
+		fail("bandwidth.download", spec.Download, err)
+	}
+
+	if bandwidth.ConnUpload, err = parseRate(spec.ConnUpload); err != nil {
+		fail("bandwidth.conn_upload", spec.ConnUpload, err)
+	}
+
+	if bandwidth.ConnDownload, err = parseRate(spec.ConnDownload); err != nil {
+		fail("bandwidth.conn_download", spec.ConnDownload, err)
+	}
+
+	return bandwidth
+}
+
+// Validate global bandwidth spec, it is shared by all routes
+func newGlobalBandwidth(spec globalBandwidthSpec) (Bandwidth, []error) {
+	errs := []error{}
+
+	bandwidth := newBandwidth(bandwidthSpec{Upload: spec.Upload, Download: spec.Download}, func(field, value string, err error) {
+		errs = append(errs, &FieldError{Field: field, Value: value, Err: err})
+	})
+
+	return bandwidth, errs
+}
+
+// Parse rate in bytes per second with optional binary suffix e.g. 65536, 512K, 10MB or 1GiB, empty is unlimited
+func parseRate(arg string) (int64, error) {
+	if arg == "" {
+		return 0, nil
+	}
+
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(arg)), "IB"), "B")
+
+	multiplier := 1.0
+
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(number, suffix) {
+			number, multiplier = strings.TrimSuffix(number, suffix), math.Pow(1024, float64(i+1))
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || value <= 0 || value*multiplier < 1 || value*multiplier > math.MaxInt64/2 {
+		return 0, ErrInvalidRate
+	}
+
+	return int64(value * multiplier), nil
+}
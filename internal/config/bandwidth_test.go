@@ -0,0 +1,107 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBandwidth(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec      bandwidthSpec
+		bandwidth Bandwidth
+		fields    []string
+	}{
+		"unlimited": {
+			spec:      bandwidthSpec{},
+			bandwidth: Bandwidth{},
+		},
+		"limited": {
+			spec:      bandwidthSpec{Upload: "1M", Download: "10MB", ConnUpload: "512K", ConnDownload: "65536"},
+			bandwidth: Bandwidth{Upload: 1 << 20, Download: 10 << 20, ConnUpload: 512 << 10, ConnDownload: 65536},
+		},
+		"all failed": {
+			spec:   bandwidthSpec{Upload: "0", Download: "-1M", ConnUpload: "fast", ConnDownload: "10T"},
+			fields: []string{"bandwidth.upload", "bandwidth.download", "bandwidth.conn_upload", "bandwidth.conn_download"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fields := []string{}
+
+			bandwidth := newBandwidth(test.spec, func(field, _ string, _ error) {
+				fields = append(fields, field)
+			})
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.bandwidth, bandwidth)
+		})
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		rate int64
+		err  error
+	}{
+		"":       {rate: 0},
+		"1":      {rate: 1},
+		"65536":  {rate: 65536},
+		"512k":   {rate: 512 << 10},
+		"512KB":  {rate: 512 << 10},
+		"1.5M":   {rate: 3 << 19},
+		"10 MiB": {rate: 10 << 20},
+		"2G":     {rate: 2 << 30},
+		"0":      {err: ErrInvalidRate},
+		"0.5":    {err: ErrInvalidRate},
+		"-1K":    {err: ErrInvalidRate},
+		"1T":     {err: ErrInvalidRate},
+		"MB":     {err: ErrInvalidRate},
+	}
+
+	for arg, test := range tests {
+		t.Run(arg, func(t *testing.T) {
+			t.Parallel()
+
+			rate, err := parseRate(arg)
+
+			assert.ErrorIs(t, err, test.err)
+			assert.EqualValues(t, test.rate, rate)
+		})
+	}
+}
@@ -24,103 +24,351 @@
 package config
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math"
-	"net/netip"
-	"strconv"
 	"strings"
 )
 
 const (
 	locaParamlDesc  = "local ipv4 address where incoming traffic comes from i.e. one of addresses on transitional host which is visible for target host/application"
-	remoteParamDesc = "remote address somethere in target vpn/subnet/tunnel"
-	portParamDesc   = "comma separated port list to be forwarded"
+	remoteParamDesc = "comma separated remote ip addresses or host names somethere in target vpn/subnet/tunnel, host name is resolved on every new connection"
+	balanceDesc     = "strategy to pick one of remotes for new connection: round-robin, random, least-conn or source-hash"
+	portParamDesc   = "comma separated port list to be forwarded, use local:remote to map local port to another remote port and add /udp suffix to forward datagrams e.g. 15432:5432,53/udp"
+	udpTimeoutDesc  = "idle timeout of udp session after which upstream socket is closed"
+	idleTimeoutDesc = "tcp connection is closed if no data is relayed in either direction for this long e.g. 15m, disabled by default"
+	lifetimeDesc    = "tcp connection is closed once it lives this long e.g. 24h, disabled by default"
+	writeTimeDesc   = "tcp connection is closed if write to either side is blocked for this long e.g. 30s, disabled by default"
+	dialTimeoutDesc = "timeout of single dial attempt to remote"
+	dialRetriesDesc = "number of dial retries with exponential backoff"
+	dialNextDesc    = "pick next remote by balancer for every dial retry instead of retrying the same one"
+	allowDesc       = "comma separated client ip addresses or cidr prefixes allowed to connect e.g. 10.0.0.0/8,fd00::/8, everyone by default"
+	denyDesc        = "comma separated client ip addresses or cidr prefixes denied to connect, they win over allowed ones"
+	maxConnsDesc    = "max concurrent connections, unlimited by default"
+	maxConnsIPDesc  = "max concurrent connections of single client ip, unlimited by default"
+	queueTimeDesc   = "over-limit connection waits this long for free slot in accept order e.g. 5s, it is rejected immediately by default"
+	uploadDesc      = "bandwidth from clients to remote in bytes per second e.g. 512K or 10M, unlimited by default"
+	downloadDesc    = "bandwidth from remote to clients in bytes per second e.g. 512K or 10M, unlimited by default"
+	connUploadDesc  = "bandwidth from client to remote of every connection in bytes per second, unlimited by default"
+	connDownDesc    = "bandwidth from remote to client of every connection in bytes per second, unlimited by default"
+	acceptRateDesc  = "new connections per second allowed from single client ip e.g. 10, unlimited by default"
+	acceptBurstDesc = "new connections allowed at once from single client ip, -accept-rate rounded up by default"
+	banTimeDesc     = "client exceeding -accept-rate is banned for this long e.g. 5m, over-rate connections are just rejected by default"
+	tlsCertDesc     = "pem file of certificate chain to terminate tls of clients, decrypted stream is relayed to remote"
+	tlsKeyDesc      = "pem file of private key of -tls-cert"
+	tlsClientCADesc = "pem bundle of CAs which client certificates are verified against, client certificate is required if set"
+	tlsMinVerDesc   = "min tls version of clients: 1.0, 1.1, 1.2 or 1.3"
+	tlsCiphersDesc  = "comma separated cipher suites of tls 1.2 e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, go defaults are used by default"
+	remoteTLSDesc   = "wrap connections to remote in tls, plaintext stream of client is encrypted"
+	rtlsNameDesc    = "server name sent in sni and verified against remote certificate, remote host is used by default"
+	rtlsCADesc      = "pem bundle of CAs which remote certificates are verified against, system roots are used by default"
+	rtlsCertDesc    = "pem file of client certificate chain sent to remote"
+	rtlsKeyDesc     = "pem file of private key of -remote-tls-cert"
+	rtlsInsecDesc   = "do not verify remote certificates at all, it is insecure and logged on every connection"
+	sendProxyDesc   = "send proxy protocol header of version v1 or v2 carrying client address to remote, nothing is sent by default"
+	acceptProxyDesc = "accept proxy protocol header from clients and use client address carried by it: required or optional, header is not expected by default"
+	proxyTimeDesc   = "proxy protocol header has to be received within this long, 5s by default"
+	proxyTrustDesc  = "comma separated ip addresses or cidr prefixes of peers e.g. load balancers whose proxy protocol headers are honoured, required once headers are accepted"
+	modeDesc        = "mode of listeners: forward, socks5, connect or transparent, destination is asked by client in socks5 and connect modes or recovered from redirected connection in transparent mode and -r is not used"
+	tunnelUsersDesc = "comma separated user:password credentials of tunnel clients, clients are not authenticated by default"
+	tunnelAllowDesc = "comma separated destination ip addresses or cidr prefixes allowed to tunnel clients, required in socks5 and connect modes"
+	tunnelDenyDesc  = "comma separated destination ip addresses or cidr prefixes denied to tunnel clients, they win over allowed ones"
+	tunnelPortsDesc = "comma separated destination ports or port ranges allowed to tunnel clients e.g. 22,8000-8999, any port by default"
+	tunnelUDPDesc   = "relay datagrams of socks5 clients asking for udp associate"
+	tunnelTimeDesc  = "tunnel request has to be received within this long, 10s by default"
+	transMethodDesc = "method of recovering original destination in transparent mode: redirect for iptables REDIRECT or tproxy for iptables TPROXY"
+	configParamDesc = "path to yaml/json config file with list of routes, can't be used along with -l, -r and -p"
+	resolverDesc    = "dns server address used to resolve remote host names e.g. 10.0.0.2:53, system resolver is used by default"
+	resolverTTLDesc = "how long resolved remote addresses are cached e.g. 30s, no caching by default"
+	metricsDesc     = "address of http endpoint exposing prometheus metrics on /metrics e.g. 127.0.0.1:9100, disabled by default"
+	adminTokenDesc  = "bearer token authorizing DELETE /bans of metrics endpoint, bans could not be lifted over http by default"
 )
 
+// Name of route created from command line args
+const cmdLineRouteName = "cmdline"
+
 // Configuration of this service
 type Config struct {
-	// Local address to bind and recevie data
-	localAddress netip.Addr
-	// Remote address where some peer are available
-	remoteAddress netip.Addr
-	// Ports to be forwarded
-	ports []uint16
+	// Routes to be forwarded
+	routes []Route
+	// Resolver of remote host names
+	resolver Resolver
+	// Metrics endpoint
+	metrics Metrics
+	// Limits shared by all routes
+	limits Limits
+	// Bandwidth shared by all routes
+	bandwidth Bandwidth
 }
 
 // Create new config based on args passed to app
 //
-// Example -l 127.0.0.1 -r 10.12.112.10 -p 1010,1080,443
+// Example -l 127.0.0.1 -r 10.12.112.10,10.12.112.11 -p 1010,1080,15432:5432,53/udp
+// or -config grelay.yaml
 func NewConfigFromCmdLineArgs(args []string) (Config, error) {
 	log.Printf("config: parse agrs %v", args)
 
 	var localArg string
 	var remoteArg string
 	var portsArg string
+	var udpTimeoutArg string
+	var balanceArg string
+	var idleTimeoutArg string
+	var maxLifetimeArg string
+	var writeTimeoutArg string
+	var dialTimeoutArg string
+	var dialRetriesArg int
+	var dialNextRemoteArg bool
+	var allowArg string
+	var maxConnsArg int
+	var maxConnsPerIPArg int
+	var queueTimeoutArg string
+	var uploadArg string
+	var downloadArg string
+	var connUploadArg string
+	var connDownloadArg string
+	var acceptRateArg float64
+	var acceptBurstArg int
+	var banTimeArg string
+	var tlsCertArg string
+	var tlsKeyArg string
+	var tlsClientCAArg string
+	var tlsMinVersionArg string
+	var tlsCiphersArg string
+	var remoteTLSArg bool
+	var remoteTLSNameArg string
+	var remoteTLSCAArg string
+	var remoteTLSCertArg string
+	var remoteTLSKeyArg string
+	var remoteTLSInsecureArg bool
+	var sendProxyArg string
+	var acceptProxyArg string
+	var proxyTimeoutArg string
+	var proxyTrustedArg string
+	var modeArg string
+	var tunnelUsersArg string
+	var tunnelAllowArg string
+	var tunnelDenyArg string
+	var tunnelPortsArg string
+	var tunnelUDPArg bool
+	var tunnelTimeoutArg string
+	var transparentMethodArg string
+	var denyArg string
+	var configArg string
+	var resolverArg string
+	var resolverTTLArg string
+	var metricsArg string
+	var metricsTokenArg string
 
 	flags := flag.NewFlagSet("", flag.ContinueOnError)
 
 	flags.StringVar(&localArg, "l", "", locaParamlDesc)
 	flags.StringVar(&remoteArg, "r", "", remoteParamDesc)
 	flags.StringVar(&portsArg, "p", "", portParamDesc)
+	flags.StringVar(&udpTimeoutArg, "udp-timeout", DefaultUDPTimeout.String(), udpTimeoutDesc)
+	flags.StringVar(&balanceArg, "balance", BalanceRoundRobin, balanceDesc)
+	flags.StringVar(&idleTimeoutArg, "idle-timeout", "", idleTimeoutDesc)
+	flags.StringVar(&maxLifetimeArg, "max-lifetime", "", lifetimeDesc)
+	flags.StringVar(&writeTimeoutArg, "write-timeout", "", writeTimeDesc)
+	flags.StringVar(&dialTimeoutArg, "dial-timeout", DefaultDialTimeout.String(), dialTimeoutDesc)
+	flags.IntVar(&dialRetriesArg, "dial-retries", 0, dialRetriesDesc)
+	flags.BoolVar(&dialNextRemoteArg, "dial-next-remote", false, dialNextDesc)
+	flags.StringVar(&allowArg, "allow", "", allowDesc)
+	flags.StringVar(&denyArg, "deny", "", denyDesc)
+	flags.IntVar(&maxConnsArg, "max-conns", 0, maxConnsDesc)
+	flags.IntVar(&maxConnsPerIPArg, "max-conns-per-ip", 0, maxConnsIPDesc)
+	flags.StringVar(&queueTimeoutArg, "queue-timeout", "", queueTimeDesc)
+	flags.StringVar(&uploadArg, "upload", "", uploadDesc)
+	flags.StringVar(&downloadArg, "download", "", downloadDesc)
+	flags.StringVar(&connUploadArg, "conn-upload", "", connUploadDesc)
+	flags.StringVar(&connDownloadArg, "conn-download", "", connDownDesc)
+	flags.Float64Var(&acceptRateArg, "accept-rate", 0, acceptRateDesc)
+	flags.IntVar(&acceptBurstArg, "accept-burst", 0, acceptBurstDesc)
+	flags.StringVar(&banTimeArg, "ban-time", "", banTimeDesc)
+	flags.StringVar(&tlsCertArg, "tls-cert", "", tlsCertDesc)
+	flags.StringVar(&tlsKeyArg, "tls-key", "", tlsKeyDesc)
+	flags.StringVar(&tlsClientCAArg, "tls-client-ca", "", tlsClientCADesc)
+	flags.StringVar(&tlsMinVersionArg, "tls-min-version", "", tlsMinVerDesc)
+	flags.StringVar(&tlsCiphersArg, "tls-ciphers", "", tlsCiphersDesc)
+	flags.BoolVar(&remoteTLSArg, "remote-tls", false, remoteTLSDesc)
+	flags.StringVar(&remoteTLSNameArg, "remote-tls-server-name", "", rtlsNameDesc)
+	flags.StringVar(&remoteTLSCAArg, "remote-tls-ca", "", rtlsCADesc)
+	flags.StringVar(&remoteTLSCertArg, "remote-tls-cert", "", rtlsCertDesc)
+	flags.StringVar(&remoteTLSKeyArg, "remote-tls-key", "", rtlsKeyDesc)
+	flags.BoolVar(&remoteTLSInsecureArg, "remote-tls-insecure", false, rtlsInsecDesc)
+	flags.StringVar(&sendProxyArg, "proxy-protocol-send", "", sendProxyDesc)
+	flags.StringVar(&acceptProxyArg, "proxy-protocol-accept", "", acceptProxyDesc)
+	flags.StringVar(&proxyTimeoutArg, "proxy-protocol-timeout", "", proxyTimeDesc)
+	flags.StringVar(&proxyTrustedArg, "proxy-protocol-trusted", "", proxyTrustDesc)
+	flags.StringVar(&modeArg, "mode", ModeForward, modeDesc)
+	flags.StringVar(&tunnelUsersArg, "tunnel-users", "", tunnelUsersDesc)
+	flags.StringVar(&tunnelAllowArg, "tunnel-allow", "", tunnelAllowDesc)
+	flags.StringVar(&tunnelDenyArg, "tunnel-deny", "", tunnelDenyDesc)
+	flags.StringVar(&tunnelPortsArg, "tunnel-ports", "", tunnelPortsDesc)
+	flags.BoolVar(&tunnelUDPArg, "tunnel-udp", false, tunnelUDPDesc)
+	flags.StringVar(&tunnelTimeoutArg, "tunnel-timeout", "", tunnelTimeDesc)
+	flags.StringVar(&transparentMethodArg, "transparent-method", "", transMethodDesc)
+	flags.StringVar(&configArg, "config", "", configParamDesc)
+	flags.StringVar(&resolverArg, "resolver", "", resolverDesc)
+	flags.StringVar(&resolverTTLArg, "resolver-ttl", "", resolverTTLDesc)
+	flags.StringVar(&metricsArg, "metrics", "", metricsDesc)
+	flags.StringVar(&metricsTokenArg, "metrics-admin-token", "", adminTokenDesc)
 
 	if err := flags.Parse(args); err != nil {
 		log.Printf("filaed to parse parameters err=%s", err)
 		return Config{}, ErrInvalidArgs
 	}
 
-	return makeConfig(localArg, remoteArg, portsArg)
+	if configArg != "" {
+		if localArg != "" || remoteArg != "" || portsArg != "" {
+			log.Printf("config file %s can't be used along with -l, -r and -p", configArg)
+			return Config{}, ErrInvalidArgs
+		}
+
+		return NewConfigFromFile(configArg)
+	}
+
+	fc := makeFileConfig(localArg, remoteArg, portsArg, udpTimeoutArg)
+
+	fc.Routes[0].Balance = balanceArg
+	fc.Routes[0].IdleTimeout = idleTimeoutArg
+	fc.Routes[0].MaxLifetime = maxLifetimeArg
+	fc.Routes[0].WriteTimeout = writeTimeoutArg
+	fc.Routes[0].Dial = dialSpec{Timeout: dialTimeoutArg, Retries: dialRetriesArg, NextRemote: dialNextRemoteArg}
+	fc.Routes[0].ACL = aclSpec{Allow: splitList(allowArg), Deny: splitList(denyArg)}
+	fc.Routes[0].Limits = limitsSpec{MaxConns: maxConnsArg, MaxConnsPerIP: maxConnsPerIPArg, QueueTimeout: queueTimeoutArg}
+	fc.Routes[0].Bandwidth = bandwidthSpec{Upload: uploadArg, Download: downloadArg, ConnUpload: connUploadArg, ConnDownload: connDownloadArg}
+	fc.Routes[0].AcceptRate = acceptRateSpec{Rate: acceptRateArg, Burst: acceptBurstArg, BanTime: banTimeArg}
+	fc.Routes[0].TLS = tlsSpec{
+		Cert:         tlsCertArg,
+		Key:          tlsKeyArg,
+		ClientCA:     tlsClientCAArg,
+		MinVersion:   tlsMinVersionArg,
+		CipherSuites: splitList(tlsCiphersArg),
+	}
+	fc.Routes[0].RemoteTLS = remoteTLSSpec{
+		Enabled:            remoteTLSArg,
+		ServerName:         remoteTLSNameArg,
+		CA:                 remoteTLSCAArg,
+		Cert:               remoteTLSCertArg,
+		Key:                remoteTLSKeyArg,
+		InsecureSkipVerify: remoteTLSInsecureArg,
+	}
+	fc.Routes[0].ProxyProtocol = proxyProtocolSpec{Send: sendProxyArg, Accept: acceptProxyArg, Timeout: proxyTimeoutArg, Trusted: splitList(proxyTrustedArg)}
+	fc.Routes[0].Mode = modeArg
+
+	// tunnel args are rejected unless mode is tunnel one
+	if isTunnelMode(modeArg) || tunnelUsersArg != "" || tunnelAllowArg != "" || tunnelDenyArg != "" || tunnelPortsArg != "" || tunnelUDPArg || tunnelTimeoutArg != "" {
+		fc.Routes[0].Tunnel = &tunnelSpec{
+			Users:        splitUsers(tunnelUsersArg),
+			Destinations: aclSpec{Allow: splitList(tunnelAllowArg), Deny: splitList(tunnelDenyArg)},
+			Ports:        splitList(tunnelPortsArg),
+			UDP:          tunnelUDPArg,
+			Timeout:      tunnelTimeoutArg,
+		}
+	}
+
+	// transparent args are rejected unless mode is transparent
+	if modeArg == ModeTransparent || transparentMethodArg != "" {
+		fc.Routes[0].Transparent = &transparentSpec{Method: transparentMethodArg}
+	}
+
+	fc.Resolver = resolverSpec{Address: resolverArg, CacheTTL: resolverTTLArg}
+	fc.Metrics = metricsSpec{Address: metricsArg, AdminToken: metricsTokenArg}
+
+	return newConfig(fc)
 }
 
-func (cfg Config) Local() netip.Addr {
-	return cfg.localAddress
+func (cfg Config) Routes() []Route {
+	return cfg.routes
 }
 
-func (cfg Config) Remote() netip.Addr {
-	return cfg.remoteAddress
+func (cfg Config) Resolver() Resolver {
+	return cfg.resolver
 }
 
-func (cfg Config) Ports() []uint16 {
-	return cfg.ports
+func (cfg Config) Metrics() Metrics {
+	return cfg.metrics
+}
+
+func (cfg Config) Limits() Limits {
+	return cfg.limits
+}
+
+func (cfg Config) Bandwidth() Bandwidth {
+	return cfg.bandwidth
 }
 
 func (cfg Config) String() string {
-	return fmt.Sprintf("{%s -> %s for ports %v}", cfg.localAddress, cfg.remoteAddress, cfg.ports)
+	return fmt.Sprintf("%v", cfg.routes)
 }
 
-func makeConfig(localArg, remoteArg, portsArg string) (Config, error) {
+func makeConfig(localArg, remoteArg, portsArg, udpTimeoutArg string) (Config, error) {
+	return newConfig(makeFileConfig(localArg, remoteArg, portsArg, udpTimeoutArg))
+}
+
+// Describe single route given by command line args
+func makeFileConfig(localArg, remoteArg, portsArg, udpTimeoutArg string) fileConfig {
 	log.Printf("create new config local=%s, remote=%s, ports=%s\n", localArg, remoteArg, portsArg)
 
-	lip, err := netip.ParseAddr(localArg)
-	if err != nil {
-		log.Printf("parameter %s is not valid ip address err=%s\n", localArg, err)
-		return Config{}, ErrInvalidParameter
+	spec := routeSpec{
+		Name:       cmdLineRouteName,
+		Listen:     localArg,
+		Remotes:    splitList(remoteArg),
+		Ports:      strings.Split(portsArg, ","),
+		UDPTimeout: udpTimeoutArg,
 	}
 
-	rip, err := netip.ParseAddr(remoteArg)
-	if err != nil {
-		log.Printf("parameter %s is not valid ip address err=%s\n", remoteArg, err)
-		return Config{}, ErrInvalidParameter
+	return fileConfig{Routes: []routeSpec{spec}}
+}
+
+// Validate config spec, all found errors are reported as joined FieldError
+func newConfig(fc fileConfig) (Config, error) {
+	routes, errs := newRoutes(fc.Routes)
+
+	resolver, resolverErrs := newResolver(fc.Resolver)
+
+	errs = append(errs, resolverErrs...)
+
+	metrics, metricsErrs := newMetrics(fc.Metrics)
+
+	errs = append(errs, metricsErrs...)
+
+	limits, limitsErrs := newGlobalLimits(fc.Limits)
+
+	errs = append(errs, limitsErrs...)
+
+	bandwidth, bandwidthErrs := newGlobalBandwidth(fc.Bandwidth)
+
+	errs = append(errs, bandwidthErrs...)
+
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("config: invalid config err=%s\n", err)
+		return Config{}, err
 	}
 
-	ports := strings.Split(portsArg, ",")
-	ipPorts := make([]uint16, 0, len(ports))
+	return Config{routes: routes, resolver: resolver, metrics: metrics, limits: limits, bandwidth: bandwidth}, nil
+}
 
-	for _, port := range ports {
-		ipPort, err := strconv.Atoi(strings.TrimSpace(port))
-		if err != nil {
-			log.Printf("parameter %s is not valid number\n", port)
-			return Config{}, ErrInvalidParameter
-		}
+// Split comma separated user:password list, password of entry without colon is empty
+func splitUsers(arg string) map[string]string {
+	users := map[string]string{}
 
-		if ipPort < 0 || ipPort > math.MaxUint16 {
-			log.Printf("parameter %s is not valid ip port\n", port)
-			return Config{}, ErrInvalidParameter
-		}
+	for _, entry := range splitList(arg) {
+		user, password, _ := strings.Cut(entry, ":")
+
+		users[user] = password
+	}
+
+	return users
+}
 
-		ipPorts = append(ipPorts, uint16(ipPort))
+// Split comma separated list, empty arg is empty list
+func splitList(arg string) []string {
+	if arg == "" {
+		return nil
 	}
 
-	return Config{localAddress: lip, remoteAddress: rip, ports: ipPorts}, nil
+	return strings.Split(arg, ",")
 }
@@ -36,42 +36,56 @@ func TestMakeConfig(t *testing.T) {
 		lip    string
 		rip    string
 		ports  string
-		pports []uint16
+		pports []Port
 		ok     bool
 	}{
 		"correct": {
 			lip:    "129.23.22.123",
 			rip:    "129.23.22.123",
 			ports:  "443,23, 43, 432, 23423",
-			pports: []uint16{443, 23, 43, 432, 23423},
+			pports: tcpPorts(443, 23, 43, 432, 23423),
 			ok:     true,
 		},
 		"lip with port": {
 			lip:    "129.23.22.123:3030",
 			rip:    "129.23.22.123",
 			ports:  "443,23, 43, 432, 23423",
-			pports: []uint16{443, 23, 43, 432, 23423},
+			pports: tcpPorts(443, 23, 43, 432, 23423),
 			ok:     false,
 		},
 		"rip with port": {
 			lip:    "129.23.22.123",
 			rip:    "129.23.22.123:3030",
 			ports:  "443,23, 43, 432, 23423",
-			pports: []uint16{443, 23, 43, 432, 23423},
+			pports: tcpPorts(443, 23, 43, 432, 23423),
 			ok:     false,
 		},
 		"lip failed": {
 			lip:    "129.23.22.323",
 			rip:    "129.23.22.123",
 			ports:  "443,23, 43, 432, 23423",
-			pports: []uint16{443, 23, 43, 432, 23423},
+			pports: tcpPorts(443, 23, 43, 432, 23423),
 			ok:     false,
 		},
 		"rip failed": {
 			lip:    "129.23.22.123",
 			rip:    "129.23.22.323",
 			ports:  "443,23, 43, 432, 23423",
-			pports: []uint16{443, 23, 43, 432, 23423},
+			pports: tcpPorts(443, 23, 43, 432, 23423),
+			ok:     false,
+		},
+		"rip host name": {
+			lip:    "129.23.22.123",
+			rip:    "db-1.vpn.example.com",
+			ports:  "443,23, 43, 432, 23423",
+			pports: tcpPorts(443, 23, 43, 432, 23423),
+			ok:     true,
+		},
+		"rip host name failed": {
+			lip:    "129.23.22.123",
+			rip:    "db_1.vpn.example.com",
+			ports:  "443,23, 43, 432, 23423",
+			pports: nil,
 			ok:     false,
 		},
 		"port format failed": {
@@ -81,11 +95,46 @@ func TestMakeConfig(t *testing.T) {
 			pports: nil,
 			ok:     false,
 		},
+		"udp ports": {
+			lip:    "129.23.22.123",
+			rip:    "129.23.22.123",
+			ports:  "443/tcp, 53/udp,514/udp",
+			pports: []Port{{Local: 443, Remote: 443, Network: NetworkTCP}, {Local: 53, Remote: 53, Network: NetworkUDP}, {Local: 514, Remote: 514, Network: NetworkUDP}},
+			ok:     true,
+		},
+		"port mapping": {
+			lip:    "129.23.22.123",
+			rip:    "129.23.22.123",
+			ports:  "15432:5432, 443, 1053:53/udp",
+			pports: []Port{{Local: 15432, Remote: 5432, Network: NetworkTCP}, {Local: 443, Remote: 443, Network: NetworkTCP}, {Local: 1053, Remote: 53, Network: NetworkUDP}},
+			ok:     true,
+		},
+		"port mapping failed": {
+			lip:    "129.23.22.123",
+			rip:    "129.23.22.123",
+			ports:  "15432:,443",
+			pports: nil,
+			ok:     false,
+		},
+		"port mapping failed by out of range": {
+			lip:    "129.23.22.123",
+			rip:    "129.23.22.123",
+			ports:  "15432:75432",
+			pports: nil,
+			ok:     false,
+		},
+		"port network failed": {
+			lip:    "129.23.22.123",
+			rip:    "129.23.22.123",
+			ports:  "443,53/sctp",
+			pports: nil,
+			ok:     false,
+		},
 		"port format failed by out of range": {
 			lip:    "129.23.22.123",
 			rip:    "129.23.22.123",
 			ports:  "443,23, 43, 432, 232423",
-			pports: []uint16{443, 23, 43, 432, 23423},
+			pports: tcpPorts(443, 23, 43, 432, 23423),
 			ok:     false,
 		},
 	}
@@ -94,17 +143,25 @@ func TestMakeConfig(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
-			cfg, err := makeConfig(test.lip, test.rip, test.ports)
+			cfg, err := makeConfig(test.lip, test.rip, test.ports, "")
 
 			assert.EqualValues(t, test.ok, (err == nil), "input", test.lip, test.rip, test.ports)
 
 			if err != nil {
+				assert.ErrorIs(t, err, ErrInvalidParameter)
 				return
 			}
 
-			assert.EqualValues(t, test.lip, cfg.Local().String())
-			assert.EqualValues(t, test.rip, cfg.Remote().String())
-			assert.EqualValues(t, test.pports, cfg.Ports())
+			assert.Len(t, cfg.Routes(), 1)
+
+			route := cfg.Routes()[0]
+
+			assert.EqualValues(t, cmdLineRouteName, route.Name)
+			assert.EqualValues(t, test.lip, route.Local.String())
+			assert.EqualValues(t, []string{test.rip}, route.Remotes)
+			assert.EqualValues(t, BalanceRoundRobin, route.Balance)
+			assert.EqualValues(t, test.pports, route.Ports)
+			assert.EqualValues(t, DefaultUDPTimeout, route.UDPTimeout)
 		})
 	}
 }
@@ -120,6 +177,158 @@ func TestNewConfig(t *testing.T) {
 			args: []string{"-l", "129.23.22.123", "-r", "129.23.22.123", "-p", "443,23, 43, 432, 23423"},
 			ok:   true,
 		},
+		"udp timeout": {
+			args: []string{"-l", "129.23.22.123", "-r", "129.23.22.123", "-p", "53/udp", "-udp-timeout", "10s"},
+			ok:   true,
+		},
+		"udp timeout failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "129.23.22.123", "-p", "53/udp", "-udp-timeout", "-10s"},
+			ok:   false,
+		},
+		"remotes and balance": {
+			args: []string{"-l", "129.23.22.123", "-r", "10.0.0.1,db.vpn", "-p", "443", "-balance", "least-conn"},
+			ok:   true,
+		},
+		"balance failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "10.0.0.1,db.vpn", "-p", "443", "-balance", "Least Conn"},
+			ok:   false,
+		},
+		"unknown balance failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "10.0.0.1,db.vpn", "-p", "443", "-balance", "leastcon"},
+			ok:   false,
+		},
+		"connection timeouts": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-idle-timeout", "15m", "-max-lifetime", "24h", "-write-timeout", "30s"},
+			ok:   true,
+		},
+		"idle timeout failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-idle-timeout", "0s"},
+			ok:   false,
+		},
+		"dial": {
+			args: []string{"-l", "129.23.22.123", "-r", "10.0.0.1,10.0.0.2", "-p", "443", "-dial-timeout", "1s", "-dial-retries", "2"},
+			ok:   true,
+		},
+		"dial failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "10.0.0.1,10.0.0.2", "-p", "443", "-dial-retries", "-2"},
+			ok:   false,
+		},
+		"acl": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-allow", "10.0.0.0/8,fd00::/8", "-deny", "10.0.0.13"},
+			ok:   true,
+		},
+		"acl failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-allow", "10.0.0.0/33"},
+			ok:   false,
+		},
+		"limits": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-max-conns", "100", "-max-conns-per-ip", "10", "-queue-timeout", "5s"},
+			ok:   true,
+		},
+		"limits failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-max-conns-per-ip", "-1", "-queue-timeout", "0s"},
+			ok:   false,
+		},
+		"bandwidth": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-upload", "1M", "-download", "10M", "-conn-upload", "128K", "-conn-download", "1M"},
+			ok:   true,
+		},
+		"bandwidth failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-conn-download", "0"},
+			ok:   false,
+		},
+		"accept rate": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-accept-rate", "0.5", "-accept-burst", "5", "-ban-time", "5m"},
+			ok:   true,
+		},
+		"accept rate failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-accept-rate", "-1"},
+			ok:   false,
+		},
+		"tls": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-tls-cert", "server.pem", "-tls-key", "server.key", "-tls-min-version", "1.3"},
+			ok:   true,
+		},
+		"tls failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-tls-cert", "server.pem", "-tls-ciphers", "RC4"},
+			ok:   false,
+		},
+		"remote tls": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-remote-tls", "-remote-tls-ca", "ca.pem", "-remote-tls-cert", "client.pem", "-remote-tls-key", "client.key"},
+			ok:   true,
+		},
+		"remote tls failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-remote-tls-insecure", "-remote-tls-ca", "ca.pem"},
+			ok:   false,
+		},
+		"proxy protocol": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-proxy-protocol-send", "v2", "-proxy-protocol-accept", "optional", "-proxy-protocol-timeout", "1s", "-proxy-protocol-trusted", "10.0.0.10,10.0.1.0/24"},
+			ok:   true,
+		},
+		"proxy protocol without trusted peers failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-proxy-protocol-accept", "optional"},
+			ok:   false,
+		},
+		"proxy protocol failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-proxy-protocol-send", "v3"},
+			ok:   false,
+		},
+		"socks5": {
+			args: []string{"-l", "129.23.22.123", "-p", "1080", "-mode", "socks5", "-tunnel-users", "alice:secret,bob:pass:word", "-tunnel-allow", "10.0.0.0/8", "-tunnel-deny", "10.0.0.1", "-tunnel-ports", "22,8000-8999", "-tunnel-udp", "-tunnel-timeout", "5s"},
+			ok:   true,
+		},
+		"socks5 without allowed destinations failed": {
+			args: []string{"-l", "129.23.22.123", "-p", "1080", "-mode", "socks5"},
+			ok:   false,
+		},
+		"socks5 with remote failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "1080", "-mode", "socks5", "-tunnel-allow", "10.0.0.0/8"},
+			ok:   false,
+		},
+		"connect": {
+			args: []string{"-l", "129.23.22.123", "-p", "3128", "-mode", "connect", "-tunnel-users", "alice:secret", "-tunnel-allow", "10.0.0.0/8", "-tunnel-ports", "443"},
+			ok:   true,
+		},
+		"connect with udp failed": {
+			args: []string{"-l", "129.23.22.123", "-p", "3128", "-mode", "connect", "-tunnel-allow", "10.0.0.0/8", "-tunnel-udp"},
+			ok:   false,
+		},
+		"transparent": {
+			args: []string{"-l", "129.23.22.123", "-p", "15001", "-mode", "transparent", "-transparent-method", "tproxy"},
+			ok:   true,
+		},
+		"transparent method in forward mode failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-transparent-method", "tproxy"},
+			ok:   false,
+		},
+		"tunnel in forward mode failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-tunnel-allow", "10.0.0.0/8"},
+			ok:   false,
+		},
+		"socks5 user without password failed": {
+			args: []string{"-l", "129.23.22.123", "-p", "1080", "-mode", "socks5", "-tunnel-allow", "10.0.0.0/8", "-tunnel-users", "alice"},
+			ok:   false,
+		},
+		"mode failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-mode", "socks4"},
+			ok:   false,
+		},
+		"resolver": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-resolver", "10.0.0.2", "-resolver-ttl", "30s"},
+			ok:   true,
+		},
+		"resolver failed": {
+			args: []string{"-l", "129.23.22.123", "-r", "db.vpn", "-p", "443", "-resolver", "dns.vpn:53"},
+			ok:   false,
+		},
+		"config file": {
+			args: []string{"-config", "../../test/grelay.yaml"},
+			ok:   true,
+		},
+		"config file along with args": {
+			args: []string{"-config", "../../test/grelay.yaml", "-p", "443"},
+			ok:   false,
+		},
 		"help": {
 			args: []string{"-h"},
 			ok:   false,
@@ -139,6 +348,52 @@ func TestNewConfig(t *testing.T) {
 	}
 }
 
+func TestDialNextRemote(t *testing.T) {
+	t.Parallel()
+
+	const route = "routes:\n  - name: cmdline\n    listen: 129.23.22.123\n    remotes: [10.0.0.1, 10.0.0.2]\n    ports: [443]\n"
+
+	tests := map[string]struct {
+		args []string
+		data string
+		next bool
+	}{
+		"cmdline default": {
+			args: []string{"-l", "129.23.22.123", "-r", "10.0.0.1,10.0.0.2", "-p", "443", "-dial-retries", "2"},
+		},
+		"cmdline next remote": {
+			args: []string{"-l", "129.23.22.123", "-r", "10.0.0.1,10.0.0.2", "-p", "443", "-dial-retries", "2", "-dial-next-remote"},
+			next: true,
+		},
+		"file default": {
+			data: route + "    dial:\n      retries: 2\n",
+		},
+		"file next remote": {
+			data: route + "    dial:\n      retries: 2\n      next_remote: true\n",
+			next: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var cfg Config
+			var err error
+
+			if test.args != nil {
+				cfg, err = NewConfigFromCmdLineArgs(test.args)
+			} else {
+				cfg, err = parseConfigFile([]byte(test.data))
+			}
+
+			if assert.NoError(t, err) && assert.Len(t, cfg.Routes(), 1) {
+				assert.EqualValues(t, test.next, cfg.Routes()[0].Dial.NextRemote)
+			}
+		})
+	}
+}
+
 func TestPrint(t *testing.T) {
 	t.Parallel()
 
@@ -150,3 +405,20 @@ func TestPrint(t *testing.T) {
 
 	assert.NotEmpty(t, cfg.String())
 }
+
+func TestPortString(t *testing.T) {
+	t.Parallel()
+
+	assert.EqualValues(t, "443/tcp", Port{Local: 443, Remote: 443, Network: NetworkTCP}.String())
+	assert.EqualValues(t, "1053:53/udp", Port{Local: 1053, Remote: 53, Network: NetworkUDP}.String())
+}
+
+func tcpPorts(numbers ...uint16) []Port {
+	ports := make([]Port, 0, len(numbers))
+
+	for _, number := range numbers {
+		ports = append(ports, Port{Local: number, Remote: number, Network: NetworkTCP})
+	}
+
+	return ports
+}
@@ -0,0 +1,103 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	// Default timeout of single dial attempt
+	DefaultDialTimeout = 5 * time.Second
+	// Default delay before first retry of dial
+	DefaultDialBackoff = 100 * time.Millisecond
+	// Default limit of delay between dial retries
+	DefaultDialMaxBackoff = 2 * time.Second
+)
+
+// Dialing of route remotes, client connection is held open while remote is dialed
+type Dial struct {
+	// Timeout of single dial attempt
+	Timeout time.Duration
+	// Attempts made after first failed one
+	Retries int
+	// Delay before first retry, it is doubled for every next retry and randomized by jitter
+	Backoff time.Duration
+	// Limit of delay between retries
+	MaxBackoff time.Duration
+	// Retry with next remote picked by balancer instead of same one
+	NextRemote bool
+}
+
+// Dialing as it is described in config file or command line args
+type dialSpec struct {
+	Timeout    string `yaml:"timeout"`
+	Retries    int    `yaml:"retries"`
+	Backoff    string `yaml:"backoff"`
+	MaxBackoff string `yaml:"max_backoff"`
+	NextRemote bool   `yaml:"next_remote"`
+}
+
+// Validate dial spec, fail is called for every invalid field
+func newDial(spec dialSpec, fail func(field, value string, err error)) Dial {
+	dial := Dial{
+		Timeout:    DefaultDialTimeout,
+		Retries:    spec.Retries,
+		Backoff:    DefaultDialBackoff,
+		MaxBackoff: DefaultDialMaxBackoff,
+		NextRemote: spec.NextRemote,
+	}
+
+	var err error
+
+	if spec.Timeout != "" {
+		if dial.Timeout, err = parseTimeout(spec.Timeout); err != nil {
+			fail("dial.timeout", spec.Timeout, err)
+		}
+	}
+
+	if spec.Retries < 0 {
+		fail("dial.retries", strconv.Itoa(spec.Retries), ErrInvalidNumber)
+	}
+
+	if spec.Backoff != "" {
+		if dial.Backoff, err = parseTimeout(spec.Backoff); err != nil {
+			fail("dial.backoff", spec.Backoff, err)
+		}
+	}
+
+	if spec.MaxBackoff != "" {
+		if dial.MaxBackoff, err = parseTimeout(spec.MaxBackoff); err != nil {
+			fail("dial.max_backoff", spec.MaxBackoff, err)
+		}
+	}
+
+	// zero is left by invalid value which is already reported
+	if dial.Backoff > 0 && dial.MaxBackoff > 0 && dial.MaxBackoff < dial.Backoff {
+		fail("dial.max_backoff", spec.MaxBackoff, ErrConflictingValue)
+	}
+
+	return dial
+}
@@ -0,0 +1,78 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDial(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   dialSpec
+		dial   Dial
+		fields []string
+	}{
+		"default": {
+			spec: dialSpec{},
+			dial: Dial{Timeout: DefaultDialTimeout, Backoff: DefaultDialBackoff, MaxBackoff: DefaultDialMaxBackoff},
+		},
+		"retries with next remote": {
+			spec: dialSpec{Timeout: "1s", Retries: 3, Backoff: "50ms", MaxBackoff: "1s", NextRemote: true},
+			dial: Dial{Timeout: time.Second, Retries: 3, Backoff: 50 * time.Millisecond, MaxBackoff: time.Second, NextRemote: true},
+		},
+		"all failed": {
+			spec:   dialSpec{Timeout: "1", Retries: -1, Backoff: "0s", MaxBackoff: "-1s"},
+			fields: []string{"dial.timeout", "dial.retries", "dial.backoff", "dial.max_backoff"},
+		},
+		"max backoff less than backoff": {
+			spec:   dialSpec{Backoff: "1s", MaxBackoff: "500ms"},
+			fields: []string{"dial.max_backoff"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fields := []string{}
+
+			dial := newDial(test.spec, func(field, _ string, _ error) {
+				fields = append(fields, field)
+			})
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.dial, dial)
+		})
+	}
+}
@@ -23,9 +23,56 @@
  */
 package config
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrInvalidParameter = errors.New("parameter is not valid ip address")
-	ErrInvalidArgs      = errors.New("invalid args")
+	ErrInvalidParameter    = errors.New("parameter is not valid")
+	ErrInvalidArgs         = errors.New("invalid args")
+	ErrInvalidFile         = errors.New("invalid config file")
+	ErrInvalidAddress      = errors.New("not valid ip address")
+	ErrInvalidHost         = errors.New("not valid ip address or host name")
+	ErrInvalidPort         = errors.New("not valid ip port")
+	ErrInvalidNetwork      = errors.New("not supported network")
+	ErrInvalidDuration     = errors.New("not valid positive duration")
+	ErrMissingValue        = errors.New("value is required")
+	ErrDuplicateValue      = errors.New("value is already used")
+	ErrConflictingValue    = errors.New("value conflicts with other field")
+	ErrInvalidName         = errors.New("not valid name")
+	ErrInvalidNumber       = errors.New("not valid positive number")
+	ErrInvalidPrefix       = errors.New("not valid cidr prefix")
+	ErrInvalidRate         = errors.New("not valid positive rate")
+	ErrInvalidTLSVersion   = errors.New("not supported tls version")
+	ErrInvalidCipherSuite  = errors.New("not supported secure cipher suite")
+	ErrInvalidMode         = errors.New("not supported route mode")
+	ErrInvalidPath         = errors.New("not valid absolute path")
+	ErrInvalidProxyVersion = errors.New("not supported proxy protocol version")
+	ErrInvalidPassword     = errors.New("not valid password")
+	ErrUnknownBalancer     = errors.New("not registered balancer")
 )
+
+// Invalid field of route, it is always ErrInvalidParameter
+type FieldError struct {
+	// Route name
+	Route string
+	// Field name as in config file
+	Field string
+	// Offending value
+	Value string
+	// Reason
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	if e.Route == "" {
+		return fmt.Sprintf("field %q value %q: %s", e.Field, e.Value, e.Err)
+	}
+
+	return fmt.Sprintf("route %q field %q value %q: %s", e.Route, e.Field, e.Value, e.Err)
+}
+
+func (e *FieldError) Unwrap() []error {
+	return []error{ErrInvalidParameter, e.Err}
+}
@@ -0,0 +1,91 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config file layout, json is accepted as well since it is subset of yaml
+//
+//	routes:
+//	  - name: db
+//	    listen: 192.168.0.42
+//	    remote: 10.0.0.72
+//	    ports: [15432:5432, 5433]
+//	  - name: dns
+//	    listen: 192.168.0.42
+//	    remote: 10.0.0.53
+//	    protocol: udp
+//	    ports: [53]
+//	    udp_timeout: 30s
+//	resolver:
+//	  address: 10.0.0.2:53
+//	  cache_ttl: 30s
+//	metrics:
+//	  address: 127.0.0.1:9100
+//	limits:
+//	  max_connections: 1000
+//	bandwidth:
+//	  upload: 10M
+type fileConfig struct {
+	Routes    []routeSpec         `yaml:"routes"`
+	Resolver  resolverSpec        `yaml:"resolver"`
+	Metrics   metricsSpec         `yaml:"metrics"`
+	Limits    globalLimitsSpec    `yaml:"limits"`
+	Bandwidth globalBandwidthSpec `yaml:"bandwidth"`
+}
+
+// Create new config from yaml or json file
+func NewConfigFromFile(path string) (Config, error) {
+	log.Printf("config: read config file %s", path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("config: failed to read config file %s err=%s\n", path, err)
+		return Config{}, errors.Join(ErrInvalidFile, err)
+	}
+
+	return parseConfigFile(data)
+}
+
+func parseConfigFile(data []byte) (Config, error) {
+	fc := fileConfig{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&fc); err != nil && err != io.EOF {
+		log.Printf("config: failed to parse config file err=%s\n", err)
+		return Config{}, errors.Join(ErrInvalidFile, err)
+	}
+
+	return newConfig(fc)
+}
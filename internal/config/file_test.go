@@ -0,0 +1,167 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConfigFromFile(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success_yaml", func(t *testing.T) {
+		t.Parallel()
+
+		cfg, err := NewConfigFromFile("../../test/grelay.yaml")
+
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, []Route{
+			{
+				Name:    "db",
+				Local:   netip.MustParseAddr("127.0.0.1"),
+				Mode:    ModeForward,
+				Remotes: []string{"10.0.0.72"},
+				Balance: BalanceRoundRobin,
+				HealthCheck: HealthCheck{
+					Interval:  5 * time.Second,
+					Timeout:   DefaultHealthTimeout,
+					MaxFails:  3,
+					EjectTime: DefaultEjectTime,
+				},
+				Dial: Dial{Timeout: time.Second, Retries: 2, Backoff: DefaultDialBackoff, MaxBackoff: DefaultDialMaxBackoff, NextRemote: true},
+				ACL: ACL{
+					Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("10.0.0.0/8")},
+					Deny:  []netip.Prefix{netip.MustParsePrefix("10.0.0.13/32")},
+				},
+				Limits:      Limits{MaxConns: 100, MaxConnsPerIP: 10, QueueTimeout: 5 * time.Second},
+				Bandwidth:   Bandwidth{Download: 10 << 20, ConnDownload: 1 << 20},
+				AcceptRate:  AcceptRate{Rate: 5, Burst: 5, BanTime: 10 * time.Minute},
+				Ports:       []Port{{Local: 15432, Remote: 5432, Network: NetworkTCP}, {Local: 5433, Remote: 5433, Network: NetworkTCP}},
+				UDPTimeout:  DefaultUDPTimeout,
+				IdleTimeout: 15 * time.Minute,
+				MaxLifetime: 24 * time.Hour,
+			},
+			{
+				Name:        "dns",
+				Local:       netip.MustParseAddr("127.0.0.1"),
+				Mode:        ModeForward,
+				Remotes:     []string{"10.0.0.53", "10.0.0.54"},
+				Balance:     BalanceSourceHash,
+				HealthCheck: HealthCheck{Timeout: DefaultHealthTimeout, EjectTime: DefaultEjectTime},
+				Dial:        Dial{Timeout: DefaultDialTimeout, Backoff: DefaultDialBackoff, MaxBackoff: DefaultDialMaxBackoff},
+				Ports:       []Port{{Local: 53, Remote: 53, Network: NetworkUDP}, {Local: 1053, Remote: 53, Network: NetworkTCP}},
+				UDPTimeout:  30 * time.Second,
+			},
+		}, cfg.Routes())
+	})
+
+	t.Run("Success_json", func(t *testing.T) {
+		t.Parallel()
+
+		cfg, err := NewConfigFromFile("../../test/grelay.json")
+
+		assert.NoError(t, err)
+		assert.Len(t, cfg.Routes(), 1)
+		assert.EqualValues(t, "web", cfg.Routes()[0].Name)
+		assert.EqualValues(t, "web.vpn.example.com", cfg.Routes()[0].Remotes[0])
+		assert.EqualValues(t, Resolver{Address: netip.MustParseAddrPort("10.0.0.2:53"), CacheTTL: 30 * time.Second}, cfg.Resolver())
+		assert.EqualValues(t, Metrics{Address: netip.MustParseAddrPort("127.0.0.1:9100"), Path: DefaultMetricsPath}, cfg.Metrics())
+		assert.EqualValues(t, Limits{MaxConns: 1000, MaxConnsPerIP: 50}, cfg.Limits())
+		assert.EqualValues(t, Bandwidth{Upload: 10 << 20, Download: 100 << 20}, cfg.Bandwidth())
+		assert.EqualValues(t, []Port{{Local: 8080, Remote: 80, Network: NetworkTCP}, {Local: 443, Remote: 443, Network: NetworkTCP}}, cfg.Routes()[0].Ports)
+	})
+
+	t.Run("Fail_no_file", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := NewConfigFromFile("../../test/not-exist.yaml")
+
+		assert.ErrorIs(t, err, ErrInvalidFile)
+	})
+}
+
+func TestParseConfigFile(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		data string
+		err  error
+	}{
+		"empty": {
+			data: "",
+			err:  ErrMissingValue,
+		},
+		"unknown field": {
+			data: "routes:\n  - name: db\n    listn: 127.0.0.1\n",
+			err:  ErrInvalidFile,
+		},
+		"not yaml": {
+			data: "routes: [",
+			err:  ErrInvalidFile,
+		},
+		"remote and remotes": {
+			data: "routes:\n  - name: db\n    listen: 127.0.0.1\n    remote: 10.0.0.1\n    remotes: [10.0.0.2]\n    ports: [5432]\n",
+			err:  ErrConflictingValue,
+		},
+		"invalid remotes": {
+			data: "routes:\n  - name: db\n    listen: 127.0.0.1\n    remotes: [10.0.0.2, db_2]\n    ports: [5432]\n",
+			err:  ErrInvalidHost,
+		},
+		"queue timeout of global limits": {
+			data: "routes:\n  - name: db\n    listen: 127.0.0.1\n    remote: 10.0.0.1\n    ports: [5432]\nlimits:\n  queue_timeout: 5s\n",
+			err:  ErrInvalidFile,
+		},
+		"invalid global limits": {
+			data: "routes:\n  - name: db\n    listen: 127.0.0.1\n    remote: 10.0.0.1\n    ports: [5432]\nlimits:\n  max_connections: -1\n",
+			err:  ErrInvalidNumber,
+		},
+		"connection bandwidth of global bandwidth": {
+			data: "routes:\n  - name: db\n    listen: 127.0.0.1\n    remote: 10.0.0.1\n    ports: [5432]\nbandwidth:\n  conn_upload: 1M\n",
+			err:  ErrInvalidFile,
+		},
+		"invalid global bandwidth": {
+			data: "routes:\n  - name: db\n    listen: 127.0.0.1\n    remote: 10.0.0.1\n    ports: [5432]\nbandwidth:\n  upload: 1 Mbit\n",
+			err:  ErrInvalidRate,
+		},
+		"invalid route": {
+			data: "routes:\n  - name: db\n    listen: 127.0.0.1\n    remote: 10.0.0.1\n    ports: [75432]\n",
+			err:  ErrInvalidPort,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := parseConfigFile([]byte(test.data))
+
+			assert.ErrorIs(t, err, test.err)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	// Default timeout of single active health check
+	DefaultHealthTimeout = 2 * time.Second
+	// Default time remote is ejected by dial failures
+	DefaultEjectTime = 30 * time.Second
+)
+
+// Health checking of route remotes, it is applied to tcp ports only
+type HealthCheck struct {
+	// Period of active checks, disabled if zero
+	Interval time.Duration
+	// Timeout of single active check
+	Timeout time.Duration
+	// Payload sent to remote once connected
+	Send string
+	// Expected prefix of remote response
+	Expect string
+	// Consecutive dial failures after which remote is ejected, disabled if zero
+	MaxFails int
+	// How long remote is ejected by dial failures if active checks are disabled,
+	// otherwise it is back once active check succeeds
+	EjectTime time.Duration
+}
+
+// Health checking as it is described in config file
+type healthCheckSpec struct {
+	Interval  string `yaml:"interval"`
+	Timeout   string `yaml:"timeout"`
+	Send      string `yaml:"send"`
+	Expect    string `yaml:"expect"`
+	MaxFails  int    `yaml:"max_fails"`
+	EjectTime string `yaml:"eject_time"`
+}
+
+// Validate health check spec, fail is called for every invalid field
+func newHealthCheck(spec healthCheckSpec, fail func(field, value string, err error)) HealthCheck {
+	hc := HealthCheck{Send: spec.Send, Expect: spec.Expect, MaxFails: spec.MaxFails, Timeout: DefaultHealthTimeout, EjectTime: DefaultEjectTime}
+
+	var err error
+
+	if spec.Interval != "" {
+		if hc.Interval, err = parseTimeout(spec.Interval); err != nil {
+			fail("health_check.interval", spec.Interval, err)
+		}
+	}
+
+	if spec.Timeout != "" {
+		if hc.Timeout, err = parseTimeout(spec.Timeout); err != nil {
+			fail("health_check.timeout", spec.Timeout, err)
+		}
+	}
+
+	if spec.MaxFails < 0 {
+		fail("health_check.max_fails", strconv.Itoa(spec.MaxFails), ErrInvalidNumber)
+	}
+
+	if spec.EjectTime != "" {
+		if hc.EjectTime, err = parseTimeout(spec.EjectTime); err != nil {
+			fail("health_check.eject_time", spec.EjectTime, err)
+		}
+	}
+
+	return hc
+}
@@ -0,0 +1,74 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   healthCheckSpec
+		hc     HealthCheck
+		fields []string
+	}{
+		"default": {
+			spec: healthCheckSpec{},
+			hc:   HealthCheck{Timeout: DefaultHealthTimeout, EjectTime: DefaultEjectTime},
+		},
+		"active and passive": {
+			spec: healthCheckSpec{Interval: "10s", Timeout: "1s", Send: "PING\r\n", Expect: "+PONG", MaxFails: 2, EjectTime: "1m"},
+			hc:   HealthCheck{Interval: 10 * time.Second, Timeout: time.Second, Send: "PING\r\n", Expect: "+PONG", MaxFails: 2, EjectTime: time.Minute},
+		},
+		"all failed": {
+			spec:   healthCheckSpec{Interval: "10", Timeout: "-1s", MaxFails: -1, EjectTime: "0s"},
+			fields: []string{"health_check.interval", "health_check.timeout", "health_check.max_fails", "health_check.eject_time"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fields := []string{}
+
+			hc := newHealthCheck(test.spec, func(field, _ string, _ error) {
+				fields = append(fields, field)
+			})
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.hc, hc)
+		})
+	}
+}
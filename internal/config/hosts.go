@@ -0,0 +1,135 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Modes of route listeners
+const (
+	// Every port is forwarded to remotes of route
+	ModeForward = "forward"
+	// Tls client is forwarded to remotes picked by server name of its hello, tls is not terminated
+	ModeSNI = "sni"
+	// Http client is forwarded to remotes picked by host and path of its first request
+	ModeHTTP = "http"
+	// Socks5 client is forwarded to destination it asks for
+	ModeSOCKS5 = "socks5"
+	// Http client is forwarded to destination of its CONNECT request
+	ModeConnect = "connect"
+	// Client redirected by iptables is forwarded to its original destination
+	ModeTransparent = "transparent"
+)
+
+// Remotes of clients asking for host name
+type HostRoute struct {
+	// Exact host name or wildcard like *.example.com which matches any of its subdomains
+	Host string
+	// Path prefix of http requests, it matches whole path segments. Any path matches if empty.
+	Path string
+	// Remote ip addresses or host names
+	Remotes []string
+}
+
+// Host route as it is described in config file
+type hostRouteSpec struct {
+	Host    string   `yaml:"host"`
+	Path    string   `yaml:"path"`
+	Remote  string   `yaml:"remote"`
+	Remotes []string `yaml:"remotes"`
+}
+
+// Validate host route specs of mode, host names along with paths have to be unique
+func newHostRoutes(specs []hostRouteSpec, mode string, fail func(field, value string, err error)) []HostRoute {
+	routes := []HostRoute{}
+
+	hosts := map[string]bool{}
+
+	for _, spec := range specs {
+		host, err := parseHostPattern(strings.TrimSpace(spec.Host))
+		if err != nil {
+			fail("hosts.host", spec.Host, err)
+			continue
+		}
+
+		if spec.Path != "" && mode != ModeHTTP {
+			fail("hosts.path", spec.Path, ErrConflictingValue)
+			continue
+		}
+
+		if spec.Path != "" && !strings.HasPrefix(spec.Path, "/") {
+			fail("hosts.path", spec.Path, ErrInvalidPath)
+			continue
+		}
+
+		if hosts[host+spec.Path] {
+			fail("hosts.host", spec.Host, ErrDuplicateValue)
+			continue
+		}
+
+		hosts[host+spec.Path] = true
+
+		routes = append(routes, HostRoute{Host: host, Path: spec.Path, Remotes: parseRemotes(spec.Remote, spec.Remotes, "hosts.", fail)})
+	}
+
+	return routes
+}
+
+// Check whether clients of mode ask for their destinations
+func isTunnelMode(mode string) bool {
+	return mode == ModeSOCKS5 || mode == ModeConnect
+}
+
+// Check whether clients of mode come with own destinations instead of remotes of route
+func hasOwnDestination(mode string) bool {
+	return isTunnelMode(mode) || mode == ModeTransparent
+}
+
+// Parse mode of route listener
+func parseMode(arg string) (string, error) {
+	switch arg {
+	case "", ModeForward:
+		return ModeForward, nil
+	case ModeSNI, ModeHTTP, ModeSOCKS5, ModeConnect, ModeTransparent:
+		return arg, nil
+	}
+
+	return "", ErrInvalidMode
+}
+
+// Parse lower case host name or wildcard of its subdomains, ip addresses are not host names of clients
+func parseHostPattern(arg string) (string, error) {
+	host, err := parseHost(strings.TrimPrefix(strings.ToLower(arg), "*."))
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := netip.ParseAddr(host); err == nil {
+		return "", ErrInvalidHost
+	}
+
+	return strings.TrimSuffix(strings.ToLower(arg), "."), nil
+}
@@ -0,0 +1,158 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHostRoutes(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   routeSpec
+		route  Route
+		fields []string
+	}{
+		"sni with default": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "sni",
+				Remote: "10.0.0.1",
+				Ports:  []string{"443"},
+				Hosts: []hostRouteSpec{
+					{Host: "Git.Example.com", Remote: "10.0.0.2"},
+					{Host: "*.example.com", Remotes: []string{"10.0.0.3", "10.0.0.4"}},
+				},
+			},
+			route: Route{
+				Mode:    ModeSNI,
+				Remotes: []string{"10.0.0.1"},
+				Hosts: []HostRoute{
+					{Host: "git.example.com", Remotes: []string{"10.0.0.2"}},
+					{Host: "*.example.com", Remotes: []string{"10.0.0.3", "10.0.0.4"}},
+				},
+			},
+		},
+		"sni without default": {
+			spec: routeSpec{Listen: "127.0.0.1", Mode: "sni", Ports: []string{"443"}, Hosts: []hostRouteSpec{{Host: "git.example.com", Remote: "10.0.0.2"}}},
+			route: Route{
+				Mode:  ModeSNI,
+				Hosts: []HostRoute{{Host: "git.example.com", Remotes: []string{"10.0.0.2"}}},
+			},
+		},
+		"sni failed": {
+			spec: routeSpec{
+				Listen:    "127.0.0.1",
+				Mode:      "sni",
+				Ports:     []string{"443", "53/udp"},
+				TLS:       tlsSpec{Cert: "server.pem", Key: "server.key"},
+				RemoteTLS: remoteTLSSpec{Enabled: true},
+				Hosts: []hostRouteSpec{
+					{Host: "10.0.0.1", Remote: "10.0.0.2"},
+					{Host: "*.example.com", Remote: "10.0.0.3"},
+					{Host: "*.Example.com", Remote: "10.0.0.4"},
+					{Host: "git.example.com"},
+				},
+			},
+			fields: []string{"hosts.host", "hosts.host", "hosts.remote", "protocol", "tls.cert", "remote_tls.enabled"},
+		},
+		"http with paths": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "http",
+				Remote: "10.0.0.1",
+				Ports:  []string{"443:80"},
+				TLS:    tlsSpec{Cert: "server.pem", Key: "server.key"},
+				Hosts: []hostRouteSpec{
+					{Host: "git.example.com", Remote: "10.0.0.2"},
+					{Host: "git.example.com", Path: "/api", Remote: "10.0.0.3"},
+				},
+			},
+			route: Route{
+				Mode:    ModeHTTP,
+				Remotes: []string{"10.0.0.1"},
+				Hosts: []HostRoute{
+					{Host: "git.example.com", Remotes: []string{"10.0.0.2"}},
+					{Host: "git.example.com", Path: "/api", Remotes: []string{"10.0.0.3"}},
+				},
+			},
+		},
+		"http failed": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "http",
+				Ports:  []string{"80"},
+				Hosts: []hostRouteSpec{
+					{Host: "git.example.com", Path: "api", Remote: "10.0.0.2"},
+					{Host: "git.example.com", Path: "/api", Remote: "10.0.0.3"},
+					{Host: "Git.example.com", Path: "/api", Remote: "10.0.0.4"},
+				},
+			},
+			fields: []string{"hosts.path", "hosts.host"},
+		},
+		"path in sni mode failed": {
+			spec:   routeSpec{Listen: "127.0.0.1", Mode: "sni", Ports: []string{"443"}, Hosts: []hostRouteSpec{{Host: "git.example.com", Path: "/api", Remote: "10.0.0.2"}}},
+			fields: []string{"hosts.path"},
+		},
+		"missing hosts failed": {
+			spec:   routeSpec{Listen: "127.0.0.1", Mode: "sni", Remote: "10.0.0.1", Ports: []string{"443"}},
+			fields: []string{"hosts"},
+		},
+		"hosts in forward mode failed": {
+			spec:   routeSpec{Listen: "127.0.0.1", Remote: "10.0.0.1", Ports: []string{"443"}, Hosts: []hostRouteSpec{{Host: "git.example.com", Remote: "10.0.0.2"}}},
+			fields: []string{"hosts"},
+		},
+		"unknown mode failed": {
+			spec:   routeSpec{Listen: "127.0.0.1", Mode: "smtp", Remote: "10.0.0.1", Ports: []string{"25"}},
+			fields: []string{"mode"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			route, errs := newRoute(test.spec)
+
+			fields := []string{}
+
+			for _, err := range errs {
+				fields = append(fields, err.(*FieldError).Field)
+			}
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.route.Mode, route.Mode)
+			assert.EqualValues(t, test.route.Remotes, route.Remotes)
+			assert.EqualValues(t, test.route.Hosts, route.Hosts)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"strconv"
+	"time"
+)
+
+// Limits of concurrent connections, udp sessions are counted as connections
+type Limits struct {
+	// Max concurrent connections, unlimited if zero
+	MaxConns int
+	// Max concurrent connections of single client ip, unlimited if zero
+	MaxConnsPerIP int
+	// Over-limit connection waits this long for free slot in accept order, it is rejected immediately if zero
+	QueueTimeout time.Duration
+}
+
+// Route limits as they are described in config file or command line args
+type limitsSpec struct {
+	MaxConns      int    `yaml:"max_connections"`
+	MaxConnsPerIP int    `yaml:"max_connections_per_ip"`
+	QueueTimeout  string `yaml:"queue_timeout"`
+}
+
+// Global limits as they are described in config file, queueing is set per route
+type globalLimitsSpec struct {
+	MaxConns      int `yaml:"max_connections"`
+	MaxConnsPerIP int `yaml:"max_connections_per_ip"`
+}
+
+// Validate limits spec, fail is called for every invalid field
+func newLimits(spec limitsSpec, fail func(field, value string, err error)) Limits {
+	limits := Limits{MaxConns: spec.MaxConns, MaxConnsPerIP: spec.MaxConnsPerIP}
+
+	var err error
+
+	if spec.MaxConns < 0 {
+		fail("limits.max_connections", strconv.Itoa(spec.MaxConns), ErrInvalidNumber)
+	}
+
+	if spec.MaxConnsPerIP < 0 {
+		fail("limits.max_connections_per_ip", strconv.Itoa(spec.MaxConnsPerIP), ErrInvalidNumber)
+	}
+
+	if spec.QueueTimeout != "" {
+		if limits.QueueTimeout, err = parseTimeout(spec.QueueTimeout); err != nil {
+			fail("limits.queue_timeout", spec.QueueTimeout, err)
+		}
+	}
+
+	return limits
+}
+
+// Validate global limits spec, they are shared by all routes
+func newGlobalLimits(spec globalLimitsSpec) (Limits, []error) {
+	errs := []error{}
+
+	limits := newLimits(limitsSpec{MaxConns: spec.MaxConns, MaxConnsPerIP: spec.MaxConnsPerIP}, func(field, value string, err error) {
+		errs = append(errs, &FieldError{Field: field, Value: value, Err: err})
+	})
+
+	return limits, errs
+}
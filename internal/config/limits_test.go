@@ -0,0 +1,91 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLimits(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   limitsSpec
+		limits Limits
+		fields []string
+	}{
+		"unlimited": {
+			spec:   limitsSpec{},
+			limits: Limits{},
+		},
+		"queued": {
+			spec:   limitsSpec{MaxConns: 100, MaxConnsPerIP: 10, QueueTimeout: "5s"},
+			limits: Limits{MaxConns: 100, MaxConnsPerIP: 10, QueueTimeout: 5 * time.Second},
+		},
+		"all failed": {
+			spec:   limitsSpec{MaxConns: -1, MaxConnsPerIP: -10, QueueTimeout: "5"},
+			fields: []string{"limits.max_connections", "limits.max_connections_per_ip", "limits.queue_timeout"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fields := []string{}
+
+			limits := newLimits(test.spec, func(field, _ string, _ error) {
+				fields = append(fields, field)
+			})
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.limits, limits)
+		})
+	}
+}
+
+func TestNewGlobalLimits(t *testing.T) {
+	t.Parallel()
+
+	limits, errs := newGlobalLimits(globalLimitsSpec{MaxConns: 1000, MaxConnsPerIP: 50})
+
+	assert.Empty(t, errs)
+	assert.EqualValues(t, Limits{MaxConns: 1000, MaxConnsPerIP: 50}, limits)
+
+	_, errs = newGlobalLimits(globalLimitsSpec{MaxConns: -1})
+
+	if assert.Len(t, errs, 1) {
+		assert.ErrorIs(t, errs[0], ErrInvalidParameter)
+		assert.ErrorIs(t, errs[0], ErrInvalidNumber)
+		assert.EqualValues(t, `field "limits.max_connections" value "-1": not valid positive number`, errs[0].Error())
+	}
+}
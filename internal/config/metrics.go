@@ -0,0 +1,84 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Default http path of metrics endpoint
+const DefaultMetricsPath = "/metrics"
+
+// Http endpoint exposing relay metrics in prometheus text format
+type Metrics struct {
+	// Address to listen on, endpoint is disabled if it is not valid
+	Address netip.AddrPort
+	// Http path of metrics
+	Path string
+	// Bearer token authorizing lifting of bans, bans could not be lifted over http if empty
+	AdminToken string
+}
+
+// Metrics endpoint as it is described in config file or command line args
+type metricsSpec struct {
+	Address    string `yaml:"address"`
+	Path       string `yaml:"path"`
+	AdminToken string `yaml:"admin_token"`
+}
+
+// Validate metrics spec, path is defaulted if address is set
+func newMetrics(spec metricsSpec) (Metrics, []error) {
+	errs := []error{}
+
+	metrics := Metrics{}
+
+	if spec.Address == "" {
+		if spec.Path != "" || spec.AdminToken != "" {
+			errs = append(errs, &FieldError{Field: "metrics.address", Err: ErrMissingValue})
+		}
+
+		return metrics, errs
+	}
+
+	addr, err := netip.ParseAddrPort(spec.Address)
+	if err != nil {
+		errs = append(errs, &FieldError{Field: "metrics.address", Value: spec.Address, Err: ErrInvalidAddress})
+	}
+
+	metrics.Address = addr
+
+	metrics.Path = DefaultMetricsPath
+	metrics.AdminToken = spec.AdminToken
+
+	if spec.Path != "" {
+		if !strings.HasPrefix(spec.Path, "/") {
+			errs = append(errs, &FieldError{Field: "metrics.path", Value: spec.Path, Err: ErrInvalidParameter})
+		}
+
+		metrics.Path = spec.Path
+	}
+
+	return metrics, errs
+}
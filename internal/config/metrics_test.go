@@ -0,0 +1,92 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMetrics(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec    metricsSpec
+		metrics Metrics
+		ok      bool
+	}{
+		"disabled": {
+			spec:    metricsSpec{},
+			metrics: Metrics{},
+			ok:      true,
+		},
+		"default path": {
+			spec:    metricsSpec{Address: "127.0.0.1:9100"},
+			metrics: Metrics{Address: netip.MustParseAddrPort("127.0.0.1:9100"), Path: DefaultMetricsPath},
+			ok:      true,
+		},
+		"custom path": {
+			spec:    metricsSpec{Address: "[::1]:9100", Path: "/grelay/metrics"},
+			metrics: Metrics{Address: netip.MustParseAddrPort("[::1]:9100"), Path: "/grelay/metrics"},
+			ok:      true,
+		},
+		"admin token": {
+			spec:    metricsSpec{Address: "127.0.0.1:9100", AdminToken: "secret"},
+			metrics: Metrics{Address: netip.MustParseAddrPort("127.0.0.1:9100"), Path: DefaultMetricsPath, AdminToken: "secret"},
+			ok:      true,
+		},
+		"admin token without address": {
+			spec: metricsSpec{AdminToken: "secret"},
+			ok:   false,
+		},
+		"address without port": {
+			spec: metricsSpec{Address: "127.0.0.1"},
+			ok:   false,
+		},
+		"path without address": {
+			spec: metricsSpec{Path: "/metrics"},
+			ok:   false,
+		},
+		"relative path": {
+			spec: metricsSpec{Address: "127.0.0.1:9100", Path: "metrics"},
+			ok:   false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			metrics, errs := newMetrics(test.spec)
+
+			assert.EqualValues(t, test.ok, len(errs) == 0)
+
+			if test.ok {
+				assert.EqualValues(t, test.metrics, metrics)
+			}
+		})
+	}
+}
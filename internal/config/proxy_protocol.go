@@ -0,0 +1,129 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Versions of proxy protocol
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+// Modes of accepting proxy protocol header from clients
+const (
+	// Client without header is rejected
+	ProxyAcceptRequired = "required"
+	// Client without header is relayed with its own address
+	ProxyAcceptOptional = "optional"
+)
+
+// Default timeout of receiving proxy protocol header from client
+const DefaultProxyTimeout = 5 * time.Second
+
+// Proxy protocol of tcp ports of route
+type ProxyProtocol struct {
+	// Version of header carrying client address which is sent to remotes, nothing is sent if zero
+	Send int
+	// Mode of accepting header of any version from clients, client address carried by it is used instead of peer one.
+	// Header is not expected if empty.
+	Accept string
+	// Header has to be received within this long
+	Timeout time.Duration
+	// Peers whose headers are honoured e.g. load balancers, other peers are rejected in required mode
+	// and relayed with own address in optional one unless they send header
+	Trusted []netip.Prefix
+}
+
+// Proxy protocol as it is described in config file or command line args
+type proxyProtocolSpec struct {
+	Send    string   `yaml:"send"`
+	Accept  string   `yaml:"accept"`
+	Timeout string   `yaml:"timeout"`
+	Trusted []string `yaml:"trusted"`
+}
+
+// Validate proxy protocol spec, timeout is defaulted once header is accepted
+func newProxyProtocol(spec proxyProtocolSpec, fail func(field, value string, err error)) ProxyProtocol {
+	proxy := ProxyProtocol{Accept: spec.Accept}
+
+	var err error
+
+	if spec.Send != "" {
+		if proxy.Send, err = parseProxyVersion(spec.Send); err != nil {
+			fail("proxy_protocol.send", spec.Send, err)
+		}
+	}
+
+	if spec.Accept != "" && spec.Accept != ProxyAcceptRequired && spec.Accept != ProxyAcceptOptional {
+		fail("proxy_protocol.accept", spec.Accept, ErrInvalidName)
+	}
+
+	if spec.Accept != "" {
+		proxy.Timeout = DefaultProxyTimeout
+	}
+
+	if spec.Timeout != "" {
+		if proxy.Timeout, err = parseTimeout(spec.Timeout); err != nil {
+			fail("proxy_protocol.timeout", spec.Timeout, err)
+		}
+	}
+
+	for _, arg := range spec.Trusted {
+		prefix, err := parsePrefix(strings.TrimSpace(arg))
+		if err != nil {
+			fail("proxy_protocol.trusted", arg, err)
+			continue
+		}
+
+		proxy.Trusted = append(proxy.Trusted, prefix)
+	}
+
+	// header is forged easily, so peers sending it are listed explicitly
+	if spec.Accept != "" && len(spec.Trusted) == 0 {
+		fail("proxy_protocol.trusted", "", ErrMissingValue)
+	}
+
+	if (spec.Timeout != "" || len(spec.Trusted) != 0) && spec.Accept == "" {
+		fail("proxy_protocol.accept", "", ErrMissingValue)
+	}
+
+	return proxy
+}
+
+// Parse proxy protocol version e.g. v2
+func parseProxyVersion(arg string) (int, error) {
+	switch strings.TrimPrefix(strings.ToLower(arg), "v") {
+	case "1":
+		return ProxyProtocolV1, nil
+	case "2":
+		return ProxyProtocolV2, nil
+	}
+
+	return 0, ErrInvalidProxyVersion
+}
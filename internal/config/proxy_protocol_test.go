@@ -0,0 +1,99 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   proxyProtocolSpec
+		proxy  ProxyProtocol
+		fields []string
+	}{
+		"disabled": {
+			spec:  proxyProtocolSpec{},
+			proxy: ProxyProtocol{},
+		},
+		"v1": {
+			spec:  proxyProtocolSpec{Send: "v1"},
+			proxy: ProxyProtocol{Send: ProxyProtocolV1},
+		},
+		"v2": {
+			spec:  proxyProtocolSpec{Send: "2"},
+			proxy: ProxyProtocol{Send: ProxyProtocolV2},
+		},
+		"accept required": {
+			spec:  proxyProtocolSpec{Accept: "required", Trusted: []string{"10.0.0.10"}},
+			proxy: ProxyProtocol{Accept: ProxyAcceptRequired, Timeout: DefaultProxyTimeout, Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.10/32")}},
+		},
+		"accept optional and send": {
+			spec:  proxyProtocolSpec{Send: "v1", Accept: "optional", Timeout: "1s", Trusted: []string{"10.0.0.0/24", "fd00::/8"}},
+			proxy: ProxyProtocol{Send: ProxyProtocolV1, Accept: ProxyAcceptOptional, Timeout: time.Second, Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("fd00::/8")}},
+		},
+		"failed": {
+			spec:   proxyProtocolSpec{Send: "v3", Accept: "always", Timeout: "0s", Trusted: []string{"10.0.0.0/33"}},
+			fields: []string{"proxy_protocol.send", "proxy_protocol.accept", "proxy_protocol.timeout", "proxy_protocol.trusted"},
+		},
+		"timeout without accept failed": {
+			spec:   proxyProtocolSpec{Timeout: "1s"},
+			fields: []string{"proxy_protocol.accept"},
+		},
+		"accept without trusted failed": {
+			spec:   proxyProtocolSpec{Accept: "optional"},
+			fields: []string{"proxy_protocol.trusted"},
+		},
+		"trusted without accept failed": {
+			spec:   proxyProtocolSpec{Trusted: []string{"10.0.0.10"}},
+			fields: []string{"proxy_protocol.accept"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fields := []string{}
+
+			proxy := newProxyProtocol(test.spec, func(field, _ string, _ error) {
+				fields = append(fields, field)
+			})
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.proxy, proxy)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Default port of dns server
+const defaultResolverPort = 53
+
+// Resolver of remote host names
+type Resolver struct {
+	// Address of dns server, system resolver is used if it is not valid
+	Address netip.AddrPort
+	// How long resolved addresses are cached, no caching if zero
+	CacheTTL time.Duration
+}
+
+// Resolver as it is described in config file or command line args
+type resolverSpec struct {
+	Address  string `yaml:"address"`
+	CacheTTL string `yaml:"cache_ttl"`
+}
+
+// Validate resolver spec, address may omit port
+func newResolver(spec resolverSpec) (Resolver, []error) {
+	errs := []error{}
+
+	resolver := Resolver{}
+
+	if spec.Address != "" {
+		if addr, err := netip.ParseAddrPort(spec.Address); err == nil {
+			resolver.Address = addr
+		} else if addr, err := netip.ParseAddr(spec.Address); err == nil {
+			resolver.Address = netip.AddrPortFrom(addr, defaultResolverPort)
+		} else {
+			errs = append(errs, &FieldError{Field: "resolver.address", Value: spec.Address, Err: ErrInvalidAddress})
+		}
+	}
+
+	if spec.CacheTTL != "" {
+		ttl, err := time.ParseDuration(spec.CacheTTL)
+		if err != nil || ttl < 0 {
+			errs = append(errs, &FieldError{Field: "resolver.cache_ttl", Value: spec.CacheTTL, Err: ErrInvalidDuration})
+		}
+
+		resolver.CacheTTL = ttl
+	}
+
+	return resolver, errs
+}
@@ -0,0 +1,80 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewResolver(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec     resolverSpec
+		resolver Resolver
+		ok       bool
+	}{
+		"system": {
+			spec:     resolverSpec{},
+			resolver: Resolver{},
+			ok:       true,
+		},
+		"address with port": {
+			spec:     resolverSpec{Address: "10.0.0.2:5353", CacheTTL: "30s"},
+			resolver: Resolver{Address: netip.MustParseAddrPort("10.0.0.2:5353"), CacheTTL: 30 * time.Second},
+			ok:       true,
+		},
+		"address without port": {
+			spec:     resolverSpec{Address: "fd00::2"},
+			resolver: Resolver{Address: netip.MustParseAddrPort("[fd00::2]:53")},
+			ok:       true,
+		},
+		"address failed": {
+			spec: resolverSpec{Address: "dns.vpn"},
+			ok:   false,
+		},
+		"ttl failed": {
+			spec: resolverSpec{CacheTTL: "-1m"},
+			ok:   false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			resolver, errs := newResolver(test.spec)
+
+			assert.EqualValues(t, test.ok, len(errs) == 0)
+
+			if test.ok {
+				assert.EqualValues(t, test.resolver, resolver)
+			}
+		})
+	}
+}
@@ -0,0 +1,537 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Stream oriented forwarding
+	NetworkTCP = "tcp"
+	// Datagram oriented forwarding
+	NetworkUDP = "udp"
+)
+
+// Default idle timeout of udp session
+const DefaultUDPTimeout = 60 * time.Second
+
+// Built-in strategies of remote selection
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceRandom     = "random"
+	BalanceLeastConn  = "least-conn"
+	BalanceSourceHash = "source-hash"
+)
+
+var (
+	// Guards balancers
+	balancersMu = &sync.Mutex{}
+	// Strategies routes could use, custom ones are added once registered by relay
+	balancers = map[string]bool{BalanceRoundRobin: true, BalanceRandom: true, BalanceLeastConn: true, BalanceSourceHash: true}
+)
+
+// Allow routes to use custom strategy, it has to be registered before config is parsed
+func RegisterBalancer(name string) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+
+	balancers[name] = true
+}
+
+// Forwarding route from local address to remote one
+type Route struct {
+	// Unique route name
+	Name string
+	// Local address to bind and recevie data
+	Local netip.Addr
+	// Mode of listeners
+	Mode string
+	// Remote ip addresses or host names where some peers are available, default ones in host routing modes
+	Remotes []string
+	// Remotes picked by host name of client in host routing modes
+	Hosts []HostRoute
+	// Destinations of clients in tunnel modes
+	Tunnel Tunnel
+	// Original destinations of clients in transparent mode
+	Transparent Transparent
+	// Name of strategy to pick one of remotes for new connection
+	Balance string
+	// Health checking of remotes
+	HealthCheck HealthCheck
+	// Dialing of remotes
+	Dial Dial
+	// Filter of client addresses
+	ACL ACL
+	// Limits of concurrent connections of route
+	Limits Limits
+	// Bandwidth limits of tcp connections of route
+	Bandwidth Bandwidth
+	// Rate limit of new connections from single client
+	AcceptRate AcceptRate
+	// Tls termination of tcp ports
+	TLS TLS
+	// Tls origination toward remotes of tcp ports
+	RemoteTLS RemoteTLS
+	// Proxy protocol of tcp ports
+	ProxyProtocol ProxyProtocol
+	// Ports to be forwarded
+	Ports []Port
+	// Idle timeout of udp sessions
+	UDPTimeout time.Duration
+	// Tcp connection is closed if no data is relayed in either direction for this long, disabled if zero
+	IdleTimeout time.Duration
+	// Tcp connection is closed once it lives this long, disabled if zero
+	MaxLifetime time.Duration
+	// Tcp connection is closed if write to either side is blocked for this long, disabled if zero
+	WriteTimeout time.Duration
+}
+
+// Forwarded port
+type Port struct {
+	// Port to listen on local address
+	Local uint16
+	// Port to connect on remote address
+	Remote uint16
+	// Network protocol, tcp or udp
+	Network string
+}
+
+// Route as it is described in config file or command line args
+type routeSpec struct {
+	Name          string            `yaml:"name"`
+	Listen        string            `yaml:"listen"`
+	Remote        string            `yaml:"remote"`
+	Remotes       []string          `yaml:"remotes"`
+	Mode          string            `yaml:"mode"`
+	Hosts         []hostRouteSpec   `yaml:"hosts"`
+	Tunnel        *tunnelSpec       `yaml:"tunnel"`
+	Transparent   *transparentSpec  `yaml:"transparent"`
+	Balance       string            `yaml:"balance"`
+	Protocol      string            `yaml:"protocol"`
+	Ports         []string          `yaml:"ports"`
+	UDPTimeout    string            `yaml:"udp_timeout"`
+	IdleTimeout   string            `yaml:"idle_timeout"`
+	MaxLifetime   string            `yaml:"max_lifetime"`
+	WriteTimeout  string            `yaml:"write_timeout"`
+	HealthCheck   healthCheckSpec   `yaml:"health_check"`
+	Dial          dialSpec          `yaml:"dial"`
+	ACL           aclSpec           `yaml:",inline"`
+	Limits        limitsSpec        `yaml:"limits"`
+	Bandwidth     bandwidthSpec     `yaml:"bandwidth"`
+	AcceptRate    acceptRateSpec    `yaml:"accept_rate"`
+	TLS           tlsSpec           `yaml:"tls"`
+	RemoteTLS     remoteTLSSpec     `yaml:"remote_tls"`
+	ProxyProtocol proxyProtocolSpec `yaml:"proxy_protocol"`
+}
+
+// Validate route specs, names and listeners have to be unique across routes
+func newRoutes(specs []routeSpec) ([]Route, []error) {
+	if len(specs) == 0 {
+		return nil, []error{&FieldError{Field: "routes", Err: ErrMissingValue}}
+	}
+
+	routes := make([]Route, 0, len(specs))
+	errs := []error{}
+
+	names := map[string]bool{}
+	listeners := map[string]string{}
+
+	for i, spec := range specs {
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("route-%d", i+1)
+		}
+
+		route, routeErrs := newRoute(spec)
+
+		if names[route.Name] {
+			routeErrs = append(routeErrs, &FieldError{Route: route.Name, Field: "name", Value: route.Name, Err: ErrDuplicateValue})
+		}
+
+		names[route.Name] = true
+
+		for _, port := range route.Ports {
+			listener := port.Network + "://" + netip.AddrPortFrom(route.Local, port.Local).String()
+
+			if owner, ok := listeners[listener]; ok {
+				err := fmt.Errorf("%w by route %q", ErrDuplicateValue, owner)
+				routeErrs = append(routeErrs, &FieldError{Route: route.Name, Field: "ports", Value: port.String(), Err: err})
+				continue
+			}
+
+			listeners[listener] = route.Name
+		}
+
+		errs = append(errs, routeErrs...)
+		routes = append(routes, route)
+	}
+
+	return routes, errs
+}
+
+// Validate single route spec
+func newRoute(spec routeSpec) (Route, []error) {
+	errs := []error{}
+
+	fail := func(field, value string, err error) {
+		errs = append(errs, &FieldError{Route: spec.Name, Field: field, Value: value, Err: err})
+	}
+
+	route := Route{Name: spec.Name, UDPTimeout: DefaultUDPTimeout}
+
+	var err error
+
+	if route.Local, err = parseAddr(spec.Listen); err != nil {
+		fail("listen", spec.Listen, err)
+	}
+
+	if route.Mode, err = parseMode(spec.Mode); err != nil {
+		fail("mode", spec.Mode, err)
+
+		// rest of route is validated as forwarding one
+		route.Mode = ModeForward
+	}
+
+	// remotes are default ones in host routing modes, unknown hosts are rejected without them
+	if route.Mode == ModeForward || spec.Remote != "" || len(spec.Remotes) != 0 {
+		route.Remotes = parseRemotes(spec.Remote, spec.Remotes, "", fail)
+	}
+
+	// destination is asked by client in tunnel modes or recovered from redirected connection
+	if hasOwnDestination(route.Mode) && len(route.Remotes) != 0 {
+		fail("remote", strings.Join(route.Remotes, ","), ErrConflictingValue)
+	}
+
+	if route.Balance, err = parseBalance(spec.Balance); err != nil {
+		fail("balance", spec.Balance, err)
+	}
+
+	route.HealthCheck = newHealthCheck(spec.HealthCheck, fail)
+
+	route.Dial = newDial(spec.Dial, fail)
+
+	route.ACL = newACL(spec.ACL, fail)
+
+	route.Limits = newLimits(spec.Limits, fail)
+
+	route.Bandwidth = newBandwidth(spec.Bandwidth, fail)
+
+	route.AcceptRate = newAcceptRate(spec.AcceptRate, fail)
+
+	route.TLS = newTLS(spec.TLS, fail)
+
+	route.RemoteTLS = newRemoteTLS(spec.RemoteTLS, fail)
+
+	route.ProxyProtocol = newProxyProtocol(spec.ProxyProtocol, fail)
+
+	network := spec.Protocol
+	if network == "" {
+		network = NetworkTCP
+	}
+
+	if network != NetworkTCP && network != NetworkUDP {
+		fail("protocol", spec.Protocol, ErrInvalidNetwork)
+	}
+
+	if route.Mode == ModeForward && len(spec.Hosts) != 0 {
+		fail("hosts", spec.Hosts[0].Host, ErrConflictingValue)
+	}
+
+	if hasOwnDestination(route.Mode) && len(spec.Hosts) != 0 {
+		fail("hosts", spec.Hosts[0].Host, ErrConflictingValue)
+	}
+
+	if route.Mode == ModeSNI || route.Mode == ModeHTTP {
+		route.Hosts = newHostRoutes(spec.Hosts, route.Mode, fail)
+
+		if len(spec.Hosts) == 0 {
+			fail("hosts", "", ErrMissingValue)
+		}
+	}
+
+	if !isTunnelMode(route.Mode) && spec.Tunnel != nil {
+		fail("tunnel", "", ErrConflictingValue)
+	}
+
+	if isTunnelMode(route.Mode) {
+		if spec.Tunnel == nil {
+			spec.Tunnel = &tunnelSpec{}
+		}
+
+		route.Tunnel = newTunnel(*spec.Tunnel, route.Mode, fail)
+	}
+
+	if route.Mode != ModeTransparent && spec.Transparent != nil {
+		fail("transparent", "", ErrConflictingValue)
+	}
+
+	if route.Mode == ModeTransparent {
+		if spec.Transparent == nil {
+			spec.Transparent = &transparentSpec{}
+		}
+
+		route.Transparent = newTransparent(*spec.Transparent, fail)
+	}
+
+	if route.Mode != ModeForward {
+		// client stream is routed as it is, datagrams of socks5 clients are relayed via their tcp port
+		if network != NetworkTCP || strings.Contains(strings.Join(spec.Ports, ","), "/"+NetworkUDP) {
+			fail("protocol", NetworkUDP, ErrConflictingValue)
+		}
+	}
+
+	// tls of sni clients is neither terminated nor originated, http could be routed once tls is terminated
+	if route.Mode == ModeSNI {
+		if route.TLS.CertFile != "" {
+			fail("tls.cert", route.TLS.CertFile, ErrConflictingValue)
+		}
+
+		if route.RemoteTLS.Enabled {
+			fail("remote_tls.enabled", "true", ErrConflictingValue)
+		}
+	}
+
+	if len(spec.Ports) == 0 {
+		fail("ports", "", ErrMissingValue)
+	}
+
+	for _, arg := range spec.Ports {
+		port, err := parsePort(strings.TrimSpace(arg), network)
+		if err != nil {
+			fail("ports", arg, err)
+			continue
+		}
+
+		// remote port is asked by client or recovered from redirected connection
+		if hasOwnDestination(route.Mode) && port.Local != port.Remote {
+			fail("ports", arg, ErrConflictingValue)
+			continue
+		}
+
+		route.Ports = append(route.Ports, port)
+	}
+
+	if spec.UDPTimeout != "" {
+		if route.UDPTimeout, err = parseTimeout(spec.UDPTimeout); err != nil {
+			fail("udp_timeout", spec.UDPTimeout, err)
+		}
+	}
+
+	if spec.IdleTimeout != "" {
+		if route.IdleTimeout, err = parseTimeout(spec.IdleTimeout); err != nil {
+			fail("idle_timeout", spec.IdleTimeout, err)
+		}
+	}
+
+	if spec.MaxLifetime != "" {
+		if route.MaxLifetime, err = parseTimeout(spec.MaxLifetime); err != nil {
+			fail("max_lifetime", spec.MaxLifetime, err)
+		}
+	}
+
+	if spec.WriteTimeout != "" {
+		if route.WriteTimeout, err = parseTimeout(spec.WriteTimeout); err != nil {
+			fail("write_timeout", spec.WriteTimeout, err)
+		}
+	}
+
+	return route, errs
+}
+
+// Parse either single remote or list of remotes, field is prefixed by prefix
+func parseRemotes(remote string, remotes []string, prefix string, fail func(field, value string, err error)) []string {
+	args, field := remotes, prefix+"remotes"
+
+	if remote != "" || len(remotes) == 0 {
+		args, field = []string{remote}, prefix+"remote"
+	}
+
+	if remote != "" && len(remotes) != 0 {
+		fail(prefix+"remotes", strings.Join(remotes, ","), ErrConflictingValue)
+	}
+
+	parsed := []string{}
+
+	for _, arg := range args {
+		host, err := parseHost(strings.TrimSpace(arg))
+		if err != nil {
+			fail(field, arg, err)
+			continue
+		}
+
+		parsed = append(parsed, host)
+	}
+
+	return parsed
+}
+
+func parseAddr(arg string) (netip.Addr, error) {
+	if arg == "" {
+		return netip.Addr{}, ErrMissingValue
+	}
+
+	addr, err := netip.ParseAddr(arg)
+	if err != nil {
+		return netip.Addr{}, ErrInvalidAddress
+	}
+
+	return addr, nil
+}
+
+// Parse ip address or host name
+func parseHost(arg string) (string, error) {
+	if arg == "" {
+		return "", ErrMissingValue
+	}
+
+	if addr, err := netip.ParseAddr(arg); err == nil {
+		return addr.String(), nil
+	}
+
+	if len(arg) > 253 {
+		return "", ErrInvalidHost
+	}
+
+	labels := strings.Split(strings.TrimSuffix(arg, "."), ".")
+
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", ErrInvalidHost
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return "", ErrInvalidHost
+			}
+		}
+	}
+
+	// top level domain is never numeric, it is rather malformed ip address
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return "", ErrInvalidHost
+	}
+
+	return arg, nil
+}
+
+// Parse name of pluggable strategy, it consists of lower case letters, digits and hyphens
+func parseName(arg, defaultName string) (string, error) {
+	if arg == "" {
+		return defaultName, nil
+	}
+
+	for _, c := range arg {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return "", ErrInvalidName
+		}
+	}
+
+	return arg, nil
+}
+
+// Parse name of registered strategy, round-robin is used by default
+func parseBalance(arg string) (string, error) {
+	name, err := parseName(arg, BalanceRoundRobin)
+	if err != nil {
+		return "", err
+	}
+
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+
+	if !balancers[name] {
+		return "", ErrUnknownBalancer
+	}
+
+	return name, nil
+}
+
+func parseTimeout(arg string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(arg)
+	if err != nil || timeout <= 0 {
+		return 0, ErrInvalidDuration
+	}
+
+	return timeout, nil
+}
+
+// Parse port in form [local:]remote[/network] e.g. 443, 15432:5432 or 53/udp
+func parsePort(arg, defaultNetwork string) (Port, error) {
+	numbers, network, found := strings.Cut(arg, "/")
+	if !found {
+		network = defaultNetwork
+	}
+
+	if network != NetworkTCP && network != NetworkUDP {
+		return Port{}, ErrInvalidNetwork
+	}
+
+	local, remote, found := strings.Cut(numbers, ":")
+	if !found {
+		remote = local
+	}
+
+	lport, err := parsePortNumber(local)
+	if err != nil {
+		return Port{}, err
+	}
+
+	rport, err := parsePortNumber(remote)
+	if err != nil {
+		return Port{}, err
+	}
+
+	return Port{Local: lport, Remote: rport, Network: network}, nil
+}
+
+func parsePortNumber(arg string) (uint16, error) {
+	ipPort, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, ErrInvalidPort
+	}
+
+	if ipPort < 0 || ipPort > math.MaxUint16 {
+		return 0, ErrInvalidPort
+	}
+
+	return uint16(ipPort), nil
+}
+
+func (route Route) String() string {
+	return fmt.Sprintf("{%s: %s -> %v (%s) for ports %v}", route.Name, route.Local, route.Remotes, route.Balance, route.Ports)
+}
+
+func (port Port) String() string {
+	if port.Local == port.Remote {
+		return fmt.Sprintf("%d/%s", port.Local, port.Network)
+	}
+
+	return fmt.Sprintf("%d:%d/%s", port.Local, port.Remote, port.Network)
+}
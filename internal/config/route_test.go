@@ -0,0 +1,194 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConfigValidation(t *testing.T) {
+	t.Parallel()
+
+	t.Run("All_errors_reported", func(t *testing.T) {
+		t.Parallel()
+
+		specs := []routeSpec{
+			{Name: "db", Listen: "127.0.0.1", Remote: "10.0.0.300", Ports: []string{"5432", "s5433"}},
+			{Name: "dns", Listen: "", Remote: "10.0.0.53", Protocol: "sctp", Ports: []string{"53"}, UDPTimeout: "-1s"},
+			{Name: "web", Listen: "127.0.0.1", Remote: "10.0.0.80", Ports: []string{"443"}, IdleTimeout: "5", MaxLifetime: "-1h", WriteTimeout: "0s"},
+		}
+
+		_, err := newConfig(fileConfig{Routes: specs})
+
+		assert.ErrorIs(t, err, ErrInvalidParameter)
+
+		fields := map[string]string{}
+
+		for _, ferr := range fieldErrors(err) {
+			fields[ferr.Route+"."+ferr.Field] = ferr.Value
+		}
+
+		assert.EqualValues(t, map[string]string{
+			"db.remote":         "10.0.0.300",
+			"db.ports":          "s5433",
+			"dns.listen":        "",
+			"dns.protocol":      "sctp",
+			"dns.ports":         "53",
+			"dns.udp_timeout":   "-1s",
+			"web.idle_timeout":  "5",
+			"web.max_lifetime":  "-1h",
+			"web.write_timeout": "0s",
+		}, fields)
+	})
+
+	t.Run("Duplicate_name_and_listener", func(t *testing.T) {
+		t.Parallel()
+
+		specs := []routeSpec{
+			{Name: "db", Listen: "127.0.0.1", Remote: "10.0.0.1", Ports: []string{"5432"}},
+			{Name: "db", Listen: "127.0.0.1", Remote: "10.0.0.2", Ports: []string{"5432", "5432/udp"}},
+		}
+
+		_, err := newConfig(fileConfig{Routes: specs})
+
+		assert.ErrorIs(t, err, ErrDuplicateValue)
+		assert.Len(t, fieldErrors(err), 2)
+	})
+
+	t.Run("Default_name", func(t *testing.T) {
+		t.Parallel()
+
+		cfg, err := newConfig(fileConfig{Routes: []routeSpec{{Listen: "127.0.0.1", Remote: "10.0.0.1", Ports: []string{"5432"}}}})
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, "route-1", cfg.Routes()[0].Name)
+	})
+
+	t.Run("No_routes", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newConfig(fileConfig{})
+
+		assert.ErrorIs(t, err, ErrMissingValue)
+	})
+}
+
+func TestParseHost(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		host string
+		err  error
+	}{
+		"ipv4":           {host: "10.0.0.1"},
+		"ipv6":           {host: "fd00::1"},
+		"host name":      {host: "db-1.vpn.example.com"},
+		"fqdn":           {host: "db.vpn."},
+		"single label":   {host: "db"},
+		"empty":          {host: "", err: ErrMissingValue},
+		"with port":      {host: "db.vpn:5432", err: ErrInvalidHost},
+		"malformed ip":   {host: "10.0.0.300", err: ErrInvalidHost},
+		"underscore":     {host: "db_1.vpn", err: ErrInvalidHost},
+		"leading hyphen": {host: "-db.vpn", err: ErrInvalidHost},
+		"empty label":    {host: "db..vpn", err: ErrInvalidHost},
+		"too long label": {host: strings.Repeat("a", 64) + ".vpn", err: ErrInvalidHost},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			host, err := parseHost(test.host)
+
+			assert.ErrorIs(t, err, test.err)
+
+			if test.err == nil {
+				assert.EqualValues(t, test.host, host)
+			}
+		})
+	}
+}
+
+func TestParseBalance(t *testing.T) {
+	t.Parallel()
+
+	RegisterBalancer("custom-test")
+
+	tests := map[string]struct {
+		balance string
+		name    string
+		err     error
+	}{
+		"default":    {name: BalanceRoundRobin},
+		"built-in":   {balance: BalanceLeastConn, name: BalanceLeastConn},
+		"registered": {balance: "custom-test", name: "custom-test"},
+		"typo":       {balance: "leastcon", err: ErrUnknownBalancer},
+		"malformed":  {balance: "Least Conn", err: ErrInvalidName},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			balance, err := parseBalance(test.balance)
+
+			assert.ErrorIs(t, err, test.err)
+			assert.EqualValues(t, test.name, balance)
+		})
+	}
+}
+
+func TestFieldError(t *testing.T) {
+	t.Parallel()
+
+	err := &FieldError{Route: "db", Field: "ports", Value: "s5432", Err: ErrInvalidPort}
+
+	assert.ErrorIs(t, err, ErrInvalidParameter)
+	assert.ErrorIs(t, err, ErrInvalidPort)
+	assert.EqualValues(t, `route "db" field "ports" value "s5432": not valid ip port`, err.Error())
+
+	err = &FieldError{Field: "resolver.address", Value: "dns", Err: ErrInvalidAddress}
+
+	assert.EqualValues(t, `field "resolver.address" value "dns": not valid ip address`, err.Error())
+}
+
+// Unwrap joined field errors
+func fieldErrors(err error) []*FieldError {
+	ferrs := []*FieldError{}
+
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			var ferr *FieldError
+			if errors.As(err, &ferr) {
+				ferrs = append(ferrs, ferr)
+			}
+		}
+	}
+
+	return ferrs
+}
@@ -0,0 +1,205 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"crypto/tls"
+	"strings"
+)
+
+// Default min version of tls
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+// Tls termination of tcp ports of route, decrypted stream is relayed to remote
+type TLS struct {
+	// Pem file of certificate chain, termination is disabled if empty
+	CertFile string
+	// Pem file of private key
+	KeyFile string
+	// Pem bundle of CAs which client certificates are verified against, client certificate is required if set
+	ClientCAFile string
+	// Min version of tls
+	MinVersion uint16
+	// Cipher suites of tls 1.2 and older versions, go defaults are used if empty
+	CipherSuites []uint16
+}
+
+// Tls as it is described in config file or command line args
+type tlsSpec struct {
+	Cert         string   `yaml:"cert"`
+	Key          string   `yaml:"key"`
+	ClientCA     string   `yaml:"client_ca"`
+	MinVersion   string   `yaml:"min_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+}
+
+// Tls origination toward remotes of tcp ports of route, plaintext stream of client is encrypted
+type RemoteTLS struct {
+	// Whether connections to remotes are wrapped in tls
+	Enabled bool
+	// Server name sent in SNI and verified against remote certificate, remote host is used if empty
+	ServerName string
+	// Pem bundle of CAs which remote certificates are verified against, system roots are used if empty
+	CAFile string
+	// Pem file of client certificate chain, no client certificate is sent if empty
+	CertFile string
+	// Pem file of private key of client certificate
+	KeyFile string
+	// Remote certificates are not verified at all
+	InsecureSkipVerify bool
+	// Min version of tls
+	MinVersion uint16
+}
+
+// Remote tls as it is described in config file or command line args
+type remoteTLSSpec struct {
+	Enabled            bool   `yaml:"enabled"`
+	ServerName         string `yaml:"server_name"`
+	CA                 string `yaml:"ca"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	MinVersion         string `yaml:"min_version"`
+}
+
+// Validate tls spec, files are loaded once route is started
+func newTLS(spec tlsSpec, fail func(field, value string, err error)) TLS {
+	cfg := TLS{CertFile: spec.Cert, KeyFile: spec.Key, ClientCAFile: spec.ClientCA, MinVersion: DefaultTLSMinVersion}
+
+	var err error
+
+	if spec.Cert == "" && spec.Key == "" {
+		if spec.ClientCA != "" || spec.MinVersion != "" || len(spec.CipherSuites) != 0 {
+			fail("tls.cert", "", ErrMissingValue)
+		}
+
+		return TLS{}
+	}
+
+	if spec.Cert == "" {
+		fail("tls.cert", "", ErrMissingValue)
+	}
+
+	if spec.Key == "" {
+		fail("tls.key", "", ErrMissingValue)
+	}
+
+	if spec.MinVersion != "" {
+		if cfg.MinVersion, err = parseTLSVersion(spec.MinVersion); err != nil {
+			fail("tls.min_version", spec.MinVersion, err)
+		}
+	}
+
+	cfg.CipherSuites = parseCipherSuites(spec.CipherSuites, "tls.cipher_suites", fail)
+
+	return cfg
+}
+
+// Validate remote tls spec, any option enables tls, files are loaded once route is started
+func newRemoteTLS(spec remoteTLSSpec, fail func(field, value string, err error)) RemoteTLS {
+	if spec == (remoteTLSSpec{}) {
+		return RemoteTLS{}
+	}
+
+	cfg := RemoteTLS{
+		Enabled:            true,
+		ServerName:         spec.ServerName,
+		CAFile:             spec.CA,
+		CertFile:           spec.Cert,
+		KeyFile:            spec.Key,
+		InsecureSkipVerify: spec.InsecureSkipVerify,
+		MinVersion:         DefaultTLSMinVersion,
+	}
+
+	var err error
+
+	if spec.ServerName != "" {
+		if _, err := parseHost(spec.ServerName); err != nil {
+			fail("remote_tls.server_name", spec.ServerName, err)
+		}
+	}
+
+	if spec.Cert != "" && spec.Key == "" {
+		fail("remote_tls.key", "", ErrMissingValue)
+	}
+
+	if spec.Key != "" && spec.Cert == "" {
+		fail("remote_tls.cert", "", ErrMissingValue)
+	}
+
+	if spec.InsecureSkipVerify && spec.CA != "" {
+		fail("remote_tls.insecure_skip_verify", "true", ErrConflictingValue)
+	}
+
+	if spec.MinVersion != "" {
+		if cfg.MinVersion, err = parseTLSVersion(spec.MinVersion); err != nil {
+			fail("remote_tls.min_version", spec.MinVersion, err)
+		}
+	}
+
+	return cfg
+}
+
+// Parse tls version e.g. 1.2
+func parseTLSVersion(arg string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(arg), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, ErrInvalidTLSVersion
+}
+
+// Parse names of secure cipher suites e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func parseCipherSuites(args []string, field string, fail func(field, value string, err error)) []uint16 {
+	if len(args) == 0 {
+		return nil
+	}
+
+	known := map[string]uint16{}
+
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := []uint16{}
+
+	for _, arg := range args {
+		id, ok := known[strings.TrimSpace(arg)]
+		if !ok {
+			fail(field, arg, ErrInvalidCipherSuite)
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids
+}
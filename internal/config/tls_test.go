@@ -0,0 +1,166 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTLS(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   tlsSpec
+		tls    TLS
+		fields []string
+	}{
+		"disabled": {
+			spec: tlsSpec{},
+			tls:  TLS{},
+		},
+		"default": {
+			spec: tlsSpec{Cert: "server.pem", Key: "server.key"},
+			tls:  TLS{CertFile: "server.pem", KeyFile: "server.key", MinVersion: tls.VersionTLS12},
+		},
+		"mtls": {
+			spec: tlsSpec{
+				Cert:         "server.pem",
+				Key:          "server.key",
+				ClientCA:     "ca.pem",
+				MinVersion:   "1.3",
+				CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+			},
+			tls: TLS{
+				CertFile:     "server.pem",
+				KeyFile:      "server.key",
+				ClientCAFile: "ca.pem",
+				MinVersion:   tls.VersionTLS13,
+				CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+			},
+		},
+		"options without cert": {
+			spec:   tlsSpec{ClientCA: "ca.pem"},
+			fields: []string{"tls.cert"},
+		},
+		"all failed": {
+			spec:   tlsSpec{Cert: "server.pem", MinVersion: "1.4", CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA", "AES"}},
+			fields: []string{"tls.key", "tls.min_version", "tls.cipher_suites", "tls.cipher_suites"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fields := []string{}
+
+			cfg := newTLS(test.spec, func(field, _ string, _ error) {
+				fields = append(fields, field)
+			})
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.tls, cfg)
+		})
+	}
+}
+
+func TestNewRemoteTLS(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   remoteTLSSpec
+		tls    RemoteTLS
+		fields []string
+	}{
+		"disabled": {
+			spec: remoteTLSSpec{},
+			tls:  RemoteTLS{},
+		},
+		"enabled with defaults": {
+			spec: remoteTLSSpec{Enabled: true},
+			tls:  RemoteTLS{Enabled: true, MinVersion: tls.VersionTLS12},
+		},
+		"mtls": {
+			spec: remoteTLSSpec{ServerName: "db.vpn", CA: "ca.pem", Cert: "client.pem", Key: "client.key", MinVersion: "1.3"},
+			tls: RemoteTLS{
+				Enabled:    true,
+				ServerName: "db.vpn",
+				CAFile:     "ca.pem",
+				CertFile:   "client.pem",
+				KeyFile:    "client.key",
+				MinVersion: tls.VersionTLS13,
+			},
+		},
+		"insecure": {
+			spec: remoteTLSSpec{InsecureSkipVerify: true, ServerName: "db.vpn"},
+			tls:  RemoteTLS{Enabled: true, ServerName: "db.vpn", InsecureSkipVerify: true, MinVersion: tls.VersionTLS12},
+		},
+		"failed": {
+			spec:   remoteTLSSpec{ServerName: "db_vpn", CA: "ca.pem", Key: "client.key", InsecureSkipVerify: true, MinVersion: "2"},
+			fields: []string{"remote_tls.server_name", "remote_tls.cert", "remote_tls.insecure_skip_verify", "remote_tls.min_version"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fields := []string{}
+
+			cfg := newRemoteTLS(test.spec, func(field, _ string, _ error) {
+				fields = append(fields, field)
+			})
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.EqualValues(t, test.tls, cfg)
+		})
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	t.Parallel()
+
+	for arg, version := range map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "TLS1.2": tls.VersionTLS12, "tls13": tls.VersionTLS13} {
+		parsed, err := parseTLSVersion(arg)
+
+		assert.NoError(t, err, arg)
+		assert.EqualValues(t, version, parsed, arg)
+	}
+
+	_, err := parseTLSVersion("ssl3")
+	assert.ErrorIs(t, err, ErrInvalidTLSVersion)
+}
@@ -0,0 +1,128 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Methods of recovering original destination of clients in transparent mode
+const (
+	// Destination is kept by conntrack for connections redirected by iptables REDIRECT or DNAT
+	TransparentRedirect = "redirect"
+	// Destination is local address of connection delivered by iptables TPROXY, listener needs CAP_NET_ADMIN
+	TransparentTProxy = "tproxy"
+)
+
+// Transparent proxying of redirected clients to their original destinations
+type Transparent struct {
+	// Method of recovering original destination
+	Method string
+	// Remapping of original destinations, first matching rule wins and destination is connected as is without match
+	Rules []TransparentRule
+}
+
+// Remapping of original destinations
+type TransparentRule struct {
+	// Original destination addresses
+	Match netip.Prefix
+	// Original destination ports, any port matches if empty
+	Ports []PortRange
+	// Ip address or host name connected instead of original address, it is kept if empty
+	Remote string
+	// Port connected instead of original port, it is kept if zero
+	Port uint16
+}
+
+// Transparent proxying as it is described in config file or command line args
+type transparentSpec struct {
+	Method string                `yaml:"method"`
+	Rules  []transparentRuleSpec `yaml:"rules"`
+}
+
+// Remapping rule as it is described in config file
+type transparentRuleSpec struct {
+	Match  string   `yaml:"match"`
+	Ports  []string `yaml:"ports"`
+	Remote string   `yaml:"remote"`
+	Port   string   `yaml:"port"`
+}
+
+// Validate transparent spec, redirect method is used by default
+func newTransparent(spec transparentSpec, fail func(field, value string, err error)) Transparent {
+	transparent := Transparent{Method: TransparentRedirect}
+
+	switch spec.Method {
+	case "", TransparentRedirect:
+	case TransparentTProxy:
+		transparent.Method = spec.Method
+	default:
+		fail("transparent.method", spec.Method, ErrInvalidName)
+	}
+
+	for _, ruleSpec := range spec.Rules {
+		rule := TransparentRule{}
+
+		var err error
+
+		if rule.Match, err = parsePrefix(strings.TrimSpace(ruleSpec.Match)); err != nil {
+			fail("transparent.rules.match", ruleSpec.Match, err)
+			continue
+		}
+
+		for _, arg := range ruleSpec.Ports {
+			ports, err := parsePortRange(strings.TrimSpace(arg))
+			if err != nil {
+				fail("transparent.rules.ports", arg, err)
+				continue
+			}
+
+			rule.Ports = append(rule.Ports, ports)
+		}
+
+		if ruleSpec.Remote == "" && ruleSpec.Port == "" {
+			fail("transparent.rules.remote", "", ErrMissingValue)
+			continue
+		}
+
+		if ruleSpec.Remote != "" {
+			if rule.Remote, err = parseHost(strings.TrimSpace(ruleSpec.Remote)); err != nil {
+				fail("transparent.rules.remote", ruleSpec.Remote, err)
+				continue
+			}
+		}
+
+		if ruleSpec.Port != "" {
+			if rule.Port, err = parsePortNumber(strings.TrimSpace(ruleSpec.Port)); err != nil || rule.Port == 0 {
+				fail("transparent.rules.port", ruleSpec.Port, ErrInvalidPort)
+				continue
+			}
+		}
+
+		transparent.Rules = append(transparent.Rules, rule)
+	}
+
+	return transparent
+}
@@ -0,0 +1,138 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransparent(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec        routeSpec
+		transparent Transparent
+		fields      []string
+	}{
+		"redirect by default": {
+			spec:        routeSpec{Listen: "127.0.0.1", Mode: "transparent", Ports: []string{"15001"}},
+			transparent: Transparent{Method: TransparentRedirect},
+		},
+		"tproxy with rules": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "transparent",
+				Ports:  []string{"15001"},
+				Transparent: &transparentSpec{
+					Method: "tproxy",
+					Rules: []transparentRuleSpec{
+						{Match: "10.0.0.0/8", Ports: []string{"80", "8000-8999"}, Remote: "proxy.vpn", Port: "3128"},
+						{Match: "fd00::1", Remote: "fd00::2"},
+						{Match: "192.168.0.0/16", Port: "8443"},
+					},
+				},
+			},
+			transparent: Transparent{
+				Method: TransparentTProxy,
+				Rules: []TransparentRule{
+					{
+						Match:  netip.MustParsePrefix("10.0.0.0/8"),
+						Ports:  []PortRange{{First: 80, Last: 80}, {First: 8000, Last: 8999}},
+						Remote: "proxy.vpn",
+						Port:   3128,
+					},
+					{Match: netip.MustParsePrefix("fd00::1/128"), Remote: "fd00::2"},
+					{Match: netip.MustParsePrefix("192.168.0.0/16"), Port: 8443},
+				},
+			},
+		},
+		"transparent failed": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "transparent",
+				Remote: "10.0.0.1",
+				Ports:  []string{"15001:80", "15002/udp"},
+				Transparent: &transparentSpec{
+					Method: "nat",
+					Rules: []transparentRuleSpec{
+						{Match: "10.0.0.0/33", Remote: "proxy.vpn"},
+						{Match: "10.0.0.0/8", Ports: []string{"0"}, Remote: "proxy_vpn"},
+						{Match: "10.0.0.0/8", Port: "0"},
+						{Match: "10.0.0.0/8"},
+					},
+				},
+			},
+			fields: []string{
+				"remote",
+				"transparent.method",
+				"transparent.rules.match",
+				"transparent.rules.ports",
+				"transparent.rules.remote",
+				"transparent.rules.port",
+				"transparent.rules.remote",
+				"protocol",
+				"ports",
+			},
+		},
+		"transparent in forward mode failed": {
+			spec:   routeSpec{Listen: "127.0.0.1", Remote: "10.0.0.1", Ports: []string{"443"}, Transparent: &transparentSpec{Method: "tproxy"}},
+			fields: []string{"transparent"},
+		},
+		"tunnel in transparent mode failed": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "transparent",
+				Ports:  []string{"15001"},
+				Tunnel: &tunnelSpec{Destinations: aclSpec{Allow: []string{"10.0.0.0/8"}}},
+			},
+			fields: []string{"tunnel"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			route, errs := newRoute(test.spec)
+
+			fields := []string{}
+
+			for _, err := range errs {
+				fields = append(fields, err.(*FieldError).Field)
+			}
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.Empty(t, route.Remotes)
+			assert.EqualValues(t, test.transparent, route.Transparent)
+		})
+	}
+}
@@ -0,0 +1,147 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"strings"
+	"time"
+)
+
+// Default timeout of receiving tunnel request from client
+const DefaultTunnelTimeout = 10 * time.Second
+
+// Tunnels of clients to destinations they ask for in tunnel modes
+type Tunnel struct {
+	// Password of every user, clients are not authenticated if empty
+	Users map[string]string
+	// Allowed destination addresses, host name is allowed by its allowed addresses.
+	// Allow list is never empty, so route is not an open proxy.
+	Destinations ACL
+	// Allowed destination ports, any port is allowed if empty
+	Ports []PortRange
+	// Relay datagrams of socks5 clients
+	UDP bool
+	// Request of client has to be received within this long
+	Timeout time.Duration
+}
+
+// Inclusive range of ports
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// Tunnel as it is described in config file or command line args
+type tunnelSpec struct {
+	Users        map[string]string `yaml:"users"`
+	Destinations aclSpec           `yaml:",inline"`
+	Ports        []string          `yaml:"ports"`
+	UDP          bool              `yaml:"udp"`
+	Timeout      string            `yaml:"timeout"`
+}
+
+// Validate tunnel spec of mode, destinations have to be allowed explicitly
+func newTunnel(spec tunnelSpec, mode string, fail func(field, value string, err error)) Tunnel {
+	tunnel := Tunnel{Timeout: DefaultTunnelTimeout, UDP: spec.UDP}
+
+	for user, password := range spec.Users {
+		// length of both is sent in single byte by socks5 clients
+		if user == "" || len(user) > 255 || strings.Contains(user, ":") {
+			fail("tunnel.users", user, ErrInvalidName)
+			continue
+		}
+
+		if password == "" || len(password) > 255 {
+			fail("tunnel.users", user, ErrInvalidPassword)
+			continue
+		}
+
+		if tunnel.Users == nil {
+			tunnel.Users = map[string]string{}
+		}
+
+		tunnel.Users[user] = password
+	}
+
+	tunnel.Destinations = newACL(spec.Destinations, func(field, value string, err error) {
+		fail("tunnel."+field, value, err)
+	})
+
+	if len(spec.Destinations.Allow) == 0 {
+		fail("tunnel.allow", "", ErrMissingValue)
+	}
+
+	for _, arg := range spec.Ports {
+		ports, err := parsePortRange(strings.TrimSpace(arg))
+		if err != nil {
+			fail("tunnel.ports", arg, err)
+			continue
+		}
+
+		tunnel.Ports = append(tunnel.Ports, ports)
+	}
+
+	if spec.UDP && mode != ModeSOCKS5 {
+		fail("tunnel.udp", "true", ErrConflictingValue)
+	}
+
+	if spec.Timeout != "" {
+		var err error
+
+		if tunnel.Timeout, err = parseTimeout(spec.Timeout); err != nil {
+			fail("tunnel.timeout", spec.Timeout, err)
+		}
+	}
+
+	return tunnel
+}
+
+// Parse single port or inclusive range of ports e.g. 8000-8999
+func parsePortRange(arg string) (PortRange, error) {
+	first, last, found := strings.Cut(arg, "-")
+	if !found {
+		last = first
+	}
+
+	fport, err := parsePortNumber(first)
+	if err != nil {
+		return PortRange{}, err
+	}
+
+	lport, err := parsePortNumber(last)
+	if err != nil {
+		return PortRange{}, err
+	}
+
+	if fport == 0 || fport > lport {
+		return PortRange{}, ErrInvalidPort
+	}
+
+	return PortRange{First: fport, Last: lport}, nil
+}
+
+// Check whether port is in range
+func (ports PortRange) Contains(port uint16) bool {
+	return port >= ports.First && port <= ports.Last
+}
@@ -0,0 +1,196 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package config
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTunnel(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		spec   routeSpec
+		tunnel Tunnel
+		fields []string
+	}{
+		"socks5": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "socks5",
+				Ports:  []string{"1080"},
+				Tunnel: &tunnelSpec{
+					Users:        map[string]string{"alice": "secret"},
+					Destinations: aclSpec{Allow: []string{"10.0.0.0/8", "fd00::/8"}, Deny: []string{"10.0.0.1"}},
+					Ports:        []string{"22", " 8000-8999"},
+					UDP:          true,
+					Timeout:      "5s",
+				},
+			},
+			tunnel: Tunnel{
+				Users: map[string]string{"alice": "secret"},
+				Destinations: ACL{
+					Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")},
+					Deny:  []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+				},
+				Ports:   []PortRange{{First: 22, Last: 22}, {First: 8000, Last: 8999}},
+				UDP:     true,
+				Timeout: 5 * time.Second,
+			},
+		},
+		"socks5 with defaults": {
+			spec: routeSpec{Listen: "127.0.0.1", Mode: "socks5", Ports: []string{"1080"}, Tunnel: &tunnelSpec{Destinations: aclSpec{Allow: []string{"0.0.0.0/0"}}}},
+			tunnel: Tunnel{
+				Destinations: ACL{Allow: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}},
+				Timeout:      DefaultTunnelTimeout,
+			},
+		},
+		"connect": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "connect",
+				Ports:  []string{"3128"},
+				Tunnel: &tunnelSpec{Users: map[string]string{"alice": "secret"}, Destinations: aclSpec{Allow: []string{"10.0.0.0/8"}}, Ports: []string{"443"}},
+			},
+			tunnel: Tunnel{
+				Users:        map[string]string{"alice": "secret"},
+				Destinations: ACL{Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+				Ports:        []PortRange{{First: 443, Last: 443}},
+				Timeout:      DefaultTunnelTimeout,
+			},
+		},
+		"udp in connect mode failed": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "connect",
+				Ports:  []string{"3128"},
+				Tunnel: &tunnelSpec{Destinations: aclSpec{Allow: []string{"10.0.0.0/8"}}, UDP: true},
+			},
+			fields: []string{"tunnel.udp"},
+		},
+		"socks5 failed": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "socks5",
+				Remote: "10.0.0.1",
+				Ports:  []string{"1080:1081", "1082/udp"},
+				Hosts:  []hostRouteSpec{{Host: "git.example.com", Remote: "10.0.0.2"}},
+				Tunnel: &tunnelSpec{
+					Users:        map[string]string{"alice:": "secret"},
+					Destinations: aclSpec{Allow: []string{"10.0.0.0/33"}},
+					Ports:        []string{"0", "9000-8000"},
+					Timeout:      "0s",
+				},
+			},
+			fields: []string{
+				"remote", "hosts", "tunnel.users", "tunnel.allow", "tunnel.ports", "tunnel.ports", "tunnel.timeout", "protocol", "ports",
+			},
+		},
+		"missing allowed destinations failed": {
+			spec:   routeSpec{Listen: "127.0.0.1", Mode: "socks5", Ports: []string{"1080"}},
+			fields: []string{"tunnel.allow"},
+		},
+		"missing password failed": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Mode:   "socks5",
+				Ports:  []string{"1080"},
+				Tunnel: &tunnelSpec{Users: map[string]string{"alice": ""}, Destinations: aclSpec{Allow: []string{"10.0.0.0/8"}}},
+			},
+			fields: []string{"tunnel.users"},
+		},
+		"tunnel in forward mode failed": {
+			spec: routeSpec{
+				Listen: "127.0.0.1",
+				Remote: "10.0.0.1",
+				Ports:  []string{"443"},
+				Tunnel: &tunnelSpec{Destinations: aclSpec{Allow: []string{"10.0.0.0/8"}}},
+			},
+			fields: []string{"tunnel"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			route, errs := newRoute(test.spec)
+
+			fields := []string{}
+
+			for _, err := range errs {
+				fields = append(fields, err.(*FieldError).Field)
+			}
+
+			if len(test.fields) != 0 {
+				assert.EqualValues(t, test.fields, fields)
+				return
+			}
+
+			assert.Empty(t, fields)
+			assert.Empty(t, route.Remotes)
+			assert.EqualValues(t, test.tunnel, route.Tunnel)
+		})
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		arg   string
+		ports PortRange
+		ok    bool
+	}{
+		"single":          {arg: "22", ports: PortRange{First: 22, Last: 22}, ok: true},
+		"range":           {arg: "8000-8999", ports: PortRange{First: 8000, Last: 8999}, ok: true},
+		"zero failed":     {arg: "0-10"},
+		"reversed failed": {arg: "10-1"},
+		"open failed":     {arg: "10-"},
+		"name failed":     {arg: "ssh"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ports, err := parsePortRange(test.arg)
+
+			if !test.ok {
+				assert.ErrorIs(t, err, ErrInvalidPort)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.EqualValues(t, test.ports, ports)
+			assert.True(t, ports.Contains(test.ports.First))
+			assert.True(t, ports.Contains(test.ports.Last))
+			assert.False(t, ports.Contains(test.ports.Last+1))
+		})
+	}
+}
@@ -0,0 +1,405 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Content type of prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Set of metric families written in registration order
+type Registry struct {
+	mu       *sync.Mutex
+	families []family
+}
+
+// Metric family which could write itself in text format
+type family interface {
+	write(w io.Writer) error
+}
+
+// Monotonic counter
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Gauge which could go up and down
+type Gauge struct {
+	value atomic.Int64
+}
+
+// Histogram of observed values with cumulative buckets
+type Histogram struct {
+	mu *sync.Mutex
+	// Upper bounds of buckets, +Inf bucket is implicit
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Counters by label values
+type CounterVec struct {
+	vec *vec[*Counter]
+}
+
+// Gauges by label values
+type GaugeVec struct {
+	vec *vec[*Gauge]
+}
+
+// Histograms by label values
+type HistogramVec struct {
+	vec *vec[*Histogram]
+}
+
+// Series of single metric family
+type vec[T any] struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	create func() T
+	print  func(w io.Writer, name, labels string, metric T) error
+	mu     *sync.Mutex
+	series map[string]*series[T]
+}
+
+// Metric with its label values
+type series[T any] struct {
+	values []string
+	metric T
+}
+
+// Create empty registry
+func NewRegistry() *Registry {
+	return &Registry{mu: &sync.Mutex{}}
+}
+
+// Register counter family
+func (reg *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{vec: newVec(name, help, "counter", labels,
+		func() *Counter { return &Counter{} },
+		func(w io.Writer, name, labels string, c *Counter) error {
+			_, err := fmt.Fprintf(w, "%s%s %d\n", name, labels, c.Value())
+			return err
+		})}
+
+	reg.register(cv.vec)
+
+	return cv
+}
+
+// Register gauge family
+func (reg *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	gv := &GaugeVec{vec: newVec(name, help, "gauge", labels,
+		func() *Gauge { return &Gauge{} },
+		func(w io.Writer, name, labels string, g *Gauge) error {
+			_, err := fmt.Fprintf(w, "%s%s %d\n", name, labels, g.Value())
+			return err
+		})}
+
+	reg.register(gv.vec)
+
+	return gv
+}
+
+// Register histogram family with sorted upper bounds of buckets
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	hv := &HistogramVec{vec: newVec(name, help, "histogram", labels,
+		func() *Histogram {
+			return &Histogram{mu: &sync.Mutex{}, buckets: buckets, counts: make([]uint64, len(buckets))}
+		},
+		func(w io.Writer, name, labels string, h *Histogram) error {
+			return h.write(w, name, labels)
+		})}
+
+	reg.register(hv.vec)
+
+	return hv
+}
+
+// Write all families in prometheus text format
+func (reg *Registry) Write(w io.Writer) error {
+	reg.mu.Lock()
+	families := slices.Clone(reg.families)
+	reg.mu.Unlock()
+
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Serve metrics over http
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+
+	reg.Write(w)
+}
+
+func (reg *Registry) register(f family) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.families = append(reg.families, f)
+}
+
+// Get counter by label values, values are matched to labels by position
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.vec.with(values)
+}
+
+// Get gauge by label values, values are matched to labels by position
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	return gv.vec.with(values)
+}
+
+// Get histogram by label values, values are matched to labels by position
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.vec.with(values)
+}
+
+// Increment counter by one, nil counter is ignored
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Increment counter by n, nil counter is ignored
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+
+	c.value.Add(n)
+}
+
+// Current value of counter
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Increment gauge by one, nil gauge is ignored
+func (g *Gauge) Inc() {
+	if g == nil {
+		return
+	}
+
+	g.value.Add(1)
+}
+
+// Decrement gauge by one, nil gauge is ignored
+func (g *Gauge) Dec() {
+	if g == nil {
+		return
+	}
+
+	g.value.Add(-1)
+}
+
+// Current value of gauge
+func (g *Gauge) Value() int64 {
+	return g.value.Load()
+}
+
+// Add value to histogram
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+// Number of observed values
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.count
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) error {
+	h.mu.Lock()
+	counts, count, sum := slices.Clone(h.counts), h.count, h.sum
+	h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatFloat(bound)), counts[i]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), count); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(sum)); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+
+	return err
+}
+
+func newVec[T any](name, help, typ string, labels []string, create func() T, print func(io.Writer, string, string, T) error) *vec[T] {
+	return &vec[T]{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		create: create,
+		print:  print,
+		mu:     &sync.Mutex{},
+		series: map[string]*series[T]{},
+	}
+}
+
+func (v *vec[T]) with(values []string) T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &series[T]{values: slices.Clone(values), metric: v.create()}
+		v.series[key] = s
+	}
+
+	return s.metric
+}
+
+// Write family header and every series sorted by label values
+func (v *vec[T]) write(w io.Writer) error {
+	v.mu.Lock()
+
+	keys := make([]string, 0, len(v.series))
+
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	all := make([]*series[T], 0, len(keys))
+
+	for _, key := range keys {
+		all = append(all, v.series[key])
+	}
+
+	v.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.typ); err != nil {
+		return err
+	}
+
+	for _, s := range all {
+		if err := v.print(w, v.name, formatLabels(v.labels, s.values), s.metric); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Format label set as {name="value",...}, empty string if there are no labels
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	sb := strings.Builder{}
+
+	sb.WriteByte('{')
+
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(values[i]))
+		sb.WriteByte('"')
+	}
+
+	sb.WriteByte('}')
+
+	return sb.String()
+}
+
+// Append label to formatted label set
+func withLabel(labels, name, value string) string {
+	label := name + `="` + escapeLabel(value) + `"`
+
+	if labels == "" {
+		return "{" + label + "}"
+	}
+
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,129 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success_text_format", func(t *testing.T) {
+		t.Parallel()
+
+		reg := NewRegistry()
+
+		counter := reg.NewCounter("test_requests_total", "Requests\nserved.", "route", "port")
+		gauge := reg.NewGauge("test_active", "Active requests.")
+		histogram := reg.NewHistogram("test_duration_seconds", "Request duration.", []float64{0.5, 1}, "route")
+
+		counter.With("b", "443/tcp").Add(3)
+		counter.With("a", `quo"te`).Inc()
+		gauge.With().Inc()
+		gauge.With().Inc()
+		gauge.With().Dec()
+		histogram.With("a").Observe(0.3)
+		histogram.With("a").Observe(0.7)
+		histogram.With("a").Observe(5)
+
+		sb := &strings.Builder{}
+
+		assert.NoError(t, reg.Write(sb))
+
+		assert.EqualValues(t, `# HELP test_requests_total Requests\nserved.
+# TYPE test_requests_total counter
+test_requests_total{route="a",port="quo\"te"} 1
+test_requests_total{route="b",port="443/tcp"} 3
+# HELP test_active Active requests.
+# TYPE test_active gauge
+test_active 1
+# HELP test_duration_seconds Request duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="a",le="0.5"} 1
+test_duration_seconds_bucket{route="a",le="1"} 2
+test_duration_seconds_bucket{route="a",le="+Inf"} 3
+test_duration_seconds_sum{route="a"} 6
+test_duration_seconds_count{route="a"} 3
+`, sb.String())
+	})
+
+	t.Run("Success_empty_family", func(t *testing.T) {
+		t.Parallel()
+
+		reg := NewRegistry()
+
+		reg.NewCounter("test_total", "Nothing yet.", "route")
+
+		sb := &strings.Builder{}
+
+		assert.NoError(t, reg.Write(sb))
+		assert.EqualValues(t, "# HELP test_total Nothing yet.\n# TYPE test_total counter\n", sb.String())
+	})
+
+	t.Run("Wrong_label_count", func(t *testing.T) {
+		t.Parallel()
+
+		reg := NewRegistry()
+
+		counter := reg.NewCounter("test_total", "Wrong labels.", "route")
+
+		assert.Panics(t, func() { counter.With("a", "b") })
+	})
+}
+
+func TestCounter(t *testing.T) {
+	t.Parallel()
+
+	var counter *Counter
+
+	assert.NotPanics(t, func() { counter.Add(10) })
+
+	counter = &Counter{}
+
+	counter.Add(10)
+	counter.Inc()
+
+	assert.EqualValues(t, 11, counter.Value())
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	reg := NewRegistry()
+
+	reg.NewGauge("test_active", "Active requests.").With().Inc()
+
+	rec := httptest.NewRecorder()
+
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.EqualValues(t, 200, rec.Code)
+	assert.EqualValues(t, ContentType, rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "test_active 1\n")
+}
@@ -0,0 +1,79 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"grelay/internal/config"
+	"net/netip"
+	"sync/atomic"
+)
+
+// Source address filter of route, rules could be replaced while route is running
+type acl struct {
+	rules atomic.Pointer[config.ACL]
+}
+
+// Create filter with rules of route
+func newACL(rules config.ACL) *acl {
+	a := &acl{}
+
+	a.update(rules)
+
+	return a
+}
+
+// Replace rules, they are applied to clients accepted afterwards
+func (a *acl) update(rules config.ACL) {
+	a.rules.Store(&rules)
+}
+
+// Check whether client is allowed, deny prefixes win over allow ones and empty allow list allows everyone.
+// Nil filter allows everyone.
+func (a *acl) permits(client netip.Addr) bool {
+	if a == nil {
+		return true
+	}
+
+	rules := a.rules.Load()
+
+	client = client.Unmap()
+
+	for _, prefix := range rules.Deny {
+		if prefix.Contains(client) {
+			return false
+		}
+	}
+
+	if len(rules.Allow) == 0 {
+		return true
+	}
+
+	for _, prefix := range rules.Allow {
+		if prefix.Contains(client) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,110 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"grelay/internal/config"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+	t.Parallel()
+
+	prefixes := func(args ...string) []netip.Prefix {
+		result := []netip.Prefix{}
+
+		for _, arg := range args {
+			result = append(result, netip.MustParsePrefix(arg))
+		}
+
+		return result
+	}
+
+	tests := map[string]struct {
+		rules   config.ACL
+		allowed []string
+		denied  []string
+	}{
+		"empty allows everyone": {
+			rules:   config.ACL{},
+			allowed: []string{"10.0.0.1", "192.168.1.1", "fd00::1"},
+		},
+		"allow list": {
+			rules:   config.ACL{Allow: prefixes("10.0.0.0/8", "fd00::/8")},
+			allowed: []string{"10.0.0.1", "10.255.0.1", "::ffff:10.0.0.1", "fd00::1"},
+			denied:  []string{"11.0.0.1", "fe80::1"},
+		},
+		"deny list": {
+			rules:   config.ACL{Deny: prefixes("192.168.0.0/16", "2001:db8::/32")},
+			allowed: []string{"10.0.0.1", "2001:db9::1"},
+			denied:  []string{"192.168.1.1", "::ffff:192.168.1.1", "2001:db8::1"},
+		},
+		"deny wins over allow": {
+			rules:   config.ACL{Allow: prefixes("10.0.0.0/8"), Deny: prefixes("10.0.0.13/32")},
+			allowed: []string{"10.0.0.12", "10.0.0.14"},
+			denied:  []string{"10.0.0.13", "172.16.0.1"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			a := newACL(test.rules)
+
+			for _, client := range test.allowed {
+				assert.True(t, a.permits(netip.MustParseAddr(client)), client)
+			}
+
+			for _, client := range test.denied {
+				assert.False(t, a.permits(netip.MustParseAddr(client)), client)
+			}
+		})
+	}
+
+	t.Run("Nil_allows_everyone", func(t *testing.T) {
+		t.Parallel()
+
+		var a *acl
+
+		assert.True(t, a.permits(netip.MustParseAddr("10.0.0.1")))
+	})
+
+	t.Run("Rules_updated", func(t *testing.T) {
+		t.Parallel()
+
+		client := netip.MustParseAddr("10.0.0.1")
+
+		a := newACL(config.ACL{Deny: prefixes("10.0.0.0/8")})
+
+		assert.False(t, a.permits(client))
+
+		a.update(config.ACL{})
+
+		assert.True(t, a.permits(client))
+	})
+}
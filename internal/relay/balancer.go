@@ -0,0 +1,262 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"grelay/internal/config"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Remote peer of route port
+type Backend struct {
+	// Address in host:port form
+	Addr string
+	// State shared by all copies of backend
+	state *backendState
+}
+
+// Load and health of backend
+type backendState struct {
+	// Number of active connections
+	active atomic.Int64
+	// Consecutive dial failures
+	fails atomic.Int64
+	// Backend is ejected until this unix nano time
+	downUntil atomic.Int64
+}
+
+// Strategy to pick backend for new connection.
+// Pick is called from concurrent connection handlers so implementation must be goroutine safe.
+type Balancer interface {
+	// Pick one of healthy backends for connection from client, backends are never empty
+	Pick(client netip.Addr, backends []Backend) Backend
+}
+
+// Create new balancer instance, each route port gets own one
+type BalancerFactory func() Balancer
+
+var (
+	// Guards balancers
+	balancersMu = &sync.Mutex{}
+	// Registered strategies by name
+	balancers = map[string]BalancerFactory{
+		config.BalanceRoundRobin: func() Balancer { return &roundRobinBalancer{} },
+		config.BalanceRandom:     func() Balancer { return randomBalancer{} },
+		config.BalanceLeastConn:  func() Balancer { return leastConnBalancer{} },
+		config.BalanceSourceHash: func() Balancer { return sourceHashBalancer{} },
+	}
+)
+
+// Register custom strategy which could be referenced by name in route config, it has to be done before config is parsed
+func RegisterBalancer(name string, factory BalancerFactory) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+
+	balancers[name] = factory
+
+	config.RegisterBalancer(name)
+}
+
+// Create balancer registered by name
+func newBalancer(name string) (Balancer, error) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+
+	factory, ok := balancers[name]
+	if !ok {
+		return nil, ErrUnknownBalancer
+	}
+
+	return factory(), nil
+}
+
+// Number of active connections to backend
+func (b Backend) Active() int64 {
+	return b.state.active.Load()
+}
+
+// Backend is not ejected by health checks
+func (b Backend) Healthy() bool {
+	return time.Now().UnixNano() >= b.state.downUntil.Load()
+}
+
+// Eject backend until given time
+func (b Backend) eject(until time.Time) {
+	b.state.downUntil.Store(until.UnixNano())
+}
+
+// Eject backend until it is reinstated by reinstate
+func (b Backend) ejectForever() {
+	b.state.downUntil.Store(math.MaxInt64)
+}
+
+// Bring ejected backend back
+func (b Backend) reinstate() {
+	b.state.fails.Store(0)
+	b.state.downUntil.Store(0)
+}
+
+// Backends of route port with selection strategy
+type upstream struct {
+	backends []Backend
+	balancer Balancer
+	// Health checking of backends
+	health config.HealthCheck
+}
+
+// Create upstream of backends addrs
+func newUpstream(addrs []string, balancer Balancer, health config.HealthCheck) *upstream {
+	ups := &upstream{balancer: balancer, health: health}
+
+	for _, addr := range addrs {
+		ups.backends = append(ups.backends, Backend{Addr: addr, state: &backendState{}})
+	}
+
+	return ups
+}
+
+// Pick healthy backend for client and count it as active until release is called
+func (ups *upstream) acquire(client netip.Addr) (Backend, func(), error) {
+	backends := ups.backends
+
+	for i, backend := range ups.backends {
+		if backend.Healthy() {
+			continue
+		}
+
+		// some backends are ejected, pick among rest ones
+		backends = append(make([]Backend, 0, len(ups.backends)), ups.backends[:i]...)
+
+		for _, backend := range ups.backends[i+1:] {
+			if backend.Healthy() {
+				backends = append(backends, backend)
+			}
+		}
+
+		break
+	}
+
+	if len(backends) == 0 {
+		return Backend{}, nil, ErrNoBackend
+	}
+
+	backend := backends[0]
+
+	if len(backends) > 1 {
+		backend = ups.balancer.Pick(client, backends)
+	}
+
+	backend.state.active.Add(1)
+
+	return backend, func() { backend.state.active.Add(-1) }, nil
+}
+
+// Account dial result of backend, it is ejected after configured number of consecutive failures.
+// Ejected backend is back after eject time or once active check succeeds if active checks are enabled.
+func (ups *upstream) report(backend Backend, err error) {
+	if err == nil {
+		backend.state.fails.Store(0)
+		return
+	}
+
+	if ups.health.MaxFails == 0 || backend.state.fails.Add(1) < int64(ups.health.MaxFails) {
+		return
+	}
+
+	backend.state.fails.Store(0)
+
+	if ups.health.Interval > 0 {
+		log.Printf("health: backend %s is ejected after %d dial failures until active check succeeds\n", backend.Addr, ups.health.MaxFails)
+		backend.ejectForever()
+		return
+	}
+
+	log.Printf("health: backend %s is ejected after %d dial failures for %s\n", backend.Addr, ups.health.MaxFails, ups.health.EjectTime)
+
+	backend.eject(time.Now().Add(ups.health.EjectTime))
+}
+
+func (ups *upstream) String() string {
+	addrs := make([]string, 0, len(ups.backends))
+
+	for _, backend := range ups.backends {
+		addrs = append(addrs, backend.Addr)
+	}
+
+	return strings.Join(addrs, ",")
+}
+
+// Pick backends one by one
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func (rrb *roundRobinBalancer) Pick(_ netip.Addr, backends []Backend) Backend {
+	return backends[(rrb.next.Add(1)-1)%uint64(len(backends))]
+}
+
+// Pick random backend
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(_ netip.Addr, backends []Backend) Backend {
+	return backends[rand.IntN(len(backends))]
+}
+
+// Pick backend with least active connections, random one among equal
+type leastConnBalancer struct{}
+
+func (leastConnBalancer) Pick(_ netip.Addr, backends []Backend) Backend {
+	offset := rand.IntN(len(backends))
+
+	least := backends[offset]
+
+	for i := 1; i < len(backends); i++ {
+		backend := backends[(offset+i)%len(backends)]
+
+		if backend.Active() < least.Active() {
+			least = backend
+		}
+	}
+
+	return least
+}
+
+// Pick backend by hash of client ip so same client sticks to same backend
+type sourceHashBalancer struct{}
+
+func (sourceHashBalancer) Pick(client netip.Addr, backends []Backend) Backend {
+	hash := fnv.New32a()
+
+	hash.Write(client.Unmap().AsSlice())
+
+	return backends[hash.Sum32()%uint32(len(backends))]
+}
@@ -0,0 +1,270 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Always pick last backend
+type lastBalancer struct{}
+
+func TestBalancers(t *testing.T) {
+	t.Parallel()
+
+	client := netip.MustParseAddr("10.0.0.1")
+
+	t.Run("Round_robin", func(t *testing.T) {
+		t.Parallel()
+
+		ups := newTestUpstream(t, config.BalanceRoundRobin, 3)
+
+		picked := []string{}
+
+		for i := 0; i < 6; i++ {
+			backend, release, _ := ups.acquire(client)
+			release()
+
+			picked = append(picked, backend.Addr)
+		}
+
+		assert.EqualValues(t, []string{"b0", "b1", "b2", "b0", "b1", "b2"}, picked)
+	})
+
+	t.Run("Random", func(t *testing.T) {
+		t.Parallel()
+
+		ups := newTestUpstream(t, config.BalanceRandom, 3)
+
+		picked := map[string]int{}
+
+		for i := 0; i < 300; i++ {
+			backend, release, _ := ups.acquire(client)
+			release()
+
+			picked[backend.Addr]++
+		}
+
+		assert.Len(t, picked, 3)
+	})
+
+	t.Run("Least_conn", func(t *testing.T) {
+		t.Parallel()
+
+		ups := newTestUpstream(t, config.BalanceLeastConn, 3)
+
+		releases := []func(){}
+
+		for i := 0; i < 6; i++ {
+			_, release, _ := ups.acquire(client)
+
+			releases = append(releases, release)
+		}
+
+		for _, backend := range ups.backends {
+			assert.EqualValues(t, 2, backend.Active())
+		}
+
+		// free one connection of b1, it is least loaded now
+		ups.backends[1].state.active.Add(-1)
+
+		backend, release, _ := ups.acquire(client)
+
+		assert.EqualValues(t, "b1", backend.Addr)
+
+		release()
+
+		ups.backends[1].state.active.Add(1)
+
+		for _, release := range releases {
+			release()
+		}
+
+		for _, backend := range ups.backends {
+			assert.EqualValues(t, 0, backend.Active())
+		}
+	})
+
+	t.Run("Source_hash", func(t *testing.T) {
+		t.Parallel()
+
+		ups := newTestUpstream(t, config.BalanceSourceHash, 5)
+
+		first, release, _ := ups.acquire(client)
+		release()
+
+		for i := 0; i < 10; i++ {
+			backend, release, _ := ups.acquire(client)
+			release()
+
+			assert.EqualValues(t, first.Addr, backend.Addr)
+		}
+
+		picked := map[string]bool{}
+
+		for i := 0; i < 200; i++ {
+			backend, release, _ := ups.acquire(netip.AddrFrom4([4]byte{10, 0, byte(i), 1}))
+			release()
+
+			picked[backend.Addr] = true
+		}
+
+		assert.Less(t, 1, len(picked))
+	})
+
+	t.Run("Concurrent_acquire", func(t *testing.T) {
+		t.Parallel()
+
+		for _, name := range []string{config.BalanceRoundRobin, config.BalanceRandom, config.BalanceLeastConn, config.BalanceSourceHash} {
+			ups := newTestUpstream(t, name, 4)
+
+			wg := &sync.WaitGroup{}
+
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					for j := 0; j < 100; j++ {
+						_, release, _ := ups.acquire(netip.AddrFrom4([4]byte{10, 0, byte(i), byte(j)}))
+						release()
+					}
+				}()
+			}
+
+			wg.Wait()
+
+			for _, backend := range ups.backends {
+				assert.EqualValues(t, 0, backend.Active(), name)
+			}
+		}
+	})
+
+	t.Run("Custom_balancer", func(t *testing.T) {
+		t.Parallel()
+
+		RegisterBalancer("last", func() Balancer { return lastBalancer{} })
+
+		ups := newTestUpstream(t, "last", 3)
+
+		backend, release, _ := ups.acquire(client)
+		release()
+
+		assert.EqualValues(t, "b2", backend.Addr)
+	})
+
+	t.Run("Unknown_balancer", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newBalancer("not-registered")
+
+		assert.ErrorIs(t, err, ErrUnknownBalancer)
+	})
+}
+
+func TestBalancedRelay(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Round_robin_over_loopback", func(t *testing.T) {
+		const localAddress = "127.0.0.1:53200"
+
+		backends := []string{"127.0.0.1:53201", "127.0.0.2:53201"}
+
+		for _, addr := range backends {
+			listener := runTCPServer(t, addr, nil, serveIdentity)
+			defer listener.Close()
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		listener, err := bindConn(ctx, localAddress)
+		if !assert.NoError(t, err) {
+			cancel()
+			return
+		}
+
+		pry := newPacketRelay(newResolver(config.Resolver{}))
+
+		wg := &sync.WaitGroup{}
+
+		wg.Add(1)
+		go func() {
+			pry.serve(ctx, listener, localAddress, newUpstream(backends, &roundRobinBalancer{}, config.HealthCheck{}))
+			wg.Done()
+		}()
+
+		picked := []string{}
+
+		for i := 0; i < 4; i++ {
+			conn, err := net.Dial("tcp", localAddress)
+			if !assert.NoError(t, err) {
+				break
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			identity, _ := io.ReadAll(conn)
+
+			picked = append(picked, string(identity))
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, []string{backends[0], backends[1], backends[0], backends[1]}, picked)
+
+		cancel()
+
+		wg.Wait()
+	})
+}
+
+func (lastBalancer) Pick(_ netip.Addr, backends []Backend) Backend {
+	return backends[len(backends)-1]
+}
+
+// Upstream of fake backends b0, b1... with balancer registered by name
+func newTestUpstream(t *testing.T, name string, size int) *upstream {
+	balancer, err := newBalancer(name)
+	if err != nil {
+		assert.FailNow(t, "failed to create balancer")
+	}
+
+	addrs := []string{}
+
+	for i := 0; i < size; i++ {
+		addrs = append(addrs, "b"+string(rune('0'+i)))
+	}
+
+	return newUpstream(addrs, balancer, config.HealthCheck{})
+}
@@ -0,0 +1,146 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// Part of second which tokens could be accumulated for
+const burstPeriod = 100 * time.Millisecond
+
+// Token bucket of bytes, tokens are refilled at rate per second up to burst.
+// Rate could be changed on the fly, zero rate is unlimited.
+type tokenBucket struct {
+	mu *sync.Mutex
+	// Bytes per second
+	rate int64
+	// Max tokens
+	burst int64
+	// Tokens left, negative if bytes are reserved ahead
+	tokens float64
+	// Time of last refill
+	last time.Time
+}
+
+// Chain of buckets which relayed bytes have to pass
+type rateLimit []*tokenBucket
+
+// Create bucket full of tokens
+func newTokenBucket(rate int64) *tokenBucket {
+	b := &tokenBucket{mu: &sync.Mutex{}, last: time.Now()}
+
+	b.setRate(rate)
+
+	b.tokens = float64(b.burst)
+
+	return b
+}
+
+// Change rate, tokens above new burst are dropped
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = rate
+	b.burst = max(int64(float64(rate)*burstPeriod.Seconds()), defaultBufferSize)
+	b.tokens = min(b.tokens, float64(b.burst))
+}
+
+// Take n tokens at now and get delay after which they are available
+func (b *tokenBucket) reserveAt(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate == 0 {
+		return 0
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.tokens+elapsed.Seconds()*float64(b.rate), float64(b.burst))
+		b.last = now
+	}
+
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// Take n tokens from every bucket and sleep until they are available in all of them
+func (rl rateLimit) wait(n int) {
+	if n <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	delay := time.Duration(0)
+
+	for _, b := range rl {
+		delay = max(delay, b.reserveAt(n, now))
+	}
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Max bytes which should be relayed at once to keep rate smooth, zero if unlimited
+func (rl rateLimit) chunk() int64 {
+	chunk := int64(0)
+
+	for _, b := range rl {
+		if b == nil {
+			continue
+		}
+
+		b.mu.Lock()
+
+		if b.rate > 0 && (chunk == 0 || b.burst < chunk) {
+			chunk = b.burst
+		}
+
+		b.mu.Unlock()
+	}
+
+	return chunk
+}
+
+// Limit with bucket of connection prepended, route limit is shared with other connections
+func (rl rateLimit) withConn(rate int64) rateLimit {
+	if rate == 0 {
+		return rl
+	}
+
+	return append(rateLimit{newTokenBucket(rate)}, rl...)
+}
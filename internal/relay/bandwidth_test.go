@@ -0,0 +1,218 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"grelay/internal/config"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Burst_then_rate", func(t *testing.T) {
+		t.Parallel()
+
+		b := newTokenBucket(100_000)
+
+		now := b.last
+
+		// burst is 100ms worth of tokens
+		assert.EqualValues(t, 0, b.reserveAt(10_000, now))
+		assert.EqualValues(t, 100*time.Millisecond, b.reserveAt(10_000, now))
+		assert.EqualValues(t, 150*time.Millisecond, b.reserveAt(5_000, now))
+
+		// reserved tokens are refilled
+		assert.EqualValues(t, 0, b.reserveAt(0, now.Add(150*time.Millisecond)))
+		assert.EqualValues(t, 10*time.Millisecond, b.reserveAt(1_000, now.Add(150*time.Millisecond)))
+	})
+
+	t.Run("Refill_capped_by_burst", func(t *testing.T) {
+		t.Parallel()
+
+		b := newTokenBucket(100_000)
+
+		now := b.last.Add(time.Hour)
+
+		assert.EqualValues(t, 0, b.reserveAt(10_000, now))
+		assert.EqualValues(t, 10*time.Millisecond, b.reserveAt(1_000, now))
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		t.Parallel()
+
+		var nilBucket *tokenBucket
+
+		assert.EqualValues(t, 0, nilBucket.reserveAt(1<<30, time.Now()))
+
+		b := newTokenBucket(0)
+
+		assert.EqualValues(t, 0, b.reserveAt(1<<30, time.Now()))
+
+		b.setRate(100_000)
+
+		// tokens of unlimited bucket are kept
+		assert.EqualValues(t, time.Second, b.reserveAt(defaultBufferSize+100_000, b.last))
+	})
+
+	t.Run("Chain_chunk", func(t *testing.T) {
+		t.Parallel()
+
+		assert.EqualValues(t, 0, rateLimit{}.chunk())
+		assert.EqualValues(t, 0, rateLimit{newTokenBucket(0)}.chunk())
+
+		limit := rateLimit{newTokenBucket(10 << 20), newTokenBucket(0)}
+
+		assert.EqualValues(t, 1<<20, limit.chunk())
+		assert.EqualValues(t, defaultBufferSize, limit.withConn(1024).chunk())
+		assert.Len(t, limit.withConn(0), 2)
+	})
+}
+
+func TestBandwidth(t *testing.T) {
+	t.Parallel()
+
+	const rate = 1 << 20
+
+	t.Run("Conn_download_spliced", func(t *testing.T) {
+		t.Parallel()
+
+		const remoteAddress = "127.0.0.1:23901"
+
+		source := runTCPServer(t, remoteAddress, nil, serveSource(rate*3/2))
+		defer source.Close()
+
+		route := testRoute("download", 23900, 23901)
+		route.Bandwidth = config.Bandwidth{ConnDownload: rate}
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		assertRate(t, rate, func() int64 {
+			return readAll(t, "127.0.0.1:23900")
+		})
+	})
+
+	t.Run("Route_upload_buffered", func(t *testing.T) {
+		t.Parallel()
+
+		const remoteAddress = "127.0.0.1:23903"
+
+		sink := runTCPServer(t, remoteAddress, nil, serveSink)
+		defer sink.Close()
+
+		route := testRoute("upload", 23902, 23903)
+		route.Bandwidth = config.Bandwidth{Upload: rate}
+		// write timeout turns splicing off
+		route.WriteTimeout = 10 * time.Second
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		assertRate(t, rate, func() int64 {
+			conn, err := net.Dial("tcp", "127.0.0.1:23902")
+			if !assert.NoError(t, err) {
+				return 0
+			}
+
+			defer conn.Close()
+
+			n, err := io.Copy(conn, io.LimitReader(zeroReader{}, rate*3/2))
+			assert.NoError(t, err)
+
+			conn.(*net.TCPConn).CloseWrite()
+
+			// sink closes conn once all data is received
+			_, err = io.Copy(io.Discard, conn)
+			assert.NoError(t, err)
+
+			return n
+		})
+	})
+
+	t.Run("Route_download_shared", func(t *testing.T) {
+		t.Parallel()
+
+		const remoteAddress = "127.0.0.1:23905"
+
+		source := runTCPServer(t, remoteAddress, nil, serveSource(rate*3/4))
+		defer source.Close()
+
+		route := testRoute("shared", 23904, 23905)
+		route.Bandwidth = config.Bandwidth{Download: rate, ConnDownload: 10 * rate}
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		assertRate(t, rate, func() int64 {
+			wg := &sync.WaitGroup{}
+
+			read := make([]int64, 2)
+
+			for i := range read {
+				wg.Add(1)
+				go func() {
+					read[i] = readAll(t, "127.0.0.1:23904")
+					wg.Done()
+				}()
+			}
+
+			wg.Wait()
+
+			return read[0] + read[1]
+		})
+	})
+}
+
+// Read everything sent by relay to new client
+func readAll(t *testing.T, addr string) int64 {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return 0
+	}
+
+	defer conn.Close()
+
+	n, err := io.Copy(io.Discard, conn)
+	assert.NoError(t, err)
+
+	return n
+}
+
+// Check throughput of transfer is within 20% of rate, transfer returns number of relayed bytes
+func assertRate(t *testing.T, rate float64, transfer func() int64) {
+	started := time.Now()
+
+	n := transfer()
+
+	measured := float64(n) / time.Since(started).Seconds()
+
+	assert.InEpsilon(t, rate, measured, 0.2, "measured %.0f B/s", measured)
+}
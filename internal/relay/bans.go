@@ -0,0 +1,296 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"grelay/internal/config"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Idle clients are dropped from accept limiter this often
+const acceptSweepInterval = time.Minute
+
+// Client banned on route
+type Ban struct {
+	Route  string
+	Client netip.Addr
+	// Ban is lifted at
+	Until time.Time
+}
+
+// Banned clients of all routes, expired bans are dropped lazily
+type banList struct {
+	mu   *sync.Mutex
+	bans map[banKey]time.Time
+}
+
+// Client of route
+type banKey struct {
+	route  string
+	client netip.Addr
+}
+
+// Limiter of new connections from single client ip of route, offenders are added to ban list
+type acceptLimiter struct {
+	mu    *sync.Mutex
+	route string
+	rate  config.AcceptRate
+	// Tokens of recently seen clients
+	clients map[netip.Addr]*acceptBucket
+	bans    *banList
+	// Time when idle clients were dropped
+	swept time.Time
+}
+
+// Tokens of single client, every new connection takes one
+type acceptBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Create empty ban list
+func newBanList() *banList {
+	return &banList{mu: &sync.Mutex{}, bans: map[banKey]time.Time{}}
+}
+
+// Ban client on route until given time
+func (bl *banList) ban(route string, client netip.Addr, until time.Time) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.bans[banKey{route: route, client: client}] = until
+}
+
+// Check whether client is banned on route at now
+func (bl *banList) banned(route string, client netip.Addr, now time.Time) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	key := banKey{route: route, client: client}
+
+	until, ok := bl.bans[key]
+	if ok && !now.Before(until) {
+		delete(bl.bans, key)
+		return false
+	}
+
+	return ok
+}
+
+// Active bans at now ordered by route and client
+func (bl *banList) list(now time.Time) []Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bans := []Ban{}
+
+	for key, until := range bl.bans {
+		if !now.Before(until) {
+			delete(bl.bans, key)
+			continue
+		}
+
+		bans = append(bans, Ban{Route: key.route, Client: key.client, Until: until})
+	}
+
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return cmp.Or(cmp.Compare(a.Route, b.Route), a.Client.Compare(b.Client))
+	})
+
+	return bans
+}
+
+// Lift bans of client on every route, all bans are lifted if client is not valid.
+// Number of lifted bans is returned.
+func (bl *banList) unban(client netip.Addr) int {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	lifted := 0
+
+	for key := range bl.bans {
+		if client.IsValid() && key.client != client {
+			continue
+		}
+
+		delete(bl.bans, key)
+
+		lifted++
+	}
+
+	return lifted
+}
+
+// List bans on GET and lift them on DELETE, optional client query parameter selects bans of single client
+func (bl *banList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client := netip.Addr{}
+
+	if arg := r.URL.Query().Get("client"); arg != "" {
+		addr, err := netip.ParseAddr(arg)
+		if err != nil {
+			http.Error(w, "not valid client ip address", http.StatusBadRequest)
+			return
+		}
+
+		client = addr.Unmap()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	switch r.Method {
+	case http.MethodGet:
+		for _, ban := range bl.list(time.Now()) {
+			if client.IsValid() && ban.Client != client {
+				continue
+			}
+
+			fmt.Fprintf(w, "%s %s %s\n", ban.Route, ban.Client, ban.Until.UTC().Format(time.RFC3339))
+		}
+	case http.MethodDelete:
+		lifted := bl.unban(client)
+
+		log.Printf("bans: lift %d bans of client %s", lifted, client)
+
+		fmt.Fprintf(w, "%d\n", lifted)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Serve ban list over http, lifting bans requires bearer token and is refused at all if token is not set.
+// Listing bans is left open like metrics are.
+func bansHandler(bans *banList, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			if token == "" {
+				log.Printf("bans: refuse to lift bans for %s, admin token is not set", r.RemoteAddr)
+				http.Error(w, "lifting bans is disabled", http.StatusForbidden)
+				return
+			}
+
+			auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+			if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 || !ok {
+				log.Printf("bans: refuse to lift bans for %s, admin token is not valid", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "admin token is required", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		bans.ServeHTTP(w, r)
+	})
+}
+
+// Create limiter of route, offenders are banned in bans
+func newAcceptLimiter(route string, rate config.AcceptRate, bans *banList) *acceptLimiter {
+	return &acceptLimiter{
+		mu:      &sync.Mutex{},
+		route:   route,
+		rate:    rate,
+		clients: map[netip.Addr]*acceptBucket{},
+		bans:    bans,
+		swept:   time.Now(),
+	}
+}
+
+// Check whether new connection of client is admitted at now.
+// ErrBanned is returned for banned client and ErrAcceptRate once client exceeds rate, client is banned then if ban time is set.
+// Nil limiter admits everyone.
+func (al *acceptLimiter) admit(client netip.Addr, now time.Time) error {
+	if al == nil {
+		return nil
+	}
+
+	if al.bans.banned(al.route, client, now) {
+		return ErrBanned
+	}
+
+	if al.rate.Rate == 0 {
+		return nil
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.sweep(now)
+
+	bucket, ok := al.clients[client]
+	if !ok {
+		bucket = &acceptBucket{tokens: float64(al.rate.Burst), last: now}
+		al.clients[client] = bucket
+	}
+
+	bucket.refill(al.rate, now)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return nil
+	}
+
+	if al.rate.BanTime > 0 {
+		until := now.Add(al.rate.BanTime)
+
+		log.Printf("bans: ban client %s of route %s until %s", client, al.route, until.Format(time.RFC3339))
+
+		al.bans.ban(al.route, client, until)
+
+		delete(al.clients, client)
+	}
+
+	return ErrAcceptRate
+}
+
+// Drop clients whose buckets are full again, mu is held
+func (al *acceptLimiter) sweep(now time.Time) {
+	if now.Sub(al.swept) < acceptSweepInterval {
+		return
+	}
+
+	al.swept = now
+
+	for client, bucket := range al.clients {
+		if bucket.refill(al.rate, now); bucket.tokens >= float64(al.rate.Burst) {
+			delete(al.clients, client)
+		}
+	}
+}
+
+// Add tokens for time passed since last refill up to burst
+func (ab *acceptBucket) refill(rate config.AcceptRate, now time.Time) {
+	if elapsed := now.Sub(ab.last); elapsed > 0 {
+		ab.tokens = min(ab.tokens+elapsed.Seconds()*rate.Rate, float64(rate.Burst))
+		ab.last = now
+	}
+}
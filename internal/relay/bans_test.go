@@ -0,0 +1,306 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptLimiter(t *testing.T) {
+	t.Parallel()
+
+	clientA := netip.MustParseAddr("10.0.0.1")
+	clientB := netip.MustParseAddr("10.0.0.2")
+
+	t.Run("Nil_admits_everyone", func(t *testing.T) {
+		t.Parallel()
+
+		var al *acceptLimiter
+
+		assert.NoError(t, al.admit(clientA, time.Now()))
+	})
+
+	t.Run("Offender_banned", func(t *testing.T) {
+		t.Parallel()
+
+		bans := newBanList()
+
+		al := newAcceptLimiter("db", config.AcceptRate{Rate: 1, Burst: 2, BanTime: time.Minute}, bans)
+
+		now := time.Now()
+
+		assert.NoError(t, al.admit(clientA, now))
+		assert.NoError(t, al.admit(clientA, now))
+		assert.ErrorIs(t, al.admit(clientA, now), ErrAcceptRate)
+
+		// other clients are not affected
+		assert.NoError(t, al.admit(clientB, now))
+
+		// rate is restored but client is still banned
+		assert.ErrorIs(t, al.admit(clientA, now.Add(10*time.Second)), ErrBanned)
+
+		assert.EqualValues(t, []Ban{{Route: "db", Client: clientA, Until: now.Add(time.Minute)}}, bans.list(now))
+
+		assert.NoError(t, al.admit(clientA, now.Add(time.Minute)))
+		assert.Empty(t, bans.list(now.Add(time.Minute)))
+	})
+
+	t.Run("Over_rate_rejected_without_ban", func(t *testing.T) {
+		t.Parallel()
+
+		bans := newBanList()
+
+		al := newAcceptLimiter("db", config.AcceptRate{Rate: 2, Burst: 1}, bans)
+
+		now := time.Now()
+
+		assert.NoError(t, al.admit(clientA, now))
+		assert.ErrorIs(t, al.admit(clientA, now.Add(100*time.Millisecond)), ErrAcceptRate)
+		assert.NoError(t, al.admit(clientA, now.Add(500*time.Millisecond)))
+
+		assert.Empty(t, bans.list(now))
+	})
+
+	t.Run("Idle_clients_swept", func(t *testing.T) {
+		t.Parallel()
+
+		al := newAcceptLimiter("db", config.AcceptRate{Rate: 1, Burst: 1}, newBanList())
+
+		now := time.Now()
+
+		assert.NoError(t, al.admit(clientA, now))
+		assert.NoError(t, al.admit(clientB, now.Add(acceptSweepInterval)))
+
+		assert.Len(t, al.clients, 1)
+		assert.Contains(t, al.clients, clientB)
+	})
+}
+
+func TestBanList(t *testing.T) {
+	t.Parallel()
+
+	clientA := netip.MustParseAddr("10.0.0.1")
+	clientB := netip.MustParseAddr("10.0.0.2")
+
+	until := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("Unban", func(t *testing.T) {
+		t.Parallel()
+
+		bans := newBanList()
+
+		bans.ban("web", clientA, until)
+		bans.ban("db", clientB, until)
+		bans.ban("db", clientA, until)
+
+		assert.EqualValues(t, []Ban{
+			{Route: "db", Client: clientA, Until: until},
+			{Route: "db", Client: clientB, Until: until},
+			{Route: "web", Client: clientA, Until: until},
+		}, bans.list(time.Now()))
+
+		assert.EqualValues(t, 2, bans.unban(clientA))
+		assert.EqualValues(t, []Ban{{Route: "db", Client: clientB, Until: until}}, bans.list(time.Now()))
+
+		assert.EqualValues(t, 1, bans.unban(netip.Addr{}))
+		assert.Empty(t, bans.list(time.Now()))
+	})
+
+	t.Run("Http", func(t *testing.T) {
+		t.Parallel()
+
+		bans := newBanList()
+
+		bans.ban("db", clientA, until)
+		bans.ban("db", clientB, until)
+
+		serve := func(method, target string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+
+			bans.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+
+			return recorder
+		}
+
+		recorder := serve(http.MethodGet, "/bans")
+
+		assert.EqualValues(t, http.StatusOK, recorder.Code)
+		assert.EqualValues(t, "db 10.0.0.1 2030-01-02T03:04:05Z\ndb 10.0.0.2 2030-01-02T03:04:05Z\n", recorder.Body.String())
+
+		recorder = serve(http.MethodGet, "/bans?client=10.0.0.2")
+
+		assert.EqualValues(t, "db 10.0.0.2 2030-01-02T03:04:05Z\n", recorder.Body.String())
+
+		assert.EqualValues(t, http.StatusBadRequest, serve(http.MethodDelete, "/bans?client=db").Code)
+		assert.EqualValues(t, http.StatusMethodNotAllowed, serve(http.MethodPost, "/bans").Code)
+
+		recorder = serve(http.MethodDelete, "/bans?client=10.0.0.1")
+
+		assert.EqualValues(t, "1\n", recorder.Body.String())
+
+		recorder = serve(http.MethodDelete, "/bans")
+
+		assert.EqualValues(t, "1\n", recorder.Body.String())
+		assert.Empty(t, bans.list(time.Now()))
+	})
+}
+
+func TestBansHandler(t *testing.T) {
+	t.Parallel()
+
+	until := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := map[string]struct {
+		token  string
+		method string
+		auth   string
+		status int
+		lifted bool
+	}{
+		"List_without_token": {
+			token:  "secret",
+			method: http.MethodGet,
+			status: http.StatusOK,
+		},
+		"Lift_disabled": {
+			method: http.MethodDelete,
+			auth:   "Bearer ",
+			status: http.StatusForbidden,
+		},
+		"Lift_without_token": {
+			token:  "secret",
+			method: http.MethodDelete,
+			status: http.StatusUnauthorized,
+		},
+		"Lift_with_invalid_token": {
+			token:  "secret",
+			method: http.MethodDelete,
+			auth:   "Bearer guess",
+			status: http.StatusUnauthorized,
+		},
+		"Lift_with_basic_auth": {
+			token:  "secret",
+			method: http.MethodDelete,
+			auth:   "Basic secret",
+			status: http.StatusUnauthorized,
+		},
+		"Lift_with_token": {
+			token:  "secret",
+			method: http.MethodDelete,
+			auth:   "Bearer secret",
+			status: http.StatusOK,
+			lifted: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			bans := newBanList()
+
+			bans.ban("db", netip.MustParseAddr("10.0.0.1"), until)
+
+			request := httptest.NewRequest(test.method, "/bans", nil)
+
+			if test.auth != "" {
+				request.Header.Set("Authorization", test.auth)
+			}
+
+			recorder := httptest.NewRecorder()
+
+			bansHandler(bans, test.token).ServeHTTP(recorder, request)
+
+			assert.EqualValues(t, test.status, recorder.Code)
+			assert.EqualValues(t, test.lifted, len(bans.list(time.Now())) == 0)
+		})
+	}
+}
+
+func TestRouteAcceptRate(t *testing.T) {
+	t.Parallel()
+
+	const remoteAddress = "127.0.0.1:23951"
+
+	echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+	defer echo.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	rly := New(ctx)
+
+	route := testRoute("rated", 23950, 23951)
+	route.AcceptRate = config.AcceptRate{Rate: 0.1, Burst: 1, BanTime: time.Minute}
+
+	assert.EqualValues(t, ReloadResult{Added: []string{"rated"}}, rly.Apply(routesConfig{route}))
+
+	conn, err := net.Dial("tcp", "127.0.0.1:23950")
+	if assert.NoError(t, err) {
+		assertEcho(t, conn, "ping")
+		conn.Close()
+	}
+
+	// offender is closed without relaying and banned
+	for range 2 {
+		conn, err := net.Dial("tcp", "127.0.0.1:23950")
+		if assert.NoError(t, err) {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			_, err = conn.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, io.EOF)
+
+			conn.Close()
+		}
+	}
+
+	client := netip.MustParseAddr("127.0.0.1")
+
+	if bans := rly.Bans(); assert.Len(t, bans, 1) {
+		assert.EqualValues(t, "rated", bans[0].Route)
+		assert.EqualValues(t, client, bans[0].Client)
+	}
+
+	assert.EqualValues(t, 1, rly.Unban(client))
+
+	// bucket of unbanned client is full again
+	conn, err = net.Dial("tcp", "127.0.0.1:23950")
+	if assert.NoError(t, err) {
+		assertEcho(t, conn, "pong")
+		conn.Close()
+	}
+
+	cancel()
+
+	rly.Wait()
+}
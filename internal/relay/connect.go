@@ -0,0 +1,128 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+)
+
+// Reply of established tunnel of http client
+const connectEstablished = "HTTP/1.1 200 Connection established\r\n\r\n"
+
+// Read http CONNECT request of client and check its basic proxy credentials, bytes sent after request are kept to be replayed.
+// Client is replied if request is rejected, otherwise it has to be replied by request.
+func connectHandshake(conn net.Conn, cfg config.Tunnel) (*tunnelRequest, error) {
+	r := bufio.NewReader(io.LimitReader(conn, maxPeekSize))
+
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		writeConnectError(conn, http.StatusBadRequest, "")
+		return nil, fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+	}
+
+	if req.ProtoMajor != 1 {
+		writeConnectError(conn, http.StatusBadRequest, "")
+		return nil, fmt.Errorf("%w: %s", ErrTunnelRequest, req.Proto)
+	}
+
+	if req.Method != http.MethodConnect {
+		writeConnectError(conn, http.StatusMethodNotAllowed, "Allow: CONNECT\r\n")
+		return nil, fmt.Errorf("%w: method %s", ErrTunnelRequest, req.Method)
+	}
+
+	request := &tunnelRequest{}
+
+	if len(cfg.Users) != 0 {
+		// basic credentials are parsed the same way as ones of origin server
+		user, password, _ := (&http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}).BasicAuth()
+
+		if !authenticate(cfg.Users, user, password) {
+			writeConnectError(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"grelay\"\r\n")
+			return nil, fmt.Errorf("%w: user %q", ErrTunnelAuth, user)
+		}
+
+		request.user = user
+	}
+
+	host, port, err := net.SplitHostPort(req.RequestURI)
+	if err != nil || host == "" {
+		writeConnectError(conn, http.StatusBadRequest, "")
+		return nil, fmt.Errorf("%w: target %q", ErrTunnelRequest, req.RequestURI)
+	}
+
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 {
+		writeConnectError(conn, http.StatusBadRequest, "")
+		return nil, fmt.Errorf("%w: target %q", ErrTunnelRequest, req.RequestURI)
+	}
+
+	request.host, request.port = host, uint16(number)
+
+	if r.Buffered() != 0 {
+		buffered, _ := r.Peek(r.Buffered())
+
+		request.buffered = append([]byte(nil), buffered...)
+	}
+
+	request.reply = func(_ netip.AddrPort, err error) error {
+		if err != nil {
+			return writeConnectError(conn, connectStatus(err), "")
+		}
+
+		_, werr := io.WriteString(conn, connectEstablished)
+
+		return werr
+	}
+
+	return request, nil
+}
+
+// Reply client with error status and headers, connection is closed afterwards
+func writeConnectError(conn net.Conn, status int, headers string) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status), headers)
+
+	return err
+}
+
+// Status of failed connect
+func connectStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrDestination):
+		return http.StatusForbidden
+	case errors.Is(err, ErrConnLimit), errors.Is(err, ErrQueueTimeout):
+		return http.StatusServiceUnavailable
+	case dialFailureReason(err) == dialFailTimeout:
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
@@ -0,0 +1,345 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectHandshake(t *testing.T) {
+	t.Parallel()
+
+	users := map[string]string{"alice": "secret"}
+
+	credentials := func(user, password string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)) + "\r\n"
+	}
+
+	tests := map[string]struct {
+		request  string
+		cfg      config.Tunnel
+		host     string
+		port     uint16
+		user     string
+		buffered string
+		status   int
+		header   string
+		err      error
+	}{
+		"connect": {
+			request: "CONNECT db.vpn:5432 HTTP/1.1\r\nHost: db.vpn:5432\r\n\r\n",
+			host:    "db.vpn",
+			port:    5432,
+		},
+		"connect ipv6": {
+			request: "CONNECT [fd00::1]:443 HTTP/1.0\r\n\r\n",
+			host:    "fd00::1",
+			port:    443,
+		},
+		"connect with data": {
+			request:  "CONNECT 10.0.0.1:443 HTTP/1.1\r\n\r\n\x16\x03\x01",
+			host:     "10.0.0.1",
+			port:     443,
+			buffered: "\x16\x03\x01",
+		},
+		"connect with password": {
+			request: "CONNECT 10.0.0.1:443 HTTP/1.1\r\n" + credentials("alice", "secret") + "\r\n",
+			cfg:     config.Tunnel{Users: users},
+			host:    "10.0.0.1",
+			port:    443,
+			user:    "alice",
+		},
+		"wrong password failed": {
+			request: "CONNECT 10.0.0.1:443 HTTP/1.1\r\n" + credentials("alice", "secre") + "\r\n",
+			cfg:     config.Tunnel{Users: users},
+			status:  http.StatusProxyAuthRequired,
+			header:  "Proxy-Authenticate",
+			err:     ErrTunnelAuth,
+		},
+		"missing credentials failed": {
+			request: "CONNECT 10.0.0.1:443 HTTP/1.1\r\n\r\n",
+			cfg:     config.Tunnel{Users: users},
+			status:  http.StatusProxyAuthRequired,
+			header:  "Proxy-Authenticate",
+			err:     ErrTunnelAuth,
+		},
+		"get failed": {
+			request: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			status:  http.StatusMethodNotAllowed,
+			header:  "Allow",
+			err:     ErrTunnelRequest,
+		},
+		"missing port failed": {
+			request: "CONNECT example.com HTTP/1.1\r\n\r\n",
+			status:  http.StatusBadRequest,
+			err:     ErrTunnelRequest,
+		},
+		"zero port failed": {
+			request: "CONNECT example.com:0 HTTP/1.1\r\n\r\n",
+			status:  http.StatusBadRequest,
+			err:     ErrTunnelRequest,
+		},
+		"http2 failed": {
+			request: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n",
+			status:  http.StatusBadRequest,
+			err:     ErrTunnelRequest,
+		},
+		"socks5 failed": {
+			request: "\x05\x01\x00",
+			status:  http.StatusBadRequest,
+			err:     ErrTunnelRequest,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := tcpPair(t)
+			defer client.Close()
+			defer server.Close()
+
+			client.Write([]byte(test.request))
+			client.(*net.TCPConn).CloseWrite()
+
+			req, err := connectHandshake(server, test.cfg)
+
+			assert.ErrorIs(t, err, test.err)
+
+			if err == nil {
+				assert.EqualValues(t, test.host, req.host)
+				assert.EqualValues(t, test.port, req.port)
+				assert.EqualValues(t, test.user, req.user)
+				assert.EqualValues(t, test.buffered, string(req.buffered))
+
+				assert.NoError(t, req.reply(netip.AddrPort{}, nil))
+
+				test.status = http.StatusOK
+			}
+
+			// nothing is left unread, so server is closed without reset
+			server.SetReadDeadline(time.Now().Add(time.Second))
+			io.Copy(io.Discard, server)
+			server.Close()
+
+			client.SetReadDeadline(time.Now().Add(time.Second))
+
+			resp, err := http.ReadResponse(bufio.NewReader(client), &http.Request{Method: http.MethodConnect})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.EqualValues(t, test.status, resp.StatusCode)
+
+			if test.header != "" {
+				assert.NotEmpty(t, resp.Header.Get(test.header))
+			}
+		})
+	}
+}
+
+func TestConnectStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		err    error
+		status int
+	}{
+		"not allowed":      {err: fmt.Errorf("%w: port 22", ErrDestination), status: http.StatusForbidden},
+		"connection limit": {err: ErrConnLimit, status: http.StatusServiceUnavailable},
+		"timeout":          {err: errors.Join(ErrRemoteConn, os.ErrDeadlineExceeded), status: http.StatusGatewayTimeout},
+		"refused":          {err: errors.Join(ErrRemoteConn, syscall.ECONNREFUSED), status: http.StatusBadGateway},
+		"unresolved":       {err: errors.Join(ErrRemoteConn, &net.DNSError{Err: "no such host", IsNotFound: true}), status: http.StatusBadGateway},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.EqualValues(t, test.status, connectStatus(test.err))
+		})
+	}
+}
+
+func TestConnectProxy(t *testing.T) {
+	t.Parallel()
+
+	echo := runTCPServer(t, "127.0.0.1:24601", nil, serveEcho)
+
+	// parallel subtests complete after parent returns
+	t.Cleanup(func() { echo.Close() })
+
+	connectRoute := func(name string, port uint16, tunnel config.Tunnel) config.Route {
+		route := testRoute(name, port, port)
+		route.Mode = config.ModeConnect
+		route.Remotes = nil
+
+		tunnel.Destinations = config.ACL{Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+		tunnel.Timeout = time.Second
+		route.Tunnel = tunnel
+
+		return route
+	}
+
+	t.Run("Success_connect", func(t *testing.T) {
+		t.Parallel()
+
+		stop := runRouteRelay(t, connectRoute("connect", 24600, config.Tunnel{}))
+		defer stop()
+
+		for _, data := range []string{"", "ping"} {
+			conn, err := net.Dial("tcp", "127.0.0.1:24600")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			// data sent along with request is relayed once tunnel is established
+			resp, r := connectRequest(t, conn, "CONNECT 127.0.0.1:24601 HTTP/1.1\r\nHost: 127.0.0.1:24601\r\n\r\n"+data)
+
+			if assert.NotNil(t, resp) {
+				assert.EqualValues(t, http.StatusOK, resp.StatusCode)
+				assert.EqualValues(t, "Connection established", resp.Status[4:])
+			}
+
+			if data != "" {
+				buf := make([]byte, len(data))
+
+				_, err = io.ReadFull(r, buf)
+
+				assert.NoError(t, err)
+				assert.EqualValues(t, data, string(buf))
+			}
+
+			assertEcho(t, conn, "pong")
+
+			conn.Close()
+		}
+	})
+
+	t.Run("Success_http_client", func(t *testing.T) {
+		t.Parallel()
+
+		stop := runRouteRelay(t, connectRoute("connect-client", 24602, config.Tunnel{Users: map[string]string{"alice": "secret"}}))
+		defer stop()
+
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}))
+		defer server.Close()
+
+		client := server.Client()
+
+		transport := client.Transport.(*http.Transport)
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("alice", "secret"), Host: "127.0.0.1:24602"})
+
+		resp, err := client.Get(server.URL)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, "hello", string(body))
+
+		// credentials are required
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: "127.0.0.1:24602"})
+		transport.CloseIdleConnections()
+
+		_, err = client.Get(server.URL)
+
+		assert.ErrorContains(t, err, "Proxy Authentication Required")
+		assert.EqualValues(t, 1, connRejected.With("connect-client", "24602/tcp", rejectAuth).Value())
+	})
+
+	t.Run("Destination_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		route := connectRoute("connect-rejected", 24603, config.Tunnel{})
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		tests := map[string]int{
+			"10.0.0.1:24601":  http.StatusForbidden,
+			"127.0.0.1:24609": http.StatusBadGateway,
+		}
+
+		for target, status := range tests {
+			conn, err := net.Dial("tcp", "127.0.0.1:24603")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			resp, _ := connectRequest(t, conn, "CONNECT "+target+" HTTP/1.1\r\n\r\n")
+
+			if assert.NotNil(t, resp) {
+				assert.EqualValues(t, status, resp.StatusCode, target)
+			}
+
+			assertClosed(t, conn, time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 1, connRejected.With(route.Name, route.Ports[0].String(), rejectDest).Value())
+		assert.EqualValues(t, 1, dialFailures.With(route.Name, route.Ports[0].String(), dialFailRefused).Value())
+	})
+}
+
+// Send CONNECT request over conn and read response, reader of data following response is returned
+func connectRequest(t *testing.T, conn net.Conn, request string) (*http.Response, *bufio.Reader) {
+	_, err := io.WriteString(conn, request)
+	assert.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if !assert.NoError(t, err) {
+		return nil, r
+	}
+
+	return resp, r
+}
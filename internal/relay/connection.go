@@ -24,22 +24,212 @@
 package relay
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"grelay/internal/config"
 	"log"
+	"math/rand/v2"
 	"net"
+	"net/netip"
 	"time"
 )
 
-const dialTimeout = 5 * time.Second
+// Connect to one of upstream backends picked for client and send header first, dial is retried according to route dial policy.
+// Returned func releases backend and has to be called once connection is done.
+func (pry packetRelay) connect(ctx context.Context, ups *upstream, client netip.Addr, header []byte) (net.Conn, func(), error) {
+	backend, release, err := ups.acquire(client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Accepted client drains on stop like relayed ones, so pending dial is not cancelled, only retries are
+	dctx := context.WithoutCancel(ctx)
+
+	errs := []error{}
+
+	for attempt := 1; ; attempt++ {
+		conn, err := newOutgoingConn(dctx, pry.resolver, backend.Addr, pry.dial.Timeout, header, pry.origin)
+
+		ups.report(backend, err)
+
+		if err == nil {
+			return conn, release, nil
+		}
+
+		pry.metrics.dialFailed(err)
+
+		errs = append(errs, fmt.Errorf("attempt %d to %s: %w", attempt, backend.Addr, err))
+
+		if attempt > pry.dial.Retries {
+			break
+		}
+
+		delay := backoff(pry.dial, attempt)
+
+		log.Printf("conn: attempt %d to %s failed, retry in %s\n", attempt, backend.Addr, delay)
+
+		if err := sleep(ctx, delay); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		if pry.dial.NextRemote {
+			release()
+
+			if backend, release, err = ups.acquire(client); err != nil {
+				errs = append(errs, err)
+				return nil, nil, fmt.Errorf("%w: %d attempts failed: %w", ErrRemoteConn, attempt, errors.Join(errs...))
+			}
+		}
+	}
+
+	release()
+
+	return nil, nil, fmt.Errorf("%w: %d attempts failed: %w", ErrRemoteConn, len(errs), errors.Join(errs...))
+}
 
-func newOutgoingConn(remoteAddr string) (net.Conn, error) {
+// Delay before retry following attempt, it grows exponentially and half of it is random
+func backoff(dial config.Dial, attempt int) time.Duration {
+	delay := dial.Backoff << (attempt - 1)
+
+	if delay > dial.MaxBackoff || delay <= 0 {
+		delay = dial.MaxBackoff
+	}
+
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Wait for delay or until ctx is done
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Create tcp connection to remoteAddr within timeout, host of remoteAddr is resolved by res at dial time.
+// Header e.g. of proxy protocol is sent first if set, then connection is wrapped in tls if origin is set.
+// Both are done within the same timeout, default dial timeout is used if timeout is not set.
+func newOutgoingConn(ctx context.Context, res *resolver, remoteAddr string, timeout time.Duration, header []byte, origin *tls.Config) (net.Conn, error) {
 	log.Printf("conn: create new outgoing net stream to %s\n", remoteAddr)
 
-	conn, err := net.DialTimeout("tcp", remoteAddr, dialTimeout)
+	if timeout <= 0 {
+		timeout = config.DefaultDialTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := dialStream(ctx, res, remoteAddr)
 	if err != nil {
 		log.Printf("conn: failed to create outgoing net stream to %s\n", remoteAddr)
-		return conn, errors.Join(ErrRemoteConn, err)
+		return nil, err
+	}
+
+	log.Printf("conn: outgoing net stream to %s uses %s\n", remoteAddr, conn.RemoteAddr())
+
+	if len(header) != 0 {
+		if err := writeHeader(ctx, conn, header); err != nil {
+			log.Printf("conn: failed to send header to %s err=%s\n", remoteAddr, err)
+			conn.Close()
+			return nil, errors.Join(ErrRemoteConn, err)
+		}
+	}
+
+	if origin == nil {
+		return conn, nil
+	}
+
+	tconn, err := originate(ctx, conn, remoteAddr, origin)
+	if err != nil {
+		log.Printf("conn: failed tls handshake with %s err=%s\n", remoteAddr, err)
+		conn.Close()
+		return nil, err
+	}
+
+	return tconn, nil
+}
+
+// Write header until ctx is done
+func writeHeader(ctx context.Context, conn net.Conn, header []byte) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
 	}
 
+	_, err := conn.Write(header)
+
+	return err
+}
+
+// Resolve host of remoteAddr and connect to first reachable address
+func dialStream(ctx context.Context, res *resolver, remoteAddr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, errors.Join(ErrRemoteConn, err)
+	}
+
+	addrs, err := res.lookup(ctx, host)
+	if err != nil {
+		return nil, errors.Join(ErrRemoteConn, err)
+	}
+
+	dialer := &net.Dialer{}
+
+	errs := []error{ErrRemoteConn}
+
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		return conn, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// Create udp socket connected to remoteAddr, host of remoteAddr is resolved by res at dial time
+func newOutgoingDatagramConn(res *resolver, remoteAddr string) (*net.UDPConn, error) {
+	log.Printf("conn: create new outgoing datagram socket to %s\n", remoteAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DefaultDialTimeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		log.Printf("conn: failed to create outgoing datagram socket to %s\n", remoteAddr)
+		return nil, errors.Join(ErrRemoteConn, err)
+	}
+
+	addrs, err := res.lookup(ctx, host)
+	if err != nil {
+		log.Printf("conn: failed to create outgoing datagram socket to %s\n", remoteAddr)
+		return nil, errors.Join(ErrRemoteConn, err)
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(addrs[0].String(), port))
+	if err != nil {
+		log.Printf("conn: failed to create outgoing datagram socket to %s\n", remoteAddr)
+		return nil, errors.Join(ErrRemoteConn, err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		log.Printf("conn: failed to create outgoing datagram socket to %s\n", remoteAddr)
+		return nil, errors.Join(ErrRemoteConn, err)
+	}
+
+	log.Printf("conn: outgoing datagram socket to %s uses %s\n", remoteAddr, raddr)
+
 	return conn, nil
 }
@@ -24,7 +24,12 @@
 package relay
 
 import (
+	"context"
+	"grelay/internal/config"
+	"net"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -35,20 +40,230 @@ func TestNewOutgoingConn(t *testing.T) {
 	t.Run("Success on connect", func(t *testing.T) {
 		t.Parallel()
 
-		conn, err := newOutgoingConn("google.com:80")
+		listener, err := net.Listen("tcp", "127.0.0.1:40103")
+		if err != nil {
+			assert.FailNow(t, "failed to open listener")
+		}
 
-		assert.NoError(t, err)
-		assert.NotNil(t, conn)
+		defer listener.Close()
 
-		conn.Close()
+		conn, err := newOutgoingConn(context.Background(), newResolver(config.Resolver{}), "127.0.0.1:40103", config.DefaultDialTimeout, nil, nil)
+
+		if assert.NoError(t, err) && assert.NotNil(t, conn) {
+			conn.Close()
+		}
+	})
+
+	t.Run("Success_on_connect_by_host_name", func(t *testing.T) {
+		t.Parallel()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:40101")
+		if err != nil {
+			assert.FailNow(t, "failed to open listener")
+		}
+
+		defer listener.Close()
+
+		conn, err := newOutgoingConn(context.Background(), newResolver(config.Resolver{}), "localhost:40101", config.DefaultDialTimeout, nil, nil)
+
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, "127.0.0.1:40101", conn.RemoteAddr().String())
+			conn.Close()
+		}
 	})
 
 	t.Run("Fail to connect", func(t *testing.T) {
 		t.Parallel()
 
-		conn, err := newOutgoingConn("127.0.0.1:40100")
+		conn, err := newOutgoingConn(context.Background(), newResolver(config.Resolver{}), "127.0.0.1:40100", config.DefaultDialTimeout, nil, nil)
 
 		assert.Error(t, err)
 		assert.Nil(t, conn)
 	})
+
+	t.Run("Fail_to_resolve", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := newOutgoingConn(context.Background(), newResolver(config.Resolver{}), "does-not-exist.invalid:80", config.DefaultDialTimeout, nil, nil)
+
+		assert.ErrorIs(t, err, ErrRemoteConn)
+		assert.Nil(t, conn)
+	})
+
+	t.Run("Fail_no_port", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := newOutgoingConn(context.Background(), newResolver(config.Resolver{}), "localhost", config.DefaultDialTimeout, nil, nil)
+
+		assert.ErrorIs(t, err, ErrRemoteConn)
+		assert.Nil(t, conn)
+	})
+}
+
+func TestNewOutgoingDatagramConn(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success_by_host_name", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := newOutgoingDatagramConn(newResolver(config.Resolver{}), "localhost:40102")
+
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, "127.0.0.1:40102", conn.RemoteAddr().String())
+			conn.Close()
+		}
+	})
+
+	t.Run("Fail_no_port", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := newOutgoingDatagramConn(newResolver(config.Resolver{}), "127.0.0.1")
+
+		assert.ErrorIs(t, err, ErrRemoteConn)
+		assert.Nil(t, conn)
+	})
+}
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+
+	dial := config.Dial{Timeout: time.Second, Retries: 2, Backoff: 20 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+
+	t.Run("Success_after_retries", func(t *testing.T) {
+		t.Parallel()
+
+		const remoteAddress = "127.0.0.1:53700"
+
+		pry := newPacketRelay(newResolver(config.Resolver{}))
+		pry.dial = dial
+		pry.dial.Retries = 10
+
+		listened := make(chan net.Listener)
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+
+			listener, _ := net.Listen("tcp", remoteAddress)
+			listened <- listener
+		}()
+
+		conn, release, err := pry.connect(context.Background(), newUpstream([]string{remoteAddress}, &roundRobinBalancer{}, config.HealthCheck{}), netip.Addr{}, nil)
+
+		if listener := <-listened; listener != nil {
+			defer listener.Close()
+		}
+
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, remoteAddress, conn.RemoteAddr().String())
+			conn.Close()
+			release()
+		}
+	})
+
+	t.Run("Fail_with_attempt_details", func(t *testing.T) {
+		t.Parallel()
+
+		pry := newPacketRelay(newResolver(config.Resolver{}))
+		pry.dial = dial
+
+		ups := newUpstream([]string{"127.0.0.1:53701"}, &roundRobinBalancer{}, config.HealthCheck{})
+
+		conn, _, err := pry.connect(context.Background(), ups, netip.Addr{}, nil)
+
+		assert.Nil(t, conn)
+		assert.ErrorIs(t, err, ErrRemoteConn)
+		assert.ErrorContains(t, err, "3 attempts failed")
+		assert.ErrorContains(t, err, "attempt 3 to 127.0.0.1:53701")
+		assert.EqualValues(t, 0, ups.backends[0].Active())
+	})
+
+	t.Run("Success_on_next_remote", func(t *testing.T) {
+		t.Parallel()
+
+		const remoteAddress = "127.0.0.1:53703"
+
+		listener, err := net.Listen("tcp", remoteAddress)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer listener.Close()
+
+		pry := newPacketRelay(newResolver(config.Resolver{}))
+		pry.dial = dial
+		pry.dial.Retries = 1
+		pry.dial.NextRemote = true
+
+		ups := newUpstream([]string{"127.0.0.1:53702", remoteAddress}, &roundRobinBalancer{}, config.HealthCheck{})
+
+		conn, release, err := pry.connect(context.Background(), ups, netip.Addr{}, nil)
+
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, remoteAddress, conn.RemoteAddr().String())
+			assert.EqualValues(t, 0, ups.backends[0].Active())
+			assert.EqualValues(t, 1, ups.backends[1].Active())
+
+			conn.Close()
+			release()
+		}
+	})
+
+	t.Run("Same_remote_without_next_remote", func(t *testing.T) {
+		t.Parallel()
+
+		const remoteAddress = "127.0.0.1:53705"
+
+		listener, err := net.Listen("tcp", remoteAddress)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer listener.Close()
+
+		pry := newPacketRelay(newResolver(config.Resolver{}))
+		pry.dial = dial
+		pry.dial.Retries = 1
+
+		ups := newUpstream([]string{"127.0.0.1:53704", remoteAddress}, &roundRobinBalancer{}, config.HealthCheck{})
+
+		_, _, err = pry.connect(context.Background(), ups, netip.Addr{}, nil)
+
+		assert.ErrorContains(t, err, "2 attempts failed")
+		assert.NotContains(t, err.Error(), remoteAddress)
+	})
+
+	t.Run("Stop_on_done_ctx", func(t *testing.T) {
+		t.Parallel()
+
+		pry := newPacketRelay(newResolver(config.Resolver{}))
+		pry.dial = config.Dial{Timeout: time.Second, Retries: 5, Backoff: time.Second, MaxBackoff: time.Second}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		started := time.Now()
+
+		_, _, err := pry.connect(ctx, newUpstream([]string{"127.0.0.1:53706"}, &roundRobinBalancer{}, config.HealthCheck{}), netip.Addr{}, nil)
+
+		assert.ErrorIs(t, err, ErrRemoteConn)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(started), 500*time.Millisecond)
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	dial := config.Dial{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 5: time.Second, 100: time.Second}
+
+	for attempt, limit := range tests {
+		for i := 0; i < 100; i++ {
+			delay := backoff(dial, attempt)
+
+			assert.GreaterOrEqual(t, delay, limit/2)
+			assert.LessOrEqual(t, delay, limit)
+		}
+	}
 }
@@ -0,0 +1,371 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"grelay/internal/config"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// Datagram relay struct
+type datagramRelay struct {
+	wg *sync.WaitGroup
+	// Idle timeout after which session is expired
+	timeout time.Duration
+	// Resolver of remote host
+	resolver *resolver
+	// Guards sessions
+	mu *sync.Mutex
+	// Active sessions by client address
+	sessions map[netip.AddrPort]*datagramSession
+	// Metrics of relayed port
+	metrics portMetrics
+	// Filter of client addresses
+	acl *acl
+	// Limiter of new sessions of single client
+	accept *acceptLimiter
+	// Limiter of concurrent sessions, datagrams are never queued
+	limiter *connLimiter
+}
+
+// Max datagrams of client queued while its session is connected to remote
+const maxPendingDatagrams = 16
+
+// Client session with own upstream socket
+type datagramSession struct {
+	// Socket connected to remote, nil until remote is dialed
+	upstream *net.UDPConn
+	// Datagrams of client received while remote is dialed
+	pending [][]byte
+	// Release backend of session
+	release func()
+	// Free slot of session in limiter
+	free func()
+	// Called once session is done
+	done func()
+	// Last time datagram passed in any direction
+	lastActive time.Time
+}
+
+// Create new datagram relay
+func newDatagramRelay(timeout time.Duration, res *resolver) datagramRelay {
+	return datagramRelay{
+		wg:       &sync.WaitGroup{},
+		timeout:  timeout,
+		resolver: res,
+		mu:       &sync.Mutex{},
+		sessions: map[netip.AddrPort]*datagramSession{},
+	}
+}
+
+// Run single instance of datagram relay.
+// Create udp listener for incoming datagrams, make upstream udp socket per client and relay datagrams between them.
+func (dry datagramRelay) runRelay(ctx context.Context, local, remote string) {
+	conn, err := bindDatagram(local)
+	if err != nil {
+		log.Printf("dgram_relay: failed to run relaying between address %s <-> %s err=%s\n", local, remote, err)
+		return
+	}
+
+	dry.serve(ctx, conn, local, newUpstream([]string{remote}, &roundRobinBalancer{}, config.HealthCheck{}))
+}
+
+// Relay datagrams received by conn to one of upstream backends until ctx is done or conn is closed
+func (dry datagramRelay) serve(ctx context.Context, conn *net.UDPConn, local string, ups *upstream) {
+	log.Printf("dgram_relay: start relaying between address %s <-> %s\n", local, ups)
+
+	serveDatagram(ctx, conn, local, func(_ context.Context, conn *net.UDPConn, client netip.AddrPort, data []byte) {
+		sess, err := dry.session(conn, client, ups)
+		if errors.Is(err, ErrDenied) {
+			log.Printf("dgram_relay: deny client %s by acl", client)
+			return
+		}
+
+		if errors.Is(err, ErrAcceptRate) || errors.Is(err, ErrBanned) {
+			log.Printf("dgram_relay: reject client %s err=%s", client, err)
+			return
+		}
+
+		if errors.Is(err, ErrConnLimit) {
+			active, _ := dry.limiter.usage()
+			log.Printf("dgram_relay: reject client %s err=%s active=%d", client, err, active)
+			return
+		}
+
+		if err != nil {
+			log.Printf("dgram_relay: reject client %s err=%s", client, err)
+			return
+		}
+
+		dry.send(client, sess, data)
+	})
+
+	// listener is closed, no new sessions could appear
+	dry.closeSessions()
+
+	dry.wg.Wait()
+
+	log.Printf("dgram_relay: stop relaying between address %s <-> %s\n", local, ups)
+}
+
+// Get session of client or create new one connected to one of upstream backends.
+// Remote of new session is dialed in background, so slow resolving of its host does not stall other sessions.
+func (dry datagramRelay) session(conn *net.UDPConn, client netip.AddrPort, ups *upstream) (*datagramSession, error) {
+	dry.mu.Lock()
+	defer dry.mu.Unlock()
+
+	if sess, ok := dry.sessions[client]; ok {
+		sess.lastActive = time.Now()
+		return sess, nil
+	}
+
+	dry.metrics.accepted()
+
+	if !dry.acl.permits(client.Addr()) {
+		dry.metrics.rejected(rejectACL)
+		return nil, ErrDenied
+	}
+
+	if err := dry.accept.admit(client.Addr().Unmap(), time.Now()); err != nil {
+		dry.metrics.rejected(acceptRejectReason(err))
+		return nil, err
+	}
+
+	free, err := dry.limiter.tryAcquire(client.Addr().Unmap())
+	if err != nil {
+		dry.metrics.rejected(rejectLimit)
+		return nil, err
+	}
+
+	backend, release, err := ups.acquire(client.Addr().Unmap())
+	if err != nil {
+		dry.metrics.rejected(rejectNoBackend)
+		free()
+		return nil, err
+	}
+
+	sess := &datagramSession{release: release, free: free, done: dry.metrics.relaying(), lastActive: time.Now()}
+
+	dry.sessions[client] = sess
+
+	dry.wg.Add(1)
+	go func() {
+		dry.runSession(conn, client, sess, backend.Addr)
+
+		dry.wg.Done()
+	}()
+
+	return sess, nil
+}
+
+// Connect session to remote and relay datagrams from it back to client until session is expired or closed
+func (dry datagramRelay) runSession(conn *net.UDPConn, client netip.AddrPort, sess *datagramSession, remote string) {
+	defer sess.done()
+
+	defer sess.free()
+
+	defer sess.release()
+
+	upstream, err := newOutgoingDatagramConn(dry.resolver, remote)
+	if err != nil {
+		log.Printf("dgram_relay: failed to connect client(%s) to remote %s err=%s", client, remote, err)
+		dry.metrics.dialFailed(err)
+		dry.removeSession(client, sess)
+		return
+	}
+
+	if !dry.connected(client, sess, upstream) {
+		log.Printf("dgram_relay: session client(%s) closed while remote %s was dialed\n", client, remote)
+		upstream.Close()
+		return
+	}
+
+	log.Printf("dgram_relay: new session client(%s) <-> %s", client, upstream.RemoteAddr())
+
+	dry.upstreamToClientRelay(conn, client, sess)
+}
+
+// Set upstream of session and flush datagrams queued while it was dialed, returns false if session is already closed
+func (dry datagramRelay) connected(client netip.AddrPort, sess *datagramSession, upstream *net.UDPConn) bool {
+	dry.mu.Lock()
+	defer dry.mu.Unlock()
+
+	if dry.sessions[client] != sess {
+		return false
+	}
+
+	sess.upstream = upstream
+
+	// queued datagrams go first, following ones wait for lock
+	for _, data := range sess.pending {
+		dry.write(client, upstream, data)
+	}
+
+	sess.pending = nil
+
+	return true
+}
+
+// Send datagram of client to upstream of session, datagrams are queued until upstream is connected
+func (dry datagramRelay) send(client netip.AddrPort, sess *datagramSession, data []byte) {
+	dry.mu.Lock()
+
+	upstream := sess.upstream
+
+	if upstream == nil {
+		if len(sess.pending) < maxPendingDatagrams {
+			sess.pending = append(sess.pending, bytes.Clone(data))
+		} else {
+			log.Printf("dgram_relay: drop datagram of client(%s), remote is not connected yet\n", client)
+		}
+
+		dry.mu.Unlock()
+
+		return
+	}
+
+	dry.mu.Unlock()
+
+	dry.write(client, upstream, data)
+}
+
+// Write datagram of client to upstream
+func (dry datagramRelay) write(client netip.AddrPort, upstream *net.UDPConn, data []byte) {
+	n, err := upstream.Write(data)
+
+	dry.metrics.bytes(directionUpload).Add(uint64(n))
+
+	if err != nil {
+		log.Printf("dgram_relay: client(%s)->%s fail to relay err=%s\n", client, upstream.RemoteAddr(), err)
+	}
+}
+
+// Relay datagrams from upstream socket back to client until session is expired or closed
+func (dry datagramRelay) upstreamToClientRelay(conn *net.UDPConn, client netip.AddrPort, sess *datagramSession) {
+	defer sess.upstream.Close()
+
+	download := dry.metrics.bytes(directionDownload)
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		if err := sess.upstream.SetReadDeadline(time.Now().Add(dry.timeout)); err != nil {
+			log.Printf("dgram_relay: session client(%s) failed to set deadline err=%s\n", client, err)
+			dry.removeSession(client, sess)
+			return
+		}
+
+		read, err := sess.upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("dgram_relay: session client(%s) closed\n", client)
+				return
+			}
+
+			if errors.Is(err, os.ErrDeadlineExceeded) && !dry.expire(client, sess) {
+				continue
+			}
+
+			log.Printf("dgram_relay: session client(%s) done err=%s\n", client, err)
+			dry.removeSession(client, sess)
+			return
+		}
+
+		dry.touch(sess)
+
+		n, err := conn.WriteToUDPAddrPort(buf[:read], client)
+
+		download.Add(uint64(n))
+
+		if err != nil {
+			log.Printf("dgram_relay: %s->client(%s) fail to relay err=%s\n", sess.upstream.RemoteAddr(), client, err)
+		}
+	}
+}
+
+// Remove session if it was idle at least timeout, returns true if session was removed
+func (dry datagramRelay) expire(client netip.AddrPort, sess *datagramSession) bool {
+	dry.mu.Lock()
+	defer dry.mu.Unlock()
+
+	if time.Since(sess.lastActive) < dry.timeout {
+		return false
+	}
+
+	log.Printf("dgram_relay: session client(%s) expired after %s\n", client, dry.timeout)
+
+	if dry.sessions[client] == sess {
+		delete(dry.sessions, client)
+	}
+
+	return true
+}
+
+// Mark session as active
+func (dry datagramRelay) touch(sess *datagramSession) {
+	dry.mu.Lock()
+	defer dry.mu.Unlock()
+
+	sess.lastActive = time.Now()
+}
+
+// Remove session from active sessions
+func (dry datagramRelay) removeSession(client netip.AddrPort, sess *datagramSession) {
+	dry.mu.Lock()
+	defer dry.mu.Unlock()
+
+	if dry.sessions[client] == sess {
+		delete(dry.sessions, client)
+	}
+}
+
+// Close upstream sockets of all sessions, sessions still dialing remote are closed once it is connected
+func (dry datagramRelay) closeSessions() {
+	dry.mu.Lock()
+	defer dry.mu.Unlock()
+
+	for client, sess := range dry.sessions {
+		if sess.upstream != nil {
+			sess.upstream.Close()
+		}
+
+		delete(dry.sessions, client)
+	}
+}
+
+// Number of active sessions
+func (dry datagramRelay) sessionCount() int {
+	dry.mu.Lock()
+	defer dry.mu.Unlock()
+
+	return len(dry.sessions)
+}
@@ -0,0 +1,263 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"grelay/internal/config"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatagramRelay(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success_echo_and_expire", func(t *testing.T) {
+		const localAddress = "127.0.0.1:52110"
+		const remoteAddress = "127.0.0.1:52011"
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		echo := runUDPEcho(t, remoteAddress)
+		defer echo.Close()
+
+		rel := newDatagramRelay(300*time.Millisecond, newResolver(config.Resolver{}))
+
+		wg := &sync.WaitGroup{}
+
+		wg.Add(1)
+		go func() {
+			rel.runRelay(ctx, localAddress, remoteAddress)
+			wg.Done()
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		conn, err := net.Dial("udp", localAddress)
+		if !assert.NoError(t, err) {
+			cancel()
+			return
+		}
+
+		defer conn.Close()
+
+		for _, msg := range []string{"ping", "pong"} {
+			_, err = conn.Write([]byte(msg))
+			assert.NoError(t, err)
+
+			buf := make([]byte, 10)
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			read, err := conn.Read(buf)
+
+			assert.NoError(t, err)
+			assert.EqualValues(t, msg, string(buf[:read]))
+		}
+
+		assert.EqualValues(t, 1, rel.sessionCount())
+
+		time.Sleep(time.Second)
+
+		assert.EqualValues(t, 0, rel.sessionCount())
+
+		cancel()
+
+		wg.Wait()
+	})
+
+	t.Run("Session_per_client", func(t *testing.T) {
+		const localAddress = "127.0.0.1:52112"
+		const remoteAddress = "127.0.0.1:52012"
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		echo := runUDPEcho(t, remoteAddress)
+		defer echo.Close()
+
+		rel := newDatagramRelay(time.Minute, newResolver(config.Resolver{}))
+
+		wg := &sync.WaitGroup{}
+
+		wg.Add(1)
+		go func() {
+			rel.runRelay(ctx, localAddress, remoteAddress)
+			wg.Done()
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		for i := 0; i < 3; i++ {
+			conn, err := net.Dial("udp", localAddress)
+			if !assert.NoError(t, err) {
+				break
+			}
+
+			conn.Write([]byte("ping"))
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			_, err = conn.Read(make([]byte, 10))
+			assert.NoError(t, err)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 3, rel.sessionCount())
+
+		cancel()
+
+		wg.Wait()
+
+		assert.EqualValues(t, 0, rel.sessionCount())
+	})
+
+	t.Run("Fail_to_resolve_remote", func(t *testing.T) {
+		t.Parallel()
+
+		const localAddress = "127.0.0.1:52114"
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// nobody is listening on resolver address
+		res := newResolver(config.Resolver{Address: netip.MustParseAddrPort("127.0.0.1:52199")})
+
+		rel := newDatagramRelay(time.Second, res)
+
+		wg := &sync.WaitGroup{}
+
+		wg.Add(1)
+		go func() {
+			rel.runRelay(ctx, localAddress, "db.test:53")
+			wg.Done()
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		conn, err := net.Dial("udp", localAddress)
+		if assert.NoError(t, err) {
+			conn.Write([]byte("ping"))
+			conn.Close()
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		assert.EqualValues(t, 0, rel.sessionCount())
+
+		cancel()
+
+		wg.Wait()
+	})
+}
+
+func TestDatagramSlowSession(t *testing.T) {
+	t.Parallel()
+
+	const localAddress = "127.0.0.1:52116"
+	const remoteAddress = "127.0.0.1:52016"
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	echo := runUDPEcho(t, remoteAddress)
+	defer echo.Close()
+
+	// dns server which never answers
+	dns, err := net.ListenPacket("udp", "127.0.0.1:52198")
+	if !assert.NoError(t, err) {
+		cancel()
+		return
+	}
+
+	defer dns.Close()
+
+	rel := newDatagramRelay(time.Minute, newResolver(config.Resolver{Address: netip.MustParseAddrPort("127.0.0.1:52198")}))
+
+	conn, err := bindDatagram(localAddress)
+	if !assert.NoError(t, err) {
+		cancel()
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+
+	// first client gets echo and second one gets remote which is resolved slowly
+	wg.Add(1)
+	go func() {
+		rel.serve(ctx, conn, localAddress, newUpstream([]string{remoteAddress, "slow.test:52016"}, &roundRobinBalancer{}, config.HealthCheck{}))
+		wg.Done()
+	}()
+
+	fast, err := net.Dial("udp", localAddress)
+	if !assert.NoError(t, err) {
+		cancel()
+		return
+	}
+
+	defer fast.Close()
+
+	assertDatagramEcho(t, fast, "ping")
+
+	slow, err := net.Dial("udp", localAddress)
+	if !assert.NoError(t, err) {
+		cancel()
+		return
+	}
+
+	defer slow.Close()
+
+	slow.Write([]byte("ping"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	// session of slow client is dialed in background
+	assertDatagramEcho(t, fast, "pong")
+
+	assert.EqualValues(t, 2, rel.sessionCount())
+
+	cancel()
+
+	wg.Wait()
+
+	assert.EqualValues(t, 0, rel.sessionCount())
+}
+
+// Send msg and check it is sent back within short time
+func assertDatagramEcho(t *testing.T, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg))
+	assert.NoError(t, err)
+
+	buf := make([]byte, 10)
+
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+
+	read, err := conn.Read(buf)
+
+	assert.NoError(t, err)
+	assert.EqualValues(t, msg, string(buf[:read]))
+}
@@ -26,6 +26,25 @@ package relay
 import "errors"
 
 var (
-	ErrRemoteConn = errors.New("error on outngoing conn")
-	ErrListenAddr = errors.New("error on listening address")
+	ErrRemoteConn      = errors.New("error on outngoing conn")
+	ErrListenAddr      = errors.New("error on listening address")
+	ErrUnknownBalancer = errors.New("unknown balancer")
+	ErrNoBackend       = errors.New("no healthy backend")
+	ErrHealthCheck     = errors.New("unexpected health check response")
+	ErrDenied          = errors.New("client is denied by acl")
+	ErrConnLimit       = errors.New("connection limit is reached")
+	ErrQueueTimeout    = errors.New("connection limit is reached and queue timed out")
+	ErrAcceptRate      = errors.New("client exceeds accept rate")
+	ErrBanned          = errors.New("client is banned")
+	ErrRemoteTLS       = errors.New("tls handshake with remote failed")
+	ErrTLSFile         = errors.New("not valid tls file")
+	ErrClientHello     = errors.New("not valid tls client hello")
+	ErrHTTPRequest     = errors.New("not valid http request")
+	ErrProxyHeader     = errors.New("not valid proxy protocol header")
+	ErrUnknownHost     = errors.New("no remote for host name")
+	ErrTunnelRequest   = errors.New("not valid tunnel request")
+	ErrTunnelAuth      = errors.New("tunnel client is not authenticated")
+	ErrDestination     = errors.New("destination is not allowed")
+	ErrOriginalDst     = errors.New("original destination of client is not found")
+	ErrTransparent     = errors.New("transparent socket is not available")
 )
@@ -0,0 +1,251 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Start relay with single route, returned func stops it
+func runRouteRelay(t *testing.T, route config.Route) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	rly := New(ctx)
+
+	if result := rly.Apply(routesConfig{route}); !assert.EqualValues(t, []string{route.Name}, result.Added) {
+		cancel()
+		assert.FailNow(t, "failed to start route")
+	}
+
+	return func() {
+		cancel()
+		rly.Wait()
+	}
+}
+
+// Serve clients of local by pry and relay them to remotes, returned func stops it.
+// Pry is set up by test, so parts route does not expose e.g. lookups could be replaced.
+func runPacketRelay(t *testing.T, pry packetRelay, local string, remotes ...string) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	listener, err := bindConn(ctx, local)
+	if err != nil {
+		cancel()
+		assert.FailNow(t, "failed to bind relay")
+	}
+
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		pry.serve(ctx, listener, local, newUpstream(remotes, &roundRobinBalancer{}, config.HealthCheck{}))
+		wg.Done()
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// Run tcp server on addr, tls is terminated if cfg is set.
+// Every client is served by serve in own routine and closed after that.
+func runTCPServer(t *testing.T, addr string, cfg *tls.Config, serve func(net.Conn)) net.Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		assert.FailNow(t, "failed to open tcp server", addr)
+	}
+
+	if cfg != nil {
+		listener = tls.NewListener(listener, cfg)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				serve(conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// Reader of endless zeroes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+
+	return len(p), nil
+}
+
+// Send all received data back
+func serveEcho(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// Send own address to client
+func serveIdentity(conn net.Conn) {
+	conn.Write([]byte(conn.LocalAddr().String()))
+}
+
+// Send size bytes to client
+func serveSource(size int64) func(net.Conn) {
+	return func(conn net.Conn) {
+		io.Copy(conn, io.LimitReader(zeroReader{}, size))
+	}
+}
+
+// Read client until EOF
+func serveSink(conn net.Conn) {
+	io.Copy(io.Discard, conn)
+}
+
+// Read request until EOF and then send response back
+func serveHalfClose(conn net.Conn) {
+	defer conn.Close()
+
+	request, err := io.ReadAll(conn)
+	if err != nil {
+		return
+	}
+
+	conn.Write([]byte("response:" + string(request)))
+}
+
+// Respond with name and head of received http request
+func serveHTTPIdentity(name string) func(net.Conn) {
+	return func(conn net.Conn) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		reader, request := bufio.NewReader(conn), ""
+
+		for !strings.HasSuffix(request, "\r\n\r\n") {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			request += line
+		}
+
+		// body is short and already sent along with head
+		if reader.Buffered() > 0 {
+			body, _ := reader.Peek(reader.Buffered())
+			request += string(body)
+		}
+
+		body := name + "\n" + request
+
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+	}
+}
+
+// Receive proxy protocol header, wrap connection in tls if cfg is set and send back addresses of header
+func serveProxyHeader(cfg *tls.Config) func(net.Conn) {
+	return func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		pc := newProxyConn(conn, config.ProxyProtocol{Accept: config.ProxyAcceptRequired, Timeout: time.Second, Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}})
+
+		if err := pc.receive(); err != nil {
+			return
+		}
+
+		reply := pc.RemoteAddr().String() + " " + pc.LocalAddr().String() + "\n"
+
+		if cfg != nil {
+			conn = tls.Server(pc, cfg)
+		}
+
+		conn.Write([]byte(reply))
+	}
+}
+
+// Run udp server which sends every datagram back
+func runUDPEcho(t *testing.T, addr string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		assert.FailNow(t, "failed to open udp echo")
+	}
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+
+		for {
+			read, raddr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			conn.WriteTo(buf[:read], raddr)
+		}
+	}()
+
+	return conn
+}
+
+// Send msg and check it is sent back
+func assertEcho(t *testing.T, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg))
+	assert.NoError(t, err)
+
+	buf := make([]byte, len(msg))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = io.ReadFull(conn, buf)
+
+	assert.NoError(t, err)
+	assert.EqualValues(t, msg, string(buf))
+}
+
+// Read conn until it is closed by peer
+func assertClosed(t *testing.T, conn net.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	_, err := io.Copy(io.Discard, conn)
+
+	assert.NoError(t, err, "connection is not closed")
+}
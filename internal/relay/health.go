@@ -0,0 +1,117 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Run active health checks of every backend until ctx is done
+func (ups *upstream) runHealthChecks(ctx context.Context, res *resolver, wg *sync.WaitGroup) {
+	for _, backend := range ups.backends {
+		wg.Add(1)
+
+		go func() {
+			ups.healthCheckLoop(ctx, res, backend)
+
+			wg.Done()
+		}()
+	}
+}
+
+// Check backend every interval, failed backend is ejected until next successful check
+func (ups *upstream) healthCheckLoop(ctx context.Context, res *resolver, backend Backend) {
+	log.Printf("health: start checking backend %s every %s\n", backend.Addr, ups.health.Interval)
+
+	ticker := time.NewTicker(ups.health.Interval)
+	defer ticker.Stop()
+
+	for {
+		err := checkBackend(ctx, res, backend.Addr, ups.health.Timeout, ups.health.Send, ups.health.Expect)
+
+		switch {
+		case ctx.Err() != nil:
+			log.Printf("health: stop checking backend %s\n", backend.Addr)
+			return
+		case err != nil && backend.Healthy():
+			log.Printf("health: backend %s is down err=%s\n", backend.Addr, err)
+			backend.ejectForever()
+		case err == nil && !backend.Healthy():
+			log.Printf("health: backend %s is up\n", backend.Addr)
+			backend.reinstate()
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("health: stop checking backend %s\n", backend.Addr)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Connect to addr, send payload and check response starts with expect
+func checkBackend(ctx context.Context, res *resolver, addr string, timeout time.Duration, send, expect string) error {
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := dialStream(cctx, res, addr)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	if send != "" {
+		if _, err := conn.Write([]byte(send)); err != nil {
+			return err
+		}
+	}
+
+	if expect == "" {
+		return nil
+	}
+
+	buf := make([]byte, len(expect))
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return errors.Join(ErrHealthCheck, err)
+	}
+
+	if !bytes.Equal(buf, []byte(expect)) {
+		return ErrHealthCheck
+	}
+
+	return nil
+}
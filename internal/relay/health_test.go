@@ -0,0 +1,229 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"errors"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBackend(t *testing.T) {
+	t.Parallel()
+
+	const addr = "127.0.0.1:53300"
+
+	listener := runTCPServer(t, addr, nil, serveEcho)
+	defer listener.Close()
+
+	res := newResolver(config.Resolver{})
+
+	t.Run("Success_connect", func(t *testing.T) {
+		assert.NoError(t, checkBackend(context.Background(), res, addr, time.Second, "", ""))
+	})
+
+	t.Run("Success_send_expect", func(t *testing.T) {
+		assert.NoError(t, checkBackend(context.Background(), res, addr, time.Second, "PING\r\n", "PING"))
+	})
+
+	t.Run("Unexpected_response", func(t *testing.T) {
+		err := checkBackend(context.Background(), res, addr, time.Second, "PING\r\n", "PONG")
+
+		assert.ErrorIs(t, err, ErrHealthCheck)
+	})
+
+	t.Run("No_response", func(t *testing.T) {
+		err := checkBackend(context.Background(), res, addr, 100*time.Millisecond, "", "PONG")
+
+		assert.ErrorIs(t, err, ErrHealthCheck)
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		err := checkBackend(context.Background(), res, "127.0.0.1:53301", time.Second, "", "")
+
+		assert.ErrorIs(t, err, ErrRemoteConn)
+	})
+}
+
+func TestHealthCheckLoop(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Down_and_up", func(t *testing.T) {
+		t.Parallel()
+
+		const addr = "127.0.0.1:53310"
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		ups := newUpstream([]string{addr}, &roundRobinBalancer{}, config.HealthCheck{Interval: 50 * time.Millisecond, Timeout: 50 * time.Millisecond})
+
+		wg := &sync.WaitGroup{}
+
+		ups.runHealthChecks(ctx, newResolver(config.Resolver{}), wg)
+
+		time.Sleep(100 * time.Millisecond)
+
+		_, _, err := ups.acquire(netip.Addr{})
+		assert.ErrorIs(t, err, ErrNoBackend)
+
+		listener := runTCPServer(t, addr, nil, serveEcho)
+		defer listener.Close()
+
+		time.Sleep(150 * time.Millisecond)
+
+		backend, release, err := ups.acquire(netip.Addr{})
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, addr, backend.Addr)
+			release()
+		}
+
+		cancel()
+
+		wg.Wait()
+	})
+}
+
+func TestPassiveHealth(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Eject_and_reinstate_by_time", func(t *testing.T) {
+		t.Parallel()
+
+		ups := newUpstream([]string{"b0", "b1"}, &roundRobinBalancer{}, config.HealthCheck{MaxFails: 2, EjectTime: 200 * time.Millisecond})
+
+		dialErr := errors.New("refused")
+
+		ups.report(ups.backends[0], dialErr)
+		assert.True(t, ups.backends[0].Healthy())
+
+		// success resets consecutive failures
+		ups.report(ups.backends[0], nil)
+		ups.report(ups.backends[0], dialErr)
+		assert.True(t, ups.backends[0].Healthy())
+
+		ups.report(ups.backends[0], dialErr)
+		assert.False(t, ups.backends[0].Healthy())
+
+		for i := 0; i < 4; i++ {
+			backend, release, err := ups.acquire(netip.Addr{})
+			if assert.NoError(t, err) {
+				assert.EqualValues(t, "b1", backend.Addr)
+				release()
+			}
+		}
+
+		ups.report(ups.backends[1], dialErr)
+		ups.report(ups.backends[1], dialErr)
+
+		_, _, err := ups.acquire(netip.Addr{})
+		assert.ErrorIs(t, err, ErrNoBackend)
+
+		time.Sleep(250 * time.Millisecond)
+
+		assert.True(t, ups.backends[0].Healthy())
+		assert.True(t, ups.backends[1].Healthy())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+
+		ups := newUpstream([]string{"b0"}, &roundRobinBalancer{}, config.HealthCheck{})
+
+		for i := 0; i < 10; i++ {
+			ups.report(ups.backends[0], errors.New("refused"))
+		}
+
+		assert.True(t, ups.backends[0].Healthy())
+	})
+
+	t.Run("Ejected_until_active_check", func(t *testing.T) {
+		t.Parallel()
+
+		ups := newUpstream([]string{"b0"}, &roundRobinBalancer{}, config.HealthCheck{Interval: time.Hour, MaxFails: 1, EjectTime: time.Millisecond})
+
+		ups.report(ups.backends[0], errors.New("refused"))
+
+		time.Sleep(10 * time.Millisecond)
+
+		assert.False(t, ups.backends[0].Healthy())
+
+		ups.backends[0].reinstate()
+
+		assert.True(t, ups.backends[0].Healthy())
+	})
+}
+
+func TestRejectWithoutBackend(t *testing.T) {
+	t.Parallel()
+
+	const localAddress = "127.0.0.1:53320"
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	listener, err := bindConn(ctx, localAddress)
+	if !assert.NoError(t, err) {
+		cancel()
+		return
+	}
+
+	ups := newUpstream([]string{"127.0.0.1:53321"}, &roundRobinBalancer{}, config.HealthCheck{MaxFails: 1, EjectTime: time.Minute})
+
+	ups.backends[0].ejectForever()
+
+	pry := newPacketRelay(newResolver(config.Resolver{}))
+
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		pry.serve(ctx, listener, localAddress, ups)
+		wg.Done()
+	}()
+
+	conn, err := net.Dial("tcp", localAddress)
+	if assert.NoError(t, err) {
+		started := time.Now()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, err = conn.Read(make([]byte, 1))
+
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Less(t, time.Since(started), 500*time.Millisecond)
+
+		conn.Close()
+	}
+
+	cancel()
+
+	wg.Wait()
+}
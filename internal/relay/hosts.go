@@ -0,0 +1,180 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Timeout of reading first bytes of client which are routed by
+const peekTimeout = 10 * time.Second
+
+// Max size of first bytes of client which are routed by
+const maxPeekSize = 64 << 10
+
+// More bytes of client are needed to parse them
+var errIncomplete = errors.New("incomplete")
+
+// Parser of host name and request path out of first bytes of client, errIncomplete is returned until bytes are enough
+type hostParser func([]byte) (host, path string, err error)
+
+// Router of clients to upstreams by host name and path found in first bytes of client
+type hostRouter struct {
+	parse hostParser
+	// Wraps errors of malformed first bytes
+	malformed error
+	// Routes in order of matching: exact hosts, then wildcards by longest suffix, longest path first for every host
+	routes []hostRoute
+	// Upstream of unknown hosts, they are rejected if nil
+	fallback *upstream
+}
+
+// Upstream of host and path prefix
+type hostRoute struct {
+	// Exact host name or suffix with leading dot e.g. .example.com
+	host     string
+	wildcard bool
+	// Path prefix, any path matches if empty
+	path string
+	ups  *upstream
+}
+
+// Create router of host names parsed by parse
+func newHostRouter(parse hostParser, malformed error) *hostRouter {
+	return &hostRouter{parse: parse, malformed: malformed}
+}
+
+// Route host name or wildcard like *.example.com with requests under path prefix to ups
+func (hr *hostRouter) add(host, path string, ups *upstream) {
+	suffix, wildcard := strings.CutPrefix(host, "*")
+	if wildcard {
+		host = suffix
+	}
+
+	hr.routes = append(hr.routes, hostRoute{host: host, wildcard: wildcard, path: path, ups: ups})
+
+	slices.SortStableFunc(hr.routes, func(a, b hostRoute) int {
+		if a.wildcard != b.wildcard {
+			if a.wildcard {
+				return 1
+			}
+
+			return -1
+		}
+
+		if a.wildcard && len(a.host) != len(b.host) {
+			return len(b.host) - len(a.host)
+		}
+
+		return len(b.path) - len(a.path)
+	})
+}
+
+// Upstream of host and path, exact name wins over wildcards and the longest wildcard wins over shorter ones.
+// The longest path prefix of host wins, host without matching prefix is matched by next wildcard.
+func (hr *hostRouter) match(host, path string) *upstream {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	for _, route := range hr.routes {
+		if route.wildcard && (len(host) <= len(route.host) || !strings.HasSuffix(host, route.host)) {
+			continue
+		}
+
+		if !route.wildcard && host != route.host {
+			continue
+		}
+
+		if hasPathPrefix(path, route.path) {
+			return route.ups
+		}
+	}
+
+	return hr.fallback
+}
+
+// Read first bytes of client until host name is parsed and pick upstream of it.
+// Read bytes are returned to be replayed to remote. Connection is routed once, so further requests of
+// keep-alive http connection go to the same upstream whatever host or path they carry.
+func (hr *hostRouter) route(conn net.Conn) ([]byte, string, *upstream, error) {
+	data, host, path, err := peek(conn, hr.parse)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("%w: %w", hr.malformed, err)
+	}
+
+	ups := hr.match(host, path)
+	if ups == nil {
+		return nil, host, nil, fmt.Errorf("%w: %q path %q", ErrUnknownHost, host, path)
+	}
+
+	return data, host, ups, nil
+}
+
+// Whether path is under prefix, prefix matches whole path segments e.g. /api matches /api/v1 and not /apiv1
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// Read conn within peek timeout until parse succeeds
+func peek(conn net.Conn, parse hostParser) ([]byte, string, string, error) {
+	conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 0, 4096)
+
+	for {
+		if len(buf) == cap(buf) {
+			if len(buf) >= maxPeekSize {
+				return nil, "", "", fmt.Errorf("more than %d bytes", maxPeekSize)
+			}
+
+			buf = slices.Grow(buf, len(buf))
+		}
+
+		n, rerr := conn.Read(buf[len(buf):cap(buf)])
+
+		buf = buf[:len(buf)+n]
+
+		host, path, err := parse(buf)
+		if err == nil {
+			return buf, host, path, nil
+		}
+
+		if !errors.Is(err, errIncomplete) {
+			return nil, "", "", err
+		}
+
+		if rerr != nil {
+			return nil, "", "", rerr
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostRouter(t *testing.T) {
+	t.Parallel()
+
+	exact, api, wildcard, nested, fallback := &upstream{}, &upstream{}, &upstream{}, &upstream{}, &upstream{}
+
+	hr := newHostRouter(parseTLSHost, ErrClientHello)
+
+	hr.add("*.example.com", "", wildcard)
+	hr.add("git.example.com", "", exact)
+	hr.add("git.example.com", "/api", api)
+	hr.add("*.dev.example.com", "/app/", nested)
+
+	tests := map[string]struct {
+		host string
+		path string
+		ups  *upstream
+	}{
+		"exact":                     {host: "git.example.com", ups: exact},
+		"exact case insensitive":    {host: "GIT.example.com.", path: "/", ups: exact},
+		"longest path":              {host: "git.example.com", path: "/api/v1", ups: api},
+		"whole path":                {host: "git.example.com", path: "/api", ups: api},
+		"path segment":              {host: "git.example.com", path: "/apiv1", ups: exact},
+		"wildcard":                  {host: "wiki.example.com", ups: wildcard},
+		"wildcard of nested domain": {host: "a.b.example.com", ups: wildcard},
+		"nested wildcard path":      {host: "app.dev.example.com", path: "/app/index.html", ups: nested},
+		"nested wildcard other":     {host: "app.dev.example.com", path: "/admin", ups: wildcard},
+		"wildcard not apex":         {host: "example.com", ups: nil},
+		"unknown":                   {host: "other.org", ups: nil},
+		"empty":                     {host: "", ups: nil},
+	}
+
+	for name, test := range tests {
+		assert.Same(t, test.ups, hr.match(test.host, test.path), name)
+	}
+
+	hr.fallback = fallback
+
+	assert.Same(t, fallback, hr.match("other.org", "/"))
+	assert.Same(t, fallback, hr.match("", ""))
+	assert.Same(t, exact, hr.match("git.example.com", "/"))
+}
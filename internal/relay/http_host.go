@@ -0,0 +1,76 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Parse host and path of first http/1.x request, errIncomplete is returned until its headers are read.
+// Host of absolute request target wins over host header, port is stripped. Path is cleaned.
+func parseHTTPHost(data []byte) (string, string, error) {
+	// request starts with method token, other protocols are rejected without waiting for headers
+	if len(data) != 0 && (data[0] < 'A' || data[0] > 'Z') {
+		return "", "", ErrHTTPRequest
+	}
+
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", "", errIncomplete
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data[:end+4])))
+	if err != nil || req.ProtoMajor != 1 {
+		return "", "", ErrHTTPRequest
+	}
+
+	host := req.Host
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), "."), cleanPath(req.URL.Path), nil
+}
+
+// Resolve dot-segments and duplicate slashes of path the way backends do, so e.g. /public/../admin does not match /public.
+// Trailing slash is kept, paths not starting with slash e.g. * are left as they are.
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+
+	cleaned := path.Clean(p)
+
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
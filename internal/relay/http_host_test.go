@@ -0,0 +1,275 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"errors"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHTTPHost(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		request string
+		host    string
+		path    string
+		err     error
+	}{
+		"host header": {
+			request: "GET /api/v1?q=1 HTTP/1.1\r\nHost: Git.Example.com\r\nAccept: */*\r\n\r\n",
+			host:    "git.example.com",
+			path:    "/api/v1",
+		},
+		"host with port": {
+			request: "POST / HTTP/1.1\r\nHost: git.example.com:8080\r\nContent-Length: 4\r\n\r\nbody",
+			host:    "git.example.com",
+			path:    "/",
+		},
+		"ipv6 host": {
+			request: "GET / HTTP/1.1\r\nHost: [fd00::1]:8080\r\n\r\n",
+			host:    "fd00::1",
+			path:    "/",
+		},
+		"absolute target": {
+			request: "GET http://wiki.example.com/docs HTTP/1.1\r\nHost: git.example.com\r\n\r\n",
+			host:    "wiki.example.com",
+			path:    "/docs",
+		},
+		"dot segments": {
+			request: "GET /public/../admin HTTP/1.1\r\nHost: git.example.com\r\n\r\n",
+			host:    "git.example.com",
+			path:    "/admin",
+		},
+		"encoded dot segments": {
+			request: "GET /public/%2e%2e//admin/./ HTTP/1.1\r\nHost: git.example.com\r\n\r\n",
+			host:    "git.example.com",
+			path:    "/admin/",
+		},
+		"no host": {
+			request: "GET /index.html HTTP/1.0\r\n\r\n",
+			host:    "",
+			path:    "/index.html",
+		},
+		"incomplete headers": {
+			request: "GET / HTTP/1.1\r\nHost: git.example.com\r\n",
+			err:     errIncomplete,
+		},
+		"empty": {
+			request: "",
+			err:     errIncomplete,
+		},
+		"tls hello": {
+			request: "\x16\x03\x01\x02\x00\x01",
+			err:     ErrHTTPRequest,
+		},
+		"malformed request line": {
+			request: "GET /\r\nHost: git.example.com\r\n\r\n",
+			err:     ErrHTTPRequest,
+		},
+		"http 2 preface": {
+			request: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n",
+			err:     ErrHTTPRequest,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			host, path, err := parseHTTPHost([]byte(test.request))
+
+			assert.ErrorIs(t, err, test.err)
+
+			if test.err == nil {
+				assert.EqualValues(t, test.host, host)
+				assert.EqualValues(t, test.path, path)
+			}
+		})
+	}
+}
+
+func TestHTTPRouting(t *testing.T) {
+	t.Parallel()
+
+	// remotes differ by address and share remote port
+	backends := map[string]string{"git": "127.0.0.1", "api": "127.0.0.2", "wildcard": "127.0.0.3", "default": "127.0.0.4"}
+
+	for name, addr := range backends {
+		listener := runTCPServer(t, addr+":24301", nil, serveHTTPIdentity(name))
+
+		// parallel subtests complete after parent returns
+		t.Cleanup(func() { listener.Close() })
+	}
+
+	httpRoute := func(name string, local uint16, fallback []string) config.Route {
+		route := testRoute(name, local, 24301)
+		route.Mode = config.ModeHTTP
+		route.Remotes = fallback
+		route.Hosts = []config.HostRoute{
+			{Host: "git.example.com", Remotes: []string{backends["git"]}},
+			{Host: "git.example.com", Path: "/api", Remotes: []string{backends["api"]}},
+			{Host: "*.example.com", Remotes: []string{backends["wildcard"]}},
+		}
+
+		return route
+	}
+
+	t.Run("Success_routed_by_host_and_path", func(t *testing.T) {
+		t.Parallel()
+
+		stop := runRouteRelay(t, httpRoute("http", 24300, []string{backends["default"]}))
+		defer stop()
+
+		tests := map[string]string{
+			"GET / HTTP/1.1\r\nHost: git.example.com\r\n\r\n":                                                  "git",
+			"GET /api/v1/users HTTP/1.1\r\nHost: git.example.com:24300\r\nUser-Agent: test\r\n\r\n":            "api",
+			"POST /api HTTP/1.1\r\nhost: GIT.example.com\r\nContent-Length: 5\r\n\r\nhello":                    "api",
+			"GET /apiv2 HTTP/1.1\r\nHost: git.example.com\r\n\r\n":                                             "git",
+			"GET /api/../admin HTTP/1.1\r\nHost: git.example.com\r\n\r\n":                                      "git",
+			"GET /docs/../api/v1 HTTP/1.1\r\nHost: git.example.com\r\n\r\n":                                    "api",
+			"GET /wiki HTTP/1.1\r\nHost: wiki.example.com\r\n\r\n":                                             "wildcard",
+			"GET http://git.example.com/api HTTP/1.1\r\nHost: other.org\r\n\r\n":                               "api",
+			"GET / HTTP/1.1\r\nHost: other.org\r\n\r\n":                                                        "default",
+			"GET / HTTP/1.0\r\n\r\n":                                                                           "default",
+			"GET / HTTP/1.1\r\nHost: wiki.example.com\r\nX-Padding: " + strings.Repeat("a", 8000) + "\r\n\r\n": "wildcard",
+		}
+
+		for request, backend := range tests {
+			name, received := httpIdentity(t, "127.0.0.1:24300", request)
+
+			assert.EqualValues(t, backend, name, request)
+
+			// request is forwarded untouched
+			assert.EqualValues(t, request, received)
+		}
+	})
+
+	t.Run("Success_split_request", func(t *testing.T) {
+		t.Parallel()
+
+		stop := runRouteRelay(t, httpRoute("http-split", 24302, nil))
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24302")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		request := "GET /api/v1 HTTP/1.1\r\nHost: git.example.com\r\n\r\n"
+
+		for _, part := range []string{request[:10], request[10:30], request[30:]} {
+			conn.Write([]byte(part))
+
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		name, received := readHTTPIdentity(t, conn)
+
+		assert.EqualValues(t, "api", name)
+		assert.EqualValues(t, request, received)
+	})
+
+	t.Run("Unknown_host_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		route := httpRoute("http-no-default", 24303, nil)
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24303")
+		if assert.NoError(t, err) {
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: other.org\r\n\r\n"))
+
+			assertClosed(t, conn, time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 1, connRejected.With(route.Name, route.Ports[0].String(), rejectHost).Value())
+	})
+
+	t.Run("Not_http_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		route := httpRoute("http-tls", 24304, []string{backends["default"]})
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24304")
+		if assert.NoError(t, err) {
+			conn.Write([]byte{recordTypeHandshake, 3, 1})
+
+			assertClosed(t, conn, time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 1, connRejected.With(route.Name, route.Ports[0].String(), rejectRequest).Value())
+	})
+}
+
+// Send request and get name of http identity and request it has received
+func httpIdentity(t *testing.T, addr, request string) (string, string) {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return "", ""
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte(request))
+
+	return readHTTPIdentity(t, conn)
+}
+
+// Read response of http identity
+func readHTTPIdentity(t *testing.T, conn net.Conn) (string, string) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	response, err := io.ReadAll(conn)
+	if err != nil && !errors.Is(err, io.EOF) {
+		assert.NoError(t, err)
+	}
+
+	_, body, found := strings.Cut(string(response), "\r\n\r\n")
+	if !assert.True(t, found, "no http response") {
+		return "", ""
+	}
+
+	name, request, _ := strings.Cut(body, "\n")
+
+	return name, request
+}
@@ -0,0 +1,235 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"container/list"
+	"context"
+	"grelay/internal/config"
+	"grelay/internal/metrics"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Limiter of concurrent connections, route limiters are chained to global one.
+// Connection takes slot in every limiter of chain, over-limit connections wait in single queue of chain root.
+type connLimiter struct {
+	// Guards state of whole chain, shared with parent
+	mu *sync.Mutex
+	// Limiter of upper level e.g. global one of route limiter
+	parent *connLimiter
+	limits config.Limits
+	// Connections holding slot
+	active int
+	// Connections holding slot by client ip
+	perIP map[netip.Addr]int
+	// Connections waiting for slot in accept order, shared with parent
+	queue *list.List
+}
+
+// Connection waiting for slot
+type limitWaiter struct {
+	limiter *connLimiter
+	client  netip.Addr
+	// Closed once slot is taken for waiter
+	ready chan struct{}
+}
+
+// Create limiter, it is chained to parent if not nil
+func newConnLimiter(limits config.Limits, parent *connLimiter) *connLimiter {
+	l := &connLimiter{parent: parent, limits: limits, perIP: map[netip.Addr]int{}}
+
+	if parent != nil {
+		l.mu = parent.mu
+		l.queue = parent.queue
+	} else {
+		l.mu = &sync.Mutex{}
+		l.queue = list.New()
+	}
+
+	return l
+}
+
+// Replace limits, waiting connections which fit new limits are let through
+func (l *connLimiter) update(limits config.Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits = limits
+
+	l.wakeup()
+}
+
+// Take slot for client. Over-limit client waits in accept order until slot is free and is counted by queued meanwhile,
+// ErrConnLimit is returned if queueing is off and ErrQueueTimeout once queue timeout or ctx is done.
+// Returned func frees slot and has to be called once connection is done. Nil limiter is unlimited.
+func (l *connLimiter) acquire(ctx context.Context, client netip.Addr, queued *metrics.Gauge) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+
+	if l.fits(client) {
+		l.take(client)
+		l.mu.Unlock()
+
+		return l.releaser(client), nil
+	}
+
+	if l.limits.QueueTimeout == 0 {
+		l.mu.Unlock()
+
+		return nil, ErrConnLimit
+	}
+
+	waiter := &limitWaiter{limiter: l, client: client, ready: make(chan struct{})}
+
+	elem := l.queue.PushBack(waiter)
+
+	l.mu.Unlock()
+
+	queued.Inc()
+	defer queued.Dec()
+
+	timer := time.NewTimer(l.limits.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-waiter.ready:
+		return l.releaser(client), nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		// slot was taken right before timeout
+		return l.releaser(client), nil
+	default:
+	}
+
+	l.queue.Remove(elem)
+
+	return nil, ErrQueueTimeout
+}
+
+// Take slot for client without waiting
+func (l *connLimiter) tryAcquire(client netip.Addr) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.fits(client) {
+		return nil, ErrConnLimit
+	}
+
+	l.take(client)
+
+	return l.releaser(client), nil
+}
+
+// Current number of connections holding slot and waiting for it
+func (l *connLimiter) usage() (active, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.active, l.queue.Len()
+}
+
+// Check whether every limiter of chain has free slot for client, mu is held
+func (l *connLimiter) fits(client netip.Addr) bool {
+	for ; l != nil; l = l.parent {
+		if l.limits.MaxConns > 0 && l.active >= l.limits.MaxConns {
+			return false
+		}
+
+		if l.limits.MaxConnsPerIP > 0 && l.perIP[client] >= l.limits.MaxConnsPerIP {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Take slot in every limiter of chain, mu is held
+func (l *connLimiter) take(client netip.Addr) {
+	for ; l != nil; l = l.parent {
+		l.active++
+		l.perIP[client]++
+	}
+}
+
+// Free slot in every limiter of chain and let waiting connections through, mu is held
+func (l *connLimiter) free(client netip.Addr) {
+	for c := l; c != nil; c = c.parent {
+		c.active--
+
+		if c.perIP[client]--; c.perIP[client] == 0 {
+			delete(c.perIP, client)
+		}
+	}
+
+	l.wakeup()
+}
+
+// Let through waiting connections which fit limits in accept order, mu is held
+func (l *connLimiter) wakeup() {
+	for elem := l.queue.Front(); elem != nil; {
+		next := elem.Next()
+
+		waiter := elem.Value.(*limitWaiter)
+
+		if waiter.limiter.fits(waiter.client) {
+			waiter.limiter.take(waiter.client)
+
+			l.queue.Remove(elem)
+
+			close(waiter.ready)
+		}
+
+		elem = next
+	}
+}
+
+// Func freeing slot of client once
+func (l *connLimiter) releaser(client netip.Addr) func() {
+	once := &sync.Once{}
+
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.free(client)
+		})
+	}
+}
@@ -0,0 +1,299 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"grelay/internal/config"
+	"grelay/internal/metrics"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimiter(t *testing.T) {
+	t.Parallel()
+
+	clientA := netip.MustParseAddr("10.0.0.1")
+	clientB := netip.MustParseAddr("10.0.0.2")
+
+	t.Run("Nil_is_unlimited", func(t *testing.T) {
+		t.Parallel()
+
+		var l *connLimiter
+
+		free, err := l.acquire(context.Background(), clientA, nil)
+		assert.NoError(t, err)
+
+		free()
+
+		free, err = l.tryAcquire(clientA)
+		assert.NoError(t, err)
+
+		free()
+	})
+
+	t.Run("Route_limit_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		l := newConnLimiter(config.Limits{MaxConns: 2}, newConnLimiter(config.Limits{}, nil))
+
+		free1, err := l.acquire(context.Background(), clientA, nil)
+		assert.NoError(t, err)
+
+		_, err = l.acquire(context.Background(), clientB, nil)
+		assert.NoError(t, err)
+
+		_, err = l.acquire(context.Background(), clientB, nil)
+		assert.ErrorIs(t, err, ErrConnLimit)
+
+		active, queued := l.usage()
+		assert.EqualValues(t, 2, active)
+		assert.EqualValues(t, 0, queued)
+
+		// slot is freed once only
+		free1()
+		free1()
+
+		_, err = l.tryAcquire(clientA)
+		assert.NoError(t, err)
+
+		_, err = l.tryAcquire(clientA)
+		assert.ErrorIs(t, err, ErrConnLimit)
+	})
+
+	t.Run("Global_limit_shared_by_routes", func(t *testing.T) {
+		t.Parallel()
+
+		global := newConnLimiter(config.Limits{MaxConns: 2}, nil)
+
+		route1 := newConnLimiter(config.Limits{}, global)
+		route2 := newConnLimiter(config.Limits{}, global)
+
+		_, err := route1.tryAcquire(clientA)
+		assert.NoError(t, err)
+
+		free, err := route2.tryAcquire(clientB)
+		assert.NoError(t, err)
+
+		_, err = route1.tryAcquire(clientB)
+		assert.ErrorIs(t, err, ErrConnLimit)
+
+		free()
+
+		_, err = route1.tryAcquire(clientB)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Per_ip_limit", func(t *testing.T) {
+		t.Parallel()
+
+		global := newConnLimiter(config.Limits{MaxConnsPerIP: 2}, nil)
+
+		route1 := newConnLimiter(config.Limits{MaxConnsPerIP: 1}, global)
+		route2 := newConnLimiter(config.Limits{}, global)
+
+		_, err := route1.tryAcquire(clientA)
+		assert.NoError(t, err)
+
+		_, err = route1.tryAcquire(clientA)
+		assert.ErrorIs(t, err, ErrConnLimit)
+
+		_, err = route1.tryAcquire(clientB)
+		assert.NoError(t, err)
+
+		_, err = route2.tryAcquire(clientA)
+		assert.NoError(t, err)
+
+		_, err = route2.tryAcquire(clientA)
+		assert.ErrorIs(t, err, ErrConnLimit)
+	})
+
+	t.Run("Queued_in_accept_order", func(t *testing.T) {
+		t.Parallel()
+
+		l := newConnLimiter(config.Limits{MaxConns: 1, QueueTimeout: 5 * time.Second}, nil)
+
+		queued := &metrics.Gauge{}
+
+		free, err := l.acquire(context.Background(), clientA, queued)
+		assert.NoError(t, err)
+
+		order := make(chan int, 3)
+
+		for i := range 3 {
+			go func() {
+				free, err := l.acquire(context.Background(), clientB, queued)
+				if assert.NoError(t, err) {
+					order <- i
+					free()
+				}
+			}()
+
+			// waiters are queued one by one
+			assert.Eventually(t, func() bool {
+				_, waiting := l.usage()
+				return waiting == i+1
+			}, time.Second, time.Millisecond)
+		}
+
+		assert.EqualValues(t, 3, queued.Value())
+
+		free()
+
+		for i := range 3 {
+			select {
+			case got := <-order:
+				assert.EqualValues(t, i, got)
+			case <-time.After(time.Second):
+				assert.FailNow(t, "queued connection is not let through")
+			}
+		}
+
+		assert.Eventually(t, func() bool { return queued.Value() == 0 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("Queue_timed_out", func(t *testing.T) {
+		t.Parallel()
+
+		l := newConnLimiter(config.Limits{MaxConns: 1, QueueTimeout: 50 * time.Millisecond}, nil)
+
+		_, err := l.acquire(context.Background(), clientA, nil)
+		assert.NoError(t, err)
+
+		started := time.Now()
+
+		_, err = l.acquire(context.Background(), clientB, nil)
+		assert.ErrorIs(t, err, ErrQueueTimeout)
+		assert.GreaterOrEqual(t, time.Since(started), 50*time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err = l.acquire(ctx, clientB, nil)
+		assert.ErrorIs(t, err, ErrQueueTimeout)
+
+		_, queued := l.usage()
+		assert.EqualValues(t, 0, queued)
+	})
+
+	t.Run("Update_lets_queued_through", func(t *testing.T) {
+		t.Parallel()
+
+		global := newConnLimiter(config.Limits{MaxConns: 1}, nil)
+
+		l := newConnLimiter(config.Limits{QueueTimeout: 5 * time.Second}, global)
+
+		_, err := l.acquire(context.Background(), clientA, nil)
+		assert.NoError(t, err)
+
+		done := make(chan error)
+
+		go func() {
+			_, err := l.acquire(context.Background(), clientB, nil)
+			done <- err
+		}()
+
+		assert.Eventually(t, func() bool {
+			_, queued := l.usage()
+			return queued == 1
+		}, time.Second, time.Millisecond)
+
+		global.update(config.Limits{MaxConns: 2})
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			assert.Fail(t, "queued connection is not let through")
+		}
+	})
+}
+
+func TestRouteLimits(t *testing.T) {
+	t.Parallel()
+
+	const remoteAddress = "127.0.0.1:53801"
+
+	echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+	defer echo.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	rly := New(ctx)
+
+	route := testRoute("limited", 53800, 53801)
+	route.Limits = config.Limits{MaxConns: 1}
+
+	assert.EqualValues(t, ReloadResult{Added: []string{"limited"}}, rly.Apply(routesConfig{route}))
+
+	first, err := net.Dial("tcp", "127.0.0.1:53800")
+	if !assert.NoError(t, err) {
+		cancel()
+		return
+	}
+
+	assertEcho(t, first, "ping")
+
+	// over-limit client is closed without relaying
+	second, err := net.Dial("tcp", "127.0.0.1:53800")
+	if assert.NoError(t, err) {
+		second.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, err = second.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+
+		second.Close()
+	}
+
+	first.Close()
+
+	// slot is freed once relaying is done
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", "127.0.0.1:53800")
+		if err != nil {
+			return false
+		}
+
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return false
+		}
+
+		_, err = io.ReadFull(conn, make([]byte, 4))
+
+		return err == nil
+	}, 2*time.Second, 50*time.Millisecond)
+
+	cancel()
+
+	rly.Wait()
+}
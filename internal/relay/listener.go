@@ -28,14 +28,33 @@ import (
 	"errors"
 	"log"
 	"net"
+	"net/netip"
 	"sync"
 )
 
+// Max size of udp datagram payload
+const maxDatagramSize = 65535
+
 // Handle new connection on goroutines
 type acceptorFunc func(ctx context.Context, conn net.Conn)
 
+// Handle datagram received from client, data is valid only until func returns
+type datagramFunc func(ctx context.Context, conn *net.UDPConn, client netip.AddrPort, data []byte)
+
 // Run listener bound to addr and call connHandler on new incoming connection
 func listenConn(ctx context.Context, addr string, connHandler acceptorFunc) error {
+	listener, err := bindConn(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	serveConn(ctx, listener, addr, connHandler)
+
+	return nil
+}
+
+// Create tcp listener bound to addr
+func bindConn(ctx context.Context, addr string) (net.Listener, error) {
 	log.Printf("listener: start listening on addr=%s\n", addr)
 
 	lc := &net.ListenConfig{}
@@ -43,9 +62,15 @@ func listenConn(ctx context.Context, addr string, connHandler acceptorFunc) erro
 	listener, err := lc.Listen(ctx, "tcp", addr)
 	if err != nil {
 		log.Printf("listener: failed to listen addr=%s, err=%s\n", addr, err)
-		return errors.Join(ErrListenAddr, err)
+		return nil, errors.Join(ErrListenAddr, err)
 	}
 
+	return listener, nil
+}
+
+// Accept connections and call connHandler on each until ctx is done or listener is closed.
+// Closing listener only stops accepting, returns after all handlers complete.
+func serveConn(ctx context.Context, listener net.Listener, addr string, connHandler acceptorFunc) {
 	defer listener.Close()
 
 	wg := &sync.WaitGroup{}
@@ -60,7 +85,7 @@ func listenConn(ctx context.Context, addr string, connHandler acceptorFunc) erro
 
 		log.Printf("listener: close relay listener addr=%s\n", addr)
 
-		if err := listener.Close(); err != nil {
+		if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			log.Println("listener: failed to close listener")
 		}
 	}()
@@ -87,6 +112,76 @@ func listenConn(ctx context.Context, addr string, connHandler acceptorFunc) erro
 	wg.Wait()
 
 	log.Printf("listener: stop listening on addr=%s\n", addr)
+}
+
+// Run udp listener bound to addr and call dgHandler on every received datagram
+func listenDatagram(ctx context.Context, addr string, dgHandler datagramFunc) error {
+	conn, err := bindDatagram(addr)
+	if err != nil {
+		return err
+	}
+
+	serveDatagram(ctx, conn, addr, dgHandler)
 
 	return nil
 }
+
+// Create udp socket bound to addr
+func bindDatagram(addr string) (*net.UDPConn, error) {
+	log.Printf("listener: start listening datagrams on addr=%s\n", addr)
+
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		log.Printf("listener: failed to resolve addr=%s, err=%s\n", addr, err)
+		return nil, errors.Join(ErrListenAddr, err)
+	}
+
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		log.Printf("listener: failed to listen addr=%s, err=%s\n", addr, err)
+		return nil, errors.Join(ErrListenAddr, err)
+	}
+
+	return conn, nil
+}
+
+// Read datagrams and call dgHandler on each until ctx is done or socket is closed
+func serveDatagram(ctx context.Context, conn *net.UDPConn, addr string, dgHandler datagramFunc) {
+	defer conn.Close()
+
+	wg := &sync.WaitGroup{}
+
+	lctx, cancel := context.WithCancel(ctx)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-lctx.Done()
+
+		log.Printf("listener: close datagram listener addr=%s\n", addr)
+
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("listener: failed to close datagram listener")
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		read, client, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			log.Printf("listener: failed to read datagram for addr=%s err=%v\n", addr, err)
+			break
+		}
+
+		dgHandler(ctx, conn, client, buf[:read])
+	}
+
+	// cancel if not and wait for close goroutine completes
+	cancel()
+
+	wg.Wait()
+
+	log.Printf("listener: stop listening datagrams on addr=%s\n", addr)
+}
@@ -26,6 +26,7 @@ package relay
 import (
 	"context"
 	"net"
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
@@ -108,3 +109,39 @@ func TestListener(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestDatagramListener(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success_on_listen_and_read", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		received := make(chan string, 1)
+
+		go func() {
+			_ = listenDatagram(ctx, "127.0.0.1:50600", func(_ context.Context, _ *net.UDPConn, _ netip.AddrPort, data []byte) {
+				received <- string(data)
+				cancel()
+			})
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		conn, err := net.Dial("udp", "127.0.0.1:50600")
+		assert.NoError(t, err)
+
+		defer conn.Close()
+
+		conn.Write([]byte("data"))
+
+		assert.EqualValues(t, "data", <-received)
+	})
+
+	t.Run("Fail_to_listen", func(t *testing.T) {
+		t.Parallel()
+
+		err := listenDatagram(context.Background(), "428.0.0.1:1012", func(_ context.Context, _ *net.UDPConn, _ netip.AddrPort, _ []byte) {})
+
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,265 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"errors"
+	"grelay/internal/config"
+	"grelay/internal/metrics"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reasons of client rejection
+const (
+	rejectNoBackend = "no_backend"
+	rejectACL       = "acl"
+	rejectLimit     = "conn_limit"
+	rejectQueue     = "queue_timeout"
+	rejectRate      = "accept_rate"
+	rejectBanned    = "banned"
+	rejectHandshake = "tls_handshake"
+	rejectHost      = "unknown_host"
+	rejectHello     = "malformed_hello"
+	rejectRequest   = "malformed_request"
+	rejectProxy     = "proxy_header"
+	rejectTunnel    = "tunnel_request"
+	rejectAuth      = "tunnel_auth"
+	rejectDest      = "destination"
+	rejectOrigDst   = "original_dst"
+)
+
+// Reasons of failed dial to remote
+const (
+	dialFailTimeout    = "timeout"
+	dialFailRefused    = "refused"
+	dialFailUnresolved = "unresolved"
+	dialFailTLS        = "tls"
+	dialFailOther      = "other"
+)
+
+// Directions of relayed bytes
+const (
+	// From client to remote
+	directionUpload = "upload"
+	// From remote to client
+	directionDownload = "download"
+)
+
+// Http path of ban list on metrics endpoint
+const bansPath = "/bans"
+
+// Upper bounds of connection duration buckets in seconds
+var durationBuckets = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// Registry of relay metrics exposed by metrics endpoint
+var registry = metrics.NewRegistry()
+
+var (
+	connActive = registry.NewGauge("grelay_connections_active",
+		"Number of relayed connections and udp sessions.", "route", "port")
+	connAccepted = registry.NewCounter("grelay_connections_accepted_total",
+		"Number of accepted connections and new udp sessions.", "route", "port")
+	connRejected = registry.NewCounter("grelay_connections_rejected_total",
+		"Number of clients closed without relaying.", "route", "port", "reason")
+	dialFailures = registry.NewCounter("grelay_dial_failures_total",
+		"Number of failed dials to remote.", "route", "port", "reason")
+	bytesRelayed = registry.NewCounter("grelay_relayed_bytes_total",
+		"Number of relayed bytes, upload is from client to remote.", "route", "port", "direction")
+	connQueued = registry.NewGauge("grelay_connections_queued",
+		"Number of connections waiting for free slot of connection limits.", "route", "port")
+	connTimedOut = registry.NewCounter("grelay_connections_timed_out_total",
+		"Number of relayed connections closed by timeout.", "route", "port", "reason")
+	connDuration = registry.NewHistogram("grelay_connection_duration_seconds",
+		"Duration of relayed connections and udp sessions.", durationBuckets, "route", "port")
+)
+
+// Metrics of single route port
+type portMetrics struct {
+	route string
+	port  string
+}
+
+// Create metrics labeled by route name and port
+func newPortMetrics(route string, port config.Port) portMetrics {
+	return portMetrics{route: route, port: port.String()}
+}
+
+// Count accepted client
+func (pm portMetrics) accepted() {
+	connAccepted.With(pm.route, pm.port).Inc()
+}
+
+// Count client closed without relaying
+func (pm portMetrics) rejected(reason string) {
+	connRejected.With(pm.route, pm.port, reason).Inc()
+}
+
+// Count failed dial by its reason
+func (pm portMetrics) dialFailed(err error) {
+	dialFailures.With(pm.route, pm.port, dialFailureReason(err)).Inc()
+}
+
+// Count connection closed by timeout
+func (pm portMetrics) timedOut(reason string) {
+	connTimedOut.With(pm.route, pm.port, reason).Inc()
+}
+
+// Count relayed connection as active, returned func must be called once relaying is done
+func (pm portMetrics) relaying() func() {
+	active := connActive.With(pm.route, pm.port)
+
+	active.Inc()
+
+	started := time.Now()
+
+	return func() {
+		active.Dec()
+
+		connDuration.With(pm.route, pm.port).Observe(time.Since(started).Seconds())
+	}
+}
+
+// Gauge of connections waiting for free slot
+func (pm portMetrics) queued() *metrics.Gauge {
+	return connQueued.With(pm.route, pm.port)
+}
+
+// Counter of bytes relayed in direction
+func (pm portMetrics) bytes(direction string) *metrics.Counter {
+	return bytesRelayed.With(pm.route, pm.port, direction)
+}
+
+// Classify error of connection limiter
+func limitRejectReason(err error) string {
+	if errors.Is(err, ErrQueueTimeout) {
+		return rejectQueue
+	}
+
+	return rejectLimit
+}
+
+// Classify error of accept limiter
+func acceptRejectReason(err error) string {
+	if errors.Is(err, ErrBanned) {
+		return rejectBanned
+	}
+
+	return rejectRate
+}
+
+// Classify error of host router
+func hostRejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownHost):
+		return rejectHost
+	case errors.Is(err, ErrHTTPRequest):
+		return rejectRequest
+	}
+
+	return rejectHello
+}
+
+// Classify error of tunnel request
+func tunnelRejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTunnelAuth):
+		return rejectAuth
+	case errors.Is(err, ErrDestination):
+		return rejectDest
+	}
+
+	return rejectTunnel
+}
+
+// Classify dial error
+func dialFailureReason(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, ErrRemoteTLS):
+		return dialFailTLS
+	case errors.As(err, &dnsErr):
+		return dialFailUnresolved
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialFailRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return dialFailTimeout
+	}
+
+	return dialFailOther
+}
+
+// Serve metrics and ban list over http until ctx is done
+func serveMetrics(ctx context.Context, cfg config.Metrics, bans *banList, wg *sync.WaitGroup) error {
+	addr := cfg.Address.String()
+
+	log.Printf("metrics: start listening on addr=%s path=%s\n", addr, cfg.Path)
+
+	lc := &net.ListenConfig{}
+
+	listener, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		log.Printf("metrics: failed to listen addr=%s, err=%s\n", addr, err)
+		return errors.Join(ErrListenAddr, err)
+	}
+
+	mux := http.NewServeMux()
+
+	mux.Handle(cfg.Path, registry)
+
+	if cfg.Path != bansPath {
+		mux.Handle(bansPath, bansHandler(bans, cfg.AdminToken))
+	}
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+
+		log.Printf("metrics: close listener addr=%s\n", addr)
+
+		server.Close()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("metrics: failed to serve addr=%s err=%s\n", addr, err)
+		}
+	}()
+
+	return nil
+}
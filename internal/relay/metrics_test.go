@@ -0,0 +1,171 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"errors"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Routes along with metrics endpoint
+type metricsConfig struct {
+	routesConfig
+	metrics config.Metrics
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	t.Parallel()
+
+	const remoteAddress = "127.0.0.1:53401"
+
+	echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+	defer echo.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	rly := New(ctx)
+
+	cfg := metricsConfig{
+		routesConfig: routesConfig{testRoute("metrics-ok", 53400, 53401), testRoute("metrics-refused", 53402, 53403)},
+		metrics:      config.Metrics{Address: netip.MustParseAddrPort("127.0.0.1:53409"), Path: config.DefaultMetricsPath},
+	}
+
+	rly.Apply(cfg)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:53400")
+	if assert.NoError(t, err) {
+		assertEcho(t, conn, "ping")
+
+		conn.Close()
+	}
+
+	conn, err = net.Dial("tcp", "127.0.0.1:53402")
+	if assert.NoError(t, err) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		conn.Read(make([]byte, 1))
+
+		conn.Close()
+	}
+
+	// let handlers complete
+	time.Sleep(200 * time.Millisecond)
+
+	body := getMetrics(t, "http://127.0.0.1:53409/metrics")
+
+	assert.Contains(t, body, `grelay_connections_accepted_total{route="metrics-ok",port="53400:53401/tcp"} 1`+"\n")
+	assert.Contains(t, body, `grelay_connections_active{route="metrics-ok",port="53400:53401/tcp"} 0`+"\n")
+	assert.Contains(t, body, `grelay_relayed_bytes_total{route="metrics-ok",port="53400:53401/tcp",direction="upload"} 4`+"\n")
+	assert.Contains(t, body, `grelay_relayed_bytes_total{route="metrics-ok",port="53400:53401/tcp",direction="download"} 4`+"\n")
+	assert.Contains(t, body, `grelay_connection_duration_seconds_count{route="metrics-ok",port="53400:53401/tcp"} 1`+"\n")
+	assert.Contains(t, body, `grelay_connections_accepted_total{route="metrics-refused",port="53402:53403/tcp"} 1`+"\n")
+	assert.Contains(t, body, `grelay_dial_failures_total{route="metrics-refused",port="53402:53403/tcp",reason="refused"} 1`+"\n")
+
+	// ban list is served along with metrics
+	assert.Empty(t, getMetrics(t, "http://127.0.0.1:53409/bans"))
+
+	// endpoint is stopped once it is removed from config
+	rly.Apply(cfg.routesConfig)
+
+	_, err = http.Get("http://127.0.0.1:53409/metrics")
+	assert.Error(t, err)
+
+	cancel()
+
+	rly.Wait()
+}
+
+func TestDialFailureReason(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		err    error
+		reason string
+	}{
+		"refused": {
+			err:    errors.Join(ErrRemoteConn, &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}),
+			reason: dialFailRefused,
+		},
+		"timeout": {
+			err:    errors.Join(ErrRemoteConn, &net.OpError{Op: "dial", Err: context.DeadlineExceeded}),
+			reason: dialFailTimeout,
+		},
+		"unresolved": {
+			err:    errors.Join(ErrRemoteConn, &net.DNSError{Err: "no such host", Name: "db.vpn", IsNotFound: true}),
+			reason: dialFailUnresolved,
+		},
+		"other": {
+			err:    errors.Join(ErrRemoteConn, errors.New("network is unreachable")),
+			reason: dialFailOther,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.EqualValues(t, test.reason, dialFailureReason(test.err))
+		})
+	}
+}
+
+func (cfg metricsConfig) Metrics() config.Metrics {
+	return cfg.metrics
+}
+
+func (cfg metricsConfig) Limits() config.Limits {
+	return config.Limits{}
+}
+
+func (cfg metricsConfig) Bandwidth() config.Bandwidth {
+	return config.Bandwidth{}
+}
+
+// Fetch metrics endpoint and return body
+func getMetrics(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+
+	defer resp.Body.Close()
+
+	assert.EqualValues(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	return string(body)
+}
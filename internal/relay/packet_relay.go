@@ -24,12 +24,20 @@
 package relay
 
 import (
+	"errors"
+	"grelay/internal/metrics"
 	"io"
 	"log"
+	"net"
+	"os"
+	"sync"
 )
 
 const defaultBufferSize = 4096
 
+// Max bytes spliced at once, relayed bytes are counted after every chunk
+const spliceChunkSize = 1 << 20
+
 // Buffer channel
 type bufChan = chan []byte
 
@@ -39,42 +47,129 @@ type roBufChan = <-chan []byte
 // WO onlu channel
 type woBufChan = chan<- []byte
 
-func connToChanRelay(conn io.Reader, ch woBufChan, raddr string) {
+// Pool of relay buffers, buffer is taken by connToChanRelay and returned by chanToConnRelay
+var bufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, defaultBufferSize)
+		return &buf
+	},
+}
+
+// Read conn to ch until EOF, read error is returned
+func connToChanRelay(conn io.Reader, ch woBufChan, raddr string, watch *connWatch) error {
 	log.Printf("pkt_relay: start conn(%s) ---> chan packets realy\n", raddr)
 
 	for {
-		// TODO: rework with pool
-		buf := make([]byte, defaultBufferSize)
+		buf := *bufPool.Get().(*[]byte)
 
 		read, err := conn.Read(buf)
 		if err != nil {
+			putBuffer(buf)
+
 			if err != io.EOF {
 				log.Printf("pkt_relay: conn(%s) err=%s faield to read from net", raddr, err)
-				return
+				return err
 			}
 
 			log.Printf("pkt_relay: conn(%s)->chan done relaying by EOF", raddr)
 
-			return
+			return nil
+		}
+
+		if read > 0 {
+			watch.touch()
 		}
 
 		ch <- buf[0:read]
 	}
 }
 
-func chanToConnRelay(conn io.Writer, ch roBufChan, raddr string) {
+// Write buffers from ch to conn until ch is closed, write error is returned.
+// Every write waits for tokens of limit.
+func chanToConnRelay(conn io.Writer, ch roBufChan, raddr string, written *metrics.Counter, limit rateLimit, watch *connWatch) error {
 	log.Printf("pkt_relay: start chan ---> %s packets realy\n", raddr)
 
 	for {
 		buf, ok := <-ch
 		if !ok {
 			log.Printf("pkt_relay: chan->conn(%s) complete relaying\n", raddr)
-			return
+			return nil
+		}
+
+		limit.wait(len(buf))
+
+		if err := watch.setWriteDeadline(conn); err != nil {
+			putBuffer(buf)
+			return err
 		}
 
-		if _, err := conn.Write(buf); err != nil {
+		n, err := conn.Write(buf)
+
+		putBuffer(buf)
+
+		written.Add(uint64(n))
+
+		if err != nil {
 			log.Printf("pkt_relay: chan->conn(%s) fail to relay err=%s\n", raddr, err)
-			return
+			return err
+		}
+	}
+}
+
+// Copy src to dst until EOF or error, error is returned.
+// Kernel splices data between sockets without copying it to user space on linux.
+// Reading is interrupted by deadline to report activity to watch.
+// Chunks are shrunk to burst of limit and every chunk waits for tokens of limit.
+func spliceRelay(dst, src *net.TCPConn, raddr string, written *metrics.Counter, limit rateLimit, watch *connWatch) error {
+	log.Printf("pkt_relay: start splice ---> %s packets realy\n", raddr)
+
+	chunk := int64(spliceChunkSize)
+
+	if burst := limit.chunk(); burst > 0 {
+		chunk = min(chunk, burst)
+	}
+
+	for {
+		if watch != nil {
+			if err := src.SetReadDeadline(watch.readDeadline()); err != nil {
+				return err
+			}
+		}
+
+		// src is wrapped by io.LimitedReader which is still spliced
+		n, err := io.CopyN(dst, src, chunk)
+
+		written.Add(uint64(n))
+
+		limit.wait(int(n))
+
+		if n > 0 {
+			watch.touch()
+		}
+
+		if watch != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+
+		if err == io.EOF {
+			log.Printf("pkt_relay: splice->conn(%s) done relaying by EOF\n", raddr)
+			return nil
+		}
+
+		if err != nil {
+			log.Printf("pkt_relay: splice->conn(%s) fail to relay err=%s\n", raddr, err)
+			return err
 		}
 	}
 }
+
+// Return buffer taken from pool, foreign buffers are dropped
+func putBuffer(buf []byte) {
+	if cap(buf) != defaultBufferSize {
+		return
+	}
+
+	buf = buf[:cap(buf)]
+
+	bufPool.Put(&buf)
+}
@@ -24,8 +24,12 @@
 package relay
 
 import (
+	"bytes"
 	"errors"
+	"grelay/internal/config"
+	"grelay/internal/metrics"
 	"io"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -46,7 +50,7 @@ func TestChanToConnReleay(t *testing.T) {
 
 		ch, cm := make(chan []byte, 1), &rmMock{}
 
-		go chanToConnRelay(cm, ch, mockRemoteAddr)
+		go chanToConnRelay(cm, ch, mockRemoteAddr, nil, nil, nil)
 
 		close(ch)
 	})
@@ -56,7 +60,7 @@ func TestChanToConnReleay(t *testing.T) {
 
 		ch, cm := make(chan []byte), &rmMock{}
 
-		go chanToConnRelay(cm, ch, mockRemoteAddr)
+		go chanToConnRelay(cm, ch, mockRemoteAddr, nil, nil, nil)
 
 		ch <- make([]byte, 10)
 
@@ -70,7 +74,7 @@ func TestChanToConnReleay(t *testing.T) {
 
 		ch, cm := make(chan []byte), &connMock{write: func(_ int) (n int, err error) { return 0, errors.New("error") }}
 
-		go chanToConnRelay(cm, ch, mockRemoteAddr)
+		go chanToConnRelay(cm, ch, mockRemoteAddr, nil, nil, nil)
 
 		ch <- make([]byte, 10)
 
@@ -96,7 +100,7 @@ func TestConnToChanReleay(t *testing.T) {
 			},
 		}
 
-		connToChanRelay(cm, ch, mockRemoteAddr)
+		connToChanRelay(cm, ch, mockRemoteAddr, nil)
 
 		data, ok := <-ch
 
@@ -111,7 +115,7 @@ func TestConnToChanReleay(t *testing.T) {
 
 		ch, cm := make(chan []byte, 1), &connMock{read: func(_ int) (n int, err error) { return 0, errors.New("error") }}
 
-		connToChanRelay(cm, ch, mockRemoteAddr)
+		connToChanRelay(cm, ch, mockRemoteAddr, nil)
 
 		assert.EqualValues(t, 1, cm.readCnt)
 	})
@@ -120,7 +124,148 @@ func TestConnToChanReleay(t *testing.T) {
 func TestMakeReleay(t *testing.T) {
 	t.Parallel()
 
-	assert.NotNil(t, newPacketRelay().wg)
+	assert.NotNil(t, newPacketRelay(newResolver(config.Resolver{})).wg)
+}
+
+func TestSpliceRelay(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success_copy_until_EOF", func(t *testing.T) {
+		t.Parallel()
+
+		client, src := tcpPair(t)
+		defer client.Close()
+		defer src.Close()
+
+		dst, server := tcpPair(t)
+		defer dst.Close()
+		defer server.Close()
+
+		payload := bytes.Repeat([]byte("grelay"), spliceChunkSize/3)
+
+		go func() {
+			client.Write(payload)
+			client.Close()
+		}()
+
+		written := &metrics.Counter{}
+
+		done := make(chan []byte)
+
+		go func() {
+			data, _ := io.ReadAll(server)
+			done <- data
+		}()
+
+		spliceRelay(dst.(*net.TCPConn), src.(*net.TCPConn), mockRemoteAddr, written, nil, nil)
+
+		dst.Close()
+
+		assert.EqualValues(t, payload, <-done)
+		assert.EqualValues(t, len(payload), written.Value())
+	})
+}
+
+func TestBufferPool(t *testing.T) {
+	t.Parallel()
+
+	ch := make(chan []byte, 1)
+	cm := &connMock{
+		read: func(cnt int) (n int, err error) {
+			if cnt > 1 {
+				return 0, io.EOF
+			}
+			return 5, nil
+		},
+	}
+
+	connToChanRelay(cm, ch, mockRemoteAddr, nil)
+
+	buf := <-ch
+
+	assert.EqualValues(t, 5, len(buf))
+	assert.EqualValues(t, defaultBufferSize, cap(buf))
+
+	// foreign buffer is not pooled
+	assert.NotPanics(t, func() { putBuffer(make([]byte, 10)) })
+
+	putBuffer(buf)
+}
+
+// Compare spliced tcp relay with channel pipeline used for non tcp connections
+func BenchmarkRelay(b *testing.B) {
+	b.Run("Splice", func(b *testing.B) {
+		benchmarkRelay(b, func(conn net.Conn) io.ReadWriteCloser { return conn })
+	})
+
+	b.Run("Channel", func(b *testing.B) {
+		benchmarkRelay(b, func(conn net.Conn) io.ReadWriteCloser { return struct{ io.ReadWriteCloser }{conn} })
+	})
+}
+
+// Relay 1 MiB per iteration from client to server over loopback, wrap hides type of relayed connections
+func benchmarkRelay(b *testing.B, wrap func(net.Conn) io.ReadWriteCloser) {
+	client, in := tcpPair(b)
+	out, server := tcpPair(b)
+
+	pry := newPacketRelay(newResolver(config.Resolver{}))
+
+	done := make(chan struct{})
+
+	go func() {
+		pry.realyPackets(wrap(in), "in", wrap(out), "out")
+		close(done)
+	}()
+
+	payload, buf := make([]byte, 1<<20), make([]byte, 1<<20)
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(server, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+
+	// relay is finished once both directions are done
+	client.Close()
+	server.Close()
+
+	<-done
+}
+
+// Create connected pair of tcp connections over loopback
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dialed, accepted
 }
 
 // Mockup io.ReaderWriteCloser
@@ -0,0 +1,393 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signatures of proxy protocol headers
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Commands and address families of proxy protocol v2
+const (
+	proxyV2Local  = 0x20
+	proxyV2Proxy  = 0x21
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+	proxyV2Unspec = 0x00
+	// Families of high nibble, low one is transport
+	proxyV2Inet  = 0x1
+	proxyV2Inet6 = 0x2
+)
+
+// Max size of proxy protocol v1 header including CRLF
+const maxProxyV1Size = 107
+
+// Client has not sent header
+var errNoProxyHeader = fmt.Errorf("%w: no header", ErrProxyHeader)
+
+// Listener of clients which could start with proxy protocol header
+type proxyListener struct {
+	net.Listener
+	cfg config.ProxyProtocol
+}
+
+// Connection of client which could start with proxy protocol header, addresses carried by header are reported once it is received
+type proxyConn struct {
+	net.Conn
+	cfg    config.ProxyProtocol
+	reader *bufio.Reader
+	// Addresses carried by header, peer ones are reported if invalid
+	src netip.AddrPort
+	dst netip.AddrPort
+}
+
+// Wrap listener to receive proxy protocol header of accepted clients
+func newProxyListener(listener net.Listener, cfg config.ProxyProtocol) net.Listener {
+	return &proxyListener{Listener: listener, cfg: cfg}
+}
+
+// Accept client, header is received later by handler of client so slow client does not block accepting
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return newProxyConn(conn, pl.cfg), nil
+}
+
+// Wrap connection to receive proxy protocol header
+func newProxyConn(conn net.Conn, cfg config.ProxyProtocol) *proxyConn {
+	return &proxyConn{Conn: conn, cfg: cfg, reader: bufio.NewReader(conn)}
+}
+
+// Receive header within timeout, client without header is fine in optional mode.
+// Headers are honoured from trusted peers only, other peers sending header are rejected as it could be forged.
+func (pc *proxyConn) receive() error {
+	optional := pc.cfg.Accept == config.ProxyAcceptOptional
+
+	peer := clientAddr(pc.Conn.RemoteAddr())
+
+	trusted := slices.ContainsFunc(pc.cfg.Trusted, func(prefix netip.Prefix) bool { return prefix.Contains(peer) })
+
+	if !trusted && !optional {
+		return fmt.Errorf("%w: peer %s is not trusted", ErrProxyHeader, peer)
+	}
+
+	pc.Conn.SetReadDeadline(time.Now().Add(pc.cfg.Timeout))
+	defer pc.Conn.SetReadDeadline(time.Time{})
+
+	src, dst, err := readProxyHeader(pc.reader)
+
+	// client which waits for server to speak first has sent nothing
+	silent := errors.Is(err, os.ErrDeadlineExceeded) && pc.reader.Buffered() == 0
+
+	if optional && (errors.Is(err, errNoProxyHeader) || silent) {
+		return nil
+	}
+
+	if !trusted {
+		return fmt.Errorf("%w: header from not trusted peer %s", ErrProxyHeader, peer)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	pc.src, pc.dst = src, dst
+
+	return nil
+}
+
+// Read data following header
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.reader.Read(b)
+}
+
+// Half-close underlying connection
+func (pc *proxyConn) CloseWrite() error {
+	return closeWrite(pc.Conn)
+}
+
+// Client address carried by header or peer one
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	if pc.src.IsValid() {
+		return net.TCPAddrFromAddrPort(pc.src)
+	}
+
+	return pc.Conn.RemoteAddr()
+}
+
+// Local address client has connected to carried by header or own one
+func (pc *proxyConn) LocalAddr() net.Addr {
+	if pc.dst.IsValid() {
+		return net.TCPAddrFromAddrPort(pc.dst)
+	}
+
+	return pc.Conn.LocalAddr()
+}
+
+// Receive proxy protocol header of client if listener expects it, tls of client follows header
+func receiveProxyHeader(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if pc, ok := conn.(*proxyConn); ok {
+		return pc.receive()
+	}
+
+	return nil
+}
+
+// Underlying connection of client once nothing is left buffered after header, so it could be spliced
+func unwrapProxyConn(conn net.Conn) net.Conn {
+	if pc, ok := conn.(*proxyConn); ok && pc.reader.Buffered() == 0 {
+		return pc.Conn
+	}
+
+	return conn
+}
+
+// Read proxy protocol header of any version, addresses are invalid if header describes unknown or local connection
+func readProxyHeader(r *bufio.Reader) (netip.AddrPort, netip.AddrPort, error) {
+	version, err := detectProxyVersion(r)
+	if err != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, err
+	}
+
+	if version == config.ProxyProtocolV1 {
+		return readProxyV1(r)
+	}
+
+	return readProxyV2(r)
+}
+
+// Detect version of header without consuming it, bytes are peeked only while they match any signature
+func detectProxyVersion(r *bufio.Reader) (int, error) {
+	for n := 1; ; n++ {
+		data, err := r.Peek(n)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+		}
+
+		v1 := n <= len(proxyV1Signature) && bytes.Equal(data, proxyV1Signature[:n])
+		v2 := n <= len(proxyV2Signature) && bytes.Equal(data, proxyV2Signature[:n])
+
+		switch {
+		case v1 && n == len(proxyV1Signature):
+			return config.ProxyProtocolV1, nil
+		case v2 && n == len(proxyV2Signature):
+			return config.ProxyProtocolV2, nil
+		case !v1 && !v2:
+			return 0, errNoProxyHeader
+		}
+	}
+}
+
+// Read text header e.g. PROXY TCP4 10.0.0.1 192.168.0.42 51000 443
+func readProxyV1(r *bufio.Reader) (netip.AddrPort, netip.AddrPort, error) {
+	line := make([]byte, 0, maxProxyV1Size)
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1Size {
+			return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: v1 header exceeds %d bytes", ErrProxyHeader, maxProxyV1Size)
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+		}
+
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	// rest of unknown connection is ignored
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, netip.AddrPort{}, nil
+	}
+
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: malformed v1 header %q", ErrProxyHeader, line)
+	}
+
+	src, err1 := parseProxyAddr(fields[2], fields[4], fields[1] == "TCP4")
+	dst, err2 := parseProxyAddr(fields[3], fields[5], fields[1] == "TCP4")
+
+	if err1 != nil || err2 != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: malformed v1 addresses %q", ErrProxyHeader, line)
+	}
+
+	return src, dst, nil
+}
+
+// Parse address of v1 header of family
+func parseProxyAddr(ip, port string, is4 bool) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	if addr.Is4() != is4 || addr.Zone() != "" {
+		return netip.AddrPort{}, ErrProxyHeader
+	}
+
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	return netip.AddrPortFrom(addr, uint16(number)), nil
+}
+
+// Read binary header, tlvs following addresses are skipped
+func readProxyV2(r *bufio.Reader) (netip.AddrPort, netip.AddrPort, error) {
+	head := make([]byte, len(proxyV2Signature)+4)
+
+	if _, err := io.ReadFull(r, head); err != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	command, family := head[12], head[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	switch command {
+	case proxyV2Local:
+		return netip.AddrPort{}, netip.AddrPort{}, nil
+	case proxyV2Proxy:
+	default:
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: not supported v2 command %#x", ErrProxyHeader, command)
+	}
+
+	size := 0
+
+	switch family >> 4 {
+	case proxyV2Inet:
+		size = 4
+	case proxyV2Inet6:
+		size = 16
+	default:
+		// unix and unspecified addresses are not ip ones
+		return netip.AddrPort{}, netip.AddrPort{}, nil
+	}
+
+	if len(body) < 2*size+4 {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: v2 addresses exceed %d bytes", ErrProxyHeader, len(body))
+	}
+
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+
+	src := netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(body[2*size:]))
+	dst := netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(body[2*size+2:]))
+
+	return src, dst, nil
+}
+
+// Build proxy protocol header of version describing tcp connection from src to dst.
+// Addresses of mixed families are sent as ipv6, invalid ones are sent as unknown connection.
+func proxyHeader(version int, src, dst netip.AddrPort) []byte {
+	src, dst = unmapAddrPort(src), unmapAddrPort(dst)
+
+	known := src.IsValid() && dst.IsValid()
+
+	if known && src.Addr().Is4() != dst.Addr().Is4() {
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+
+	if version == config.ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+
+		family := "TCP4"
+		if src.Addr().Is6() {
+			family = "TCP6"
+		}
+
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+
+	switch {
+	case !known:
+		header = append(header, proxyV2Local, proxyV2Unspec, 0, 0)
+	default:
+		family, size := byte(proxyV2TCP4), uint16(12)
+		if src.Addr().Is6() {
+			family, size = proxyV2TCP6, 36
+		}
+
+		header = append(header, proxyV2Proxy, family)
+		header = binary.BigEndian.AppendUint16(header, size)
+		header = append(header, src.Addr().AsSlice()...)
+		header = append(header, dst.Addr().AsSlice()...)
+		header = binary.BigEndian.AppendUint16(header, src.Port())
+		header = binary.BigEndian.AppendUint16(header, dst.Port())
+	}
+
+	return header
+}
+
+// Get ip address and port of tcp peer, it is invalid for other peers
+func tcpAddrPort(addr net.Addr) netip.AddrPort {
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		return addr.AddrPort()
+	}
+
+	return netip.AddrPort{}
+}
+
+// Unmap ipv4 address of ipv6 socket
+func unmapAddrPort(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
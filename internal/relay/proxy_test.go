@@ -0,0 +1,492 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	src4, dst4 := netip.MustParseAddrPort("10.0.0.1:51000"), netip.MustParseAddrPort("192.168.0.42:443")
+	src6, dst6 := netip.MustParseAddrPort("[fd00::1]:51000"), netip.MustParseAddrPort("[fd00::42]:443")
+
+	t.Run("V1", func(t *testing.T) {
+		t.Parallel()
+
+		tests := map[string]struct {
+			src, dst netip.AddrPort
+			header   string
+		}{
+			"tcp4":    {src: src4, dst: dst4, header: "PROXY TCP4 10.0.0.1 192.168.0.42 51000 443\r\n"},
+			"tcp6":    {src: src6, dst: dst6, header: "PROXY TCP6 fd00::1 fd00::42 51000 443\r\n"},
+			"mapped":  {src: netip.MustParseAddrPort("[::ffff:10.0.0.1]:51000"), dst: dst4, header: "PROXY TCP4 10.0.0.1 192.168.0.42 51000 443\r\n"},
+			"mixed":   {src: src4, dst: dst6, header: "PROXY TCP6 ::ffff:10.0.0.1 fd00::42 51000 443\r\n"},
+			"unknown": {src: netip.AddrPort{}, dst: dst4, header: "PROXY UNKNOWN\r\n"},
+		}
+
+		for name, test := range tests {
+			assert.EqualValues(t, test.header, string(proxyHeader(config.ProxyProtocolV1, test.src, test.dst)), name)
+		}
+	})
+
+	t.Run("V2", func(t *testing.T) {
+		t.Parallel()
+
+		header := proxyHeader(config.ProxyProtocolV2, src4, dst4)
+
+		expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12, 10, 0, 0, 1, 192, 168, 0, 42, 0xc7, 0x38, 0x01, 0xbb)
+
+		assert.EqualValues(t, expected, header)
+
+		header = proxyHeader(config.ProxyProtocolV2, src6, dst6)
+
+		assert.EqualValues(t, []byte{0x21, 0x21, 0, 36}, header[12:16])
+		assert.Len(t, header, 16+36)
+
+		header = proxyHeader(config.ProxyProtocolV2, netip.AddrPort{}, dst4)
+
+		assert.EqualValues(t, []byte{0x20, 0x00, 0, 0}, header[12:])
+	})
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	certs := newTestCerts(t)
+
+	certs.issue(t, "server", "server")
+
+	plain := runTCPServer(t, "127.0.0.1:24401", nil, serveProxyHeader(nil))
+	secure := runTCPServer(t, "127.0.0.1:24403", nil, serveProxyHeader(&tls.Config{Certificates: []tls.Certificate{certs.keyPair(t, "server")}}))
+
+	// parallel subtests complete after parent returns
+	t.Cleanup(func() {
+		plain.Close()
+		secure.Close()
+	})
+
+	tests := map[string]struct {
+		local     uint16
+		remote    uint16
+		version   int
+		remoteTLS config.RemoteTLS
+	}{
+		"Success_v1": {
+			local:   24400,
+			remote:  24401,
+			version: config.ProxyProtocolV1,
+		},
+		"Success_v2": {
+			local:   24402,
+			remote:  24401,
+			version: config.ProxyProtocolV2,
+		},
+		"Success_v2_before_tls": {
+			local:     24404,
+			remote:    24403,
+			version:   config.ProxyProtocolV2,
+			remoteTLS: config.RemoteTLS{Enabled: true, CAFile: filepath.Join(certs.dir, "ca.pem"), MinVersion: config.DefaultTLSMinVersion},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			route := testRoute(name, test.local, test.remote)
+			route.ProxyProtocol = config.ProxyProtocol{Send: test.version}
+			route.RemoteTLS = test.remoteTLS
+
+			stop := runRouteRelay(t, route)
+			defer stop()
+
+			conn, err := net.Dial("tcp", makeAddr(route.Local, test.local))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			defer conn.Close()
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			// backend sends back addresses of received header and then echoes
+			line, err := bufio.NewReader(conn).ReadString('\n')
+
+			assert.NoError(t, err)
+			assert.EqualValues(t, conn.LocalAddr().String()+" "+conn.RemoteAddr().String()+"\n", line)
+		})
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	v2 := func(command, family byte, body ...byte) string {
+		return string(append(append([]byte("\r\n\r\n\x00\r\nQUIT\n"), command, family, byte(len(body)>>8), byte(len(body))), body...))
+	}
+
+	tests := map[string]struct {
+		header string
+		src    string
+		dst    string
+		err    error
+	}{
+		"v1 tcp4":    {header: "PROXY TCP4 10.0.0.1 192.168.0.42 51000 443\r\n", src: "10.0.0.1:51000", dst: "192.168.0.42:443"},
+		"v1 tcp6":    {header: "PROXY TCP6 fd00::1 fd00::42 51000 443\r\n", src: "[fd00::1]:51000", dst: "[fd00::42]:443"},
+		"v1 unknown": {header: "PROXY UNKNOWN fd00::1 fd00::42 51000 443\r\n"},
+		"v2 tcp4": {
+			header: v2(0x21, 0x11, 10, 0, 0, 1, 192, 168, 0, 42, 0xc7, 0x38, 0x01, 0xbb),
+			src:    "10.0.0.1:51000",
+			dst:    "192.168.0.42:443",
+		},
+		"v2 tcp6 with tlv": {
+			header: v2(0x21, 0x21, append(append(netip.MustParseAddr("fd00::1").AsSlice(), netip.MustParseAddr("fd00::42").AsSlice()...), 0xc7, 0x38, 0x01, 0xbb, 0x04, 0, 1, 0)...),
+			src:    "[fd00::1]:51000",
+			dst:    "[fd00::42]:443",
+		},
+		"v2 udp4":              {header: v2(0x21, 0x12, 10, 0, 0, 1, 192, 168, 0, 42, 0xc7, 0x38, 0x01, 0xbb), src: "10.0.0.1:51000", dst: "192.168.0.42:443"},
+		"v2 local":             {header: v2(0x20, 0x00)},
+		"v2 unix":              {header: v2(0x21, 0x31, make([]byte, 216)...)},
+		"no header":            {header: "GET / HTTP/1.1\r\n\r\n", err: errNoProxyHeader},
+		"v1 too long":          {header: "PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", err: ErrProxyHeader},
+		"v1 missing port":      {header: "PROXY TCP4 10.0.0.1 192.168.0.42 51000\r\n", err: ErrProxyHeader},
+		"v1 family mismatch":   {header: "PROXY TCP4 fd00::1 192.168.0.42 51000 443\r\n", err: ErrProxyHeader},
+		"v1 port overflow":     {header: "PROXY TCP4 10.0.0.1 192.168.0.42 51000 65536\r\n", err: ErrProxyHeader},
+		"v1 incomplete":        {header: "PROXY TCP4 10.0.0.1", err: ErrProxyHeader},
+		"v2 unknown command":   {header: v2(0x22, 0x11, make([]byte, 12)...), err: ErrProxyHeader},
+		"v2 short addresses":   {header: v2(0x21, 0x21, make([]byte, 12)...), err: ErrProxyHeader},
+		"v2 incomplete":        {header: v2(0x21, 0x11, make([]byte, 12)...)[:20], err: ErrProxyHeader},
+		"signature incomplete": {header: "\r\n\r\n", err: ErrProxyHeader},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			r := bufio.NewReader(strings.NewReader(test.header + "data"))
+
+			src, dst, err := readProxyHeader(r)
+
+			assert.ErrorIs(t, err, test.err)
+
+			if test.err != nil {
+				return
+			}
+
+			if test.src != "" {
+				assert.EqualValues(t, test.src, src.String())
+				assert.EqualValues(t, test.dst, dst.String())
+			} else {
+				assert.False(t, src.IsValid())
+				assert.False(t, dst.IsValid())
+			}
+
+			// data following header is left unread
+			rest, _ := io.ReadAll(r)
+			assert.EqualValues(t, "data", string(rest))
+		})
+	}
+
+	t.Run("Round_trip", func(t *testing.T) {
+		t.Parallel()
+
+		for _, version := range []int{config.ProxyProtocolV1, config.ProxyProtocolV2} {
+			for _, pair := range [][2]string{{"10.0.0.1:51000", "192.168.0.42:443"}, {"[fd00::1]:51000", "[fd00::42]:443"}} {
+				header := proxyHeader(version, netip.MustParseAddrPort(pair[0]), netip.MustParseAddrPort(pair[1]))
+
+				src, dst, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header)))
+
+				assert.NoError(t, err)
+				assert.EqualValues(t, pair[0], src.String())
+				assert.EqualValues(t, pair[1], dst.String())
+			}
+		}
+	})
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	certs := newTestCerts(t)
+
+	certs.issue(t, "server", "server")
+
+	backend := runTCPServer(t, "127.0.0.1:24411", nil, serveProxyHeader(nil))
+	echo := runTCPServer(t, "127.0.0.1:24412", nil, serveEcho)
+	identity := runTCPServer(t, "127.0.0.1:24413", nil, serveIdentity)
+
+	// parallel subtests complete after parent returns
+	t.Cleanup(func() {
+		backend.Close()
+		echo.Close()
+		identity.Close()
+	})
+
+	const header = "PROXY TCP4 10.1.2.3 127.0.0.1 51000 24410\r\n"
+
+	acceptRoute := func(name string, local, remote uint16, accept string) config.Route {
+		route := testRoute(name, local, remote)
+		route.ProxyProtocol = config.ProxyProtocol{Accept: accept, Timeout: 200 * time.Millisecond, Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+
+		return route
+	}
+
+	t.Run("Success_forwarded_client_address", func(t *testing.T) {
+		t.Parallel()
+
+		route := acceptRoute("proxy-forward", 24410, 24411, config.ProxyAcceptRequired)
+		route.ProxyProtocol.Send = config.ProxyProtocolV2
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24410")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		conn.Write([]byte(header))
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, "10.1.2.3:51000 127.0.0.1:24410\n", line)
+	})
+
+	t.Run("Success_relayed_after_header", func(t *testing.T) {
+		t.Parallel()
+
+		stop := runRouteRelay(t, acceptRoute("proxy-echo", 24414, 24412, config.ProxyAcceptRequired))
+		defer stop()
+
+		for _, request := range []string{"", "ping"} {
+			conn, err := net.Dial("tcp", "127.0.0.1:24414")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			// data sent along with header is buffered and relayed first
+			conn.Write([]byte(header + request))
+
+			if request != "" {
+				buf := make([]byte, len(request))
+
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+
+				_, err = io.ReadFull(conn, buf)
+
+				assert.NoError(t, err)
+				assert.EqualValues(t, request, string(buf))
+			}
+
+			assertEcho(t, conn, "pong")
+
+			conn.Close()
+		}
+	})
+
+	t.Run("Carried_client_denied_by_acl", func(t *testing.T) {
+		t.Parallel()
+
+		route := acceptRoute("proxy-acl", 24415, 24412, config.ProxyAcceptRequired)
+		route.ACL = config.ACL{Deny: []netip.Prefix{netip.MustParsePrefix("10.1.2.3/32")}}
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24415")
+		if assert.NoError(t, err) {
+			conn.Write([]byte(header))
+
+			assertClosed(t, conn, time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 1, connRejected.With(route.Name, route.Ports[0].String(), rejectACL).Value())
+
+		conn, err = net.Dial("tcp", "127.0.0.1:24415")
+		if assert.NoError(t, err) {
+			conn.Write([]byte("PROXY TCP4 10.1.2.4 127.0.0.1 51000 24415\r\n"))
+
+			assertEcho(t, conn, "ping")
+
+			conn.Close()
+		}
+	})
+
+	t.Run("Required_header_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		route := acceptRoute("proxy-required", 24416, 24412, config.ProxyAcceptRequired)
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		for _, request := range []string{"ping", "PROXY TCP4 10.1.2.3\r\n", ""} {
+			conn, err := net.Dial("tcp", "127.0.0.1:24416")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			// silent client is closed by timeout
+			conn.Write([]byte(request))
+
+			assertClosed(t, conn, time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 3, connRejected.With(route.Name, route.Ports[0].String(), rejectProxy).Value())
+	})
+
+	t.Run("Success_optional_header", func(t *testing.T) {
+		t.Parallel()
+
+		route := acceptRoute("proxy-optional", 24417, 24412, config.ProxyAcceptOptional)
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		for _, prefix := range []string{header, ""} {
+			conn, err := net.Dial("tcp", "127.0.0.1:24417")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			conn.Write([]byte(prefix))
+
+			assertEcho(t, conn, "ping")
+
+			conn.Close()
+		}
+	})
+
+	t.Run("Success_optional_silent_client", func(t *testing.T) {
+		t.Parallel()
+
+		stop := runRouteRelay(t, acceptRoute("proxy-silent", 24418, 24413, config.ProxyAcceptOptional))
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24418")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		// server speaks first once header timeout expires
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		response, err := io.ReadAll(conn)
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, "127.0.0.1:24413", string(response))
+	})
+
+	t.Run("Untrusted_peer", func(t *testing.T) {
+		t.Parallel()
+
+		for accept, port := range map[string]uint16{config.ProxyAcceptRequired: 24420, config.ProxyAcceptOptional: 24421} {
+			route := acceptRoute("proxy-untrusted-"+accept, port, 24412, accept)
+			route.ProxyProtocol.Trusted = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+			stop := runRouteRelay(t, route)
+			defer stop()
+
+			addr := makeAddr(netip.MustParseAddr("127.0.0.1"), port)
+
+			// forged header could not spoof address of client
+			conn, err := net.Dial("tcp", addr)
+			if assert.NoError(t, err) {
+				conn.Write([]byte(header))
+
+				assertClosed(t, conn, time.Second)
+
+				conn.Close()
+			}
+
+			assert.EqualValues(t, 1, connRejected.With(route.Name, route.Ports[0].String(), rejectProxy).Value(), accept)
+
+			if accept == config.ProxyAcceptRequired {
+				continue
+			}
+
+			// client without header is relayed with own address
+			conn, err = net.Dial("tcp", addr)
+			if assert.NoError(t, err) {
+				assertEcho(t, conn, "ping")
+
+				conn.Close()
+			}
+		}
+	})
+
+	t.Run("Success_header_before_tls", func(t *testing.T) {
+		t.Parallel()
+
+		route := acceptRoute("proxy-tls", 24419, 24411, config.ProxyAcceptRequired)
+		route.TLS = certs.serverTLS("server")
+		route.ProxyProtocol.Send = config.ProxyProtocolV1
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24419")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		conn.Write([]byte("PROXY TCP6 fd00::1 fd00::42 51000 443\r\n"))
+
+		tlsConn := tls.Client(conn, &tls.Config{RootCAs: certs.pool, ServerName: "server"})
+
+		tlsConn.SetReadDeadline(time.Now().Add(time.Second))
+
+		line, err := bufio.NewReader(tlsConn).ReadString('\n')
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, "[fd00::1]:51000 [fd00::42]:443\n", line)
+	})
+}
@@ -25,46 +25,77 @@ package relay
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"grelay/internal/config"
+	"grelay/internal/metrics"
 	"io"
 	"log"
 	"net"
 	"net/netip"
+	"os"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // Config interface
 type Config interface {
-	Local() netip.Addr
-	Remote() netip.Addr
-	Ports() []uint16
+	Routes() []config.Route
+	Resolver() config.Resolver
+	Metrics() config.Metrics
+	Limits() config.Limits
+	Bandwidth() config.Bandwidth
 }
 
 // Packet relay struct
 type packetRelay struct {
 	wg *sync.WaitGroup
+	// Resolver of remote host
+	resolver *resolver
+	// Metrics of relayed port
+	metrics portMetrics
+	// Dial policy of remotes
+	dial config.Dial
+	// Timeouts of relayed connections
+	timeouts connTimeouts
+	// Watch of relayed connection, set per connection
+	watch *connWatch
+	// Filter of client addresses
+	acl *acl
+	// Limiter of concurrent connections
+	limiter *connLimiter
+	// Limiter of new connections of single client
+	accept *acceptLimiter
+	// Router of clients by host name, all clients go to upstream of port if nil
+	hosts *hostRouter
+	// Tunnels of clients to destinations they ask for, all clients go to upstream of port if nil
+	tunnel *tunnel
+	// Idle timeout of destinations of udp associated socks5 clients
+	udpTimeout time.Duration
+	// Router of redirected clients to their original destinations, all clients go to upstream of port if nil
+	transparent *transparentRouter
+	// Version of proxy protocol header sent to remotes, nothing is sent if zero
+	sendProxy int
+	// Tls origination toward remotes, plaintext if nil
+	origin *tls.Config
+	// Bandwidth of single connection
+	bandwidth config.Bandwidth
+	// Bandwidth from client to remote, shared by connections
+	upload rateLimit
+	// Bandwidth from remote to client, shared by connections
+	download rateLimit
 }
 
-// Create and run relay on ports based on provided config
+// Create and run relay on every route based on provided config, blocks until ctx is done
 func Run(ctx context.Context, cfg Config) {
 	log.Printf("relay: run relay with config %s", cfg)
 
-	wg := sync.WaitGroup{}
+	rly := New(ctx)
 
-	for _, port := range cfg.Ports() {
-		pry := newPacketRelay()
+	rly.Apply(cfg)
 
-		local, remote := makeAddr(cfg.Local(), port), makeAddr(cfg.Remote(), port)
-
-		wg.Add(1)
-
-		go func() {
-			pry.runRelay(ctx, local, remote)
-
-			wg.Done()
-		}()
-	}
-
-	wg.Wait()
+	rly.Wait()
 
 	log.Println("relay: stop relay")
 }
@@ -72,76 +103,270 @@ func Run(ctx context.Context, cfg Config) {
 // Run single instance of packet relay.
 // Create listener for incoming traffic, make new tcp connection to raddr and do relay traffic between them.
 func (pry packetRelay) runRelay(ctx context.Context, local, remote string) {
-	log.Printf("pkt_relay: start relaying between address %s <-> %s\n", local, remote)
+	listener, err := bindConn(ctx, local)
+	if err != nil {
+		log.Printf("pkt_relay: failed to run relaying between address %s <-> %s err=%s\n", local, remote, err)
+		return
+	}
+
+	pry.serve(ctx, listener, local, newUpstream([]string{remote}, &roundRobinBalancer{}, config.HealthCheck{}))
+}
 
-	err := listenConn(ctx, local, func(ctx context.Context, inConn net.Conn) {
-		log.Printf("pkt_relay: prepare relaying to remote %s", remote)
+// Relay traffic of connections accepted by listener to one of upstream backends until ctx is done or listener is closed
+func (pry packetRelay) serve(ctx context.Context, listener net.Listener, local string, ups *upstream) {
+	log.Printf("pkt_relay: start relaying between address %s <-> %s\n", local, ups)
 
+	serveConn(ctx, listener, local, func(ctx context.Context, inConn net.Conn) {
 		defer inConn.Close()
 
-		outConn, err := newOutgoingConn(remote)
+		pry.metrics.accepted()
+
+		// client address carried by header is used from now on
+		if err := receiveProxyHeader(inConn); err != nil {
+			log.Printf("pkt_relay: reject client %s err=%s", inConn.RemoteAddr(), err)
+			pry.metrics.rejected(rejectProxy)
+			return
+		}
+
+		client := clientAddr(inConn.RemoteAddr())
+
+		if !pry.acl.permits(client) {
+			log.Printf("pkt_relay: deny client %s by acl", inConn.RemoteAddr())
+			pry.metrics.rejected(rejectACL)
+			return
+		}
+
+		if err := pry.accept.admit(client, time.Now()); err != nil {
+			log.Printf("pkt_relay: reject client %s err=%s", inConn.RemoteAddr(), err)
+			pry.metrics.rejected(acceptRejectReason(err))
+			return
+		}
+
+		if tlsConn, ok := inConn.(*tls.Conn); ok {
+			if err := handshake(ctx, tlsConn); err != nil {
+				log.Printf("pkt_relay: reject client %s by failed tls handshake err=%s", inConn.RemoteAddr(), err)
+				pry.metrics.rejected(rejectHandshake)
+				return
+			}
+		}
+
+		target, peeked := ups, []byte(nil)
+
+		if pry.hosts != nil {
+			var host string
+			var err error
+
+			if peeked, host, target, err = pry.hosts.route(inConn); err != nil {
+				log.Printf("pkt_relay: reject client %s err=%s", inConn.RemoteAddr(), err)
+				pry.metrics.rejected(hostRejectReason(err))
+				return
+			}
+
+			log.Printf("pkt_relay: route client %s by host %q to %s", inConn.RemoteAddr(), host, target)
+		}
+
+		var request *tunnelRequest
+
+		if pry.tunnel != nil {
+			var err error
+
+			if request, err = pry.tunnel.accept(inConn); err != nil {
+				log.Printf("pkt_relay: reject client %s err=%s", inConn.RemoteAddr(), err)
+				pry.metrics.rejected(tunnelRejectReason(err))
+				return
+			}
+
+			log.Printf("pkt_relay: tunnel client %s to %s", inConn.RemoteAddr(), request)
+
+			// bytes sent along with request are replayed as they are
+			peeked = request.buffered
+
+			// datagrams are checked one by one
+			if !request.udp {
+				if target, err = pry.tunnel.upstream(ctx, pry.resolver, pry.dial.Timeout, request); err != nil {
+					log.Printf("pkt_relay: reject client %s err=%s", inConn.RemoteAddr(), err)
+					request.reply(netip.AddrPort{}, err)
+
+					if errors.Is(err, ErrDestination) {
+						pry.metrics.rejected(rejectDest)
+					} else {
+						pry.metrics.dialFailed(err)
+					}
+
+					return
+				}
+			}
+		}
+
+		// destination of header is the one client has connected to, not listener
+		local := tcpAddrPort(inConn.LocalAddr())
+
+		if pry.transparent != nil {
+			dst, remote, err := pry.transparent.route(inConn)
+			if err != nil {
+				log.Printf("pkt_relay: reject client %s err=%s", inConn.RemoteAddr(), err)
+				pry.metrics.rejected(rejectOrigDst)
+				return
+			}
+
+			log.Printf("pkt_relay: redirect client %s from %s to %s", inConn.RemoteAddr(), dst, remote)
+
+			local, target = dst, newUpstream([]string{remote}, &roundRobinBalancer{}, config.HealthCheck{})
+		}
+
+		free, err := pry.limiter.acquire(ctx, client, pry.metrics.queued())
 		if err != nil {
-			log.Printf("pkt_relay: failed to connect to remote %s err=%s", remote, err)
+			active, queued := pry.limiter.usage()
+			log.Printf("pkt_relay: reject client %s err=%s active=%d queued=%d", inConn.RemoteAddr(), err, active, queued)
+			pry.metrics.rejected(limitRejectReason(err))
+
+			if request != nil {
+				request.reply(netip.AddrPort{}, err)
+			}
+
 			return
 		}
 
+		defer free()
+
+		if request != nil && request.udp {
+			pry.associate(ctx, inConn, request)
+			return
+		}
+
+		var header []byte
+
+		if pry.sendProxy != 0 {
+			header = proxyHeader(pry.sendProxy, tcpAddrPort(inConn.RemoteAddr()), local)
+		}
+
+		outConn, release, err := pry.connect(ctx, target, client, header)
+
+		if request != nil {
+			var bound netip.AddrPort
+
+			if err == nil {
+				bound = tcpAddrPort(outConn.LocalAddr())
+			}
+
+			// relaying starts once client knows destination is connected
+			if rerr := request.reply(bound, err); rerr != nil && err == nil {
+				log.Printf("pkt_relay: failed to reply client %s err=%s", inConn.RemoteAddr(), rerr)
+				outConn.Close()
+				release()
+				return
+			}
+		}
+
+		if errors.Is(err, ErrNoBackend) {
+			log.Printf("pkt_relay: reject client %s err=%s", inConn.RemoteAddr(), err)
+			pry.metrics.rejected(rejectNoBackend)
+			return
+		}
+
+		if err != nil {
+			log.Printf("pkt_relay: failed to connect client %s to %s err=%s", inConn.RemoteAddr(), target, err)
+			return
+		}
+
+		defer release()
+
+		remote := outConn.RemoteAddr().String()
+
 		defer outConn.Close()
 
+		// bytes read to route client are replayed as they are
+		if len(peeked) != 0 {
+			if _, err := outConn.Write(peeked); err != nil {
+				log.Printf("pkt_relay: failed to replay first bytes of client %s to %s err=%s", inConn.RemoteAddr(), remote, err)
+				return
+			}
+
+			pry.metrics.bytes(directionUpload).Add(uint64(len(peeked)))
+		}
+
+		defer pry.metrics.relaying()()
+
+		// every connection waits for own relay routines only
+		cry := pry
+		cry.wg = &sync.WaitGroup{}
+		cry.watch = newConnWatch(pry.timeouts)
+		cry.upload = pry.upload.withConn(pry.bandwidth.ConnUpload)
+		cry.download = pry.download.withConn(pry.bandwidth.ConnDownload)
+
 		wg := &sync.WaitGroup{}
 
 		lctx, cancel := context.WithCancel(ctx)
 
 		wg.Add(1)
 		go func() {
-			<-lctx.Done()
+			if reason := cry.watch.wait(lctx); reason != "" {
+				log.Printf("pkt_relay: close %s <-> %s by %s", inConn.RemoteAddr(), remote, reason)
+				pry.metrics.timedOut(reason)
+			}
 
-			defer inConn.Close()
+			inConn.Close()
 
-			defer outConn.Close()
+			outConn.Close()
 
 			wg.Done()
 		}()
 
-		pry.realyPackets(inConn, inConn.RemoteAddr().String(), outConn, outConn.RemoteAddr().String())
+		cry.realyPackets(unwrapProxyConn(inConn), inConn.RemoteAddr().String(), outConn, outConn.RemoteAddr().String())
 
 		cancel()
 
 		wg.Wait()
 	})
 
-	if err != nil {
-		log.Printf("pkt_relay: failed to run relaying between address %s <-> %s err=%s\n", local, remote, err)
-		return
-	}
-
-	log.Printf("pkt_relay: stop relaying between address %s <-> %s\n", local, remote)
+	log.Printf("pkt_relay: stop relaying between address %s <-> %s\n", local, ups)
 }
 
-// Bind incoming and outgoing connection via channels
+// Bind incoming and outgoing connection, tcp connections are spliced and others are bound via channels
 func (pry packetRelay) realyPackets(in io.ReadWriteCloser, inRAddr string, out io.ReadWriteCloser, outRAddr string) {
 	log.Printf("pkt_relay: relaying packets %s <-> %s", inRAddr, outRAddr)
 
+	inTCP, inOk := in.(*net.TCPConn)
+	outTCP, outOk := out.(*net.TCPConn)
+
+	// writes are spliced by kernel, so write timeout could be enforced by buffered relay only
+	if inOk && outOk && pry.timeouts.write == 0 {
+		pry.splice(inTCP, inRAddr, outTCP, outRAddr)
+
+		log.Printf("pkt_relay: finish relaying packets %s <-> %s", inRAddr, outRAddr)
+
+		return
+	}
+
 	ich, och := make(bufChan, 1), make(bufChan, 1)
 
 	// run in -> och
 	//     in <- ich
-	pry.relay(in, inRAddr, ich, och)
+	pry.relay(in, out, inRAddr, ich, och, pry.metrics.bytes(directionDownload), pry.download)
 
 	// run out -> och
 	//     out <- ich
-	pry.relay(out, outRAddr, och, ich)
+	pry.relay(out, in, outRAddr, och, ich, pry.metrics.bytes(directionUpload), pry.upload)
 
 	// wait for all 4 relay routines stops
 	pry.wg.Wait()
 
+	in.Close()
+
+	out.Close()
+
 	log.Printf("pkt_relay: finish relaying packets %s <-> %s", inRAddr, outRAddr)
 }
 
-// Relay traffic from conn to wch and rch to conn
-func (pry packetRelay) relay(conn io.ReadWriteCloser, raddr string, rch roBufChan, wch woBufChan) {
+// Relay traffic from conn to wch and rch to conn, bytes written to conn are added to written and limited by limit.
+// Once rch is closed conn is half-closed and reading from conn goes on until EOF, error closes both conn and its peer.
+func (pry packetRelay) relay(conn, peer io.ReadWriteCloser, raddr string, rch roBufChan, wch woBufChan, written *metrics.Counter, limit rateLimit) {
 	pry.wg.Add(1)
 	go func() {
-		connToChanRelay(conn, wch, raddr)
+		if err := connToChanRelay(conn, wch, raddr, pry.watch); err != nil {
+			conn.Close()
+			peer.Close()
+		}
 
 		log.Printf("pkt_relay: close conn(%s)->chan\n", raddr)
 
@@ -152,22 +377,94 @@ func (pry packetRelay) relay(conn io.ReadWriteCloser, raddr string, rch roBufCha
 
 	pry.wg.Add(1)
 	go func() {
-		chanToConnRelay(conn, rch, raddr)
+		if err := chanToConnRelay(conn, rch, raddr, written, limit, pry.watch); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("pkt_relay: close conn(%s) by %s\n", raddr, closeWriteTimeout)
+				pry.metrics.timedOut(closeWriteTimeout)
+			}
+
+			conn.Close()
+			peer.Close()
+
+			// unblock opposite reader until it is done
+			for buf := range rch {
+				putBuffer(buf)
+			}
+		} else if err := closeWrite(conn); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("pkt_relay: failed to close write side of conn(%s) err=%s\n", raddr, err)
+		}
 
 		log.Printf("pkt_relay: close chan->conn(%s)\n", raddr)
 
-		conn.Close()
-
 		pry.wg.Done()
 	}()
 }
 
+// Splice tcp connections in both directions.
+// EOF of one direction half-closes its destination, error closes both connections.
+func (pry packetRelay) splice(in *net.TCPConn, inRAddr string, out *net.TCPConn, outRAddr string) {
+	wg := &sync.WaitGroup{}
+
+	pipe := func(dst, src *net.TCPConn, raddr string, written *metrics.Counter, limit rateLimit) {
+		if err := spliceRelay(dst, src, raddr, written, limit, pry.watch); err != nil {
+			in.Close()
+			out.Close()
+			return
+		}
+
+		if err := dst.CloseWrite(); err != nil {
+			log.Printf("pkt_relay: failed to close write side of conn(%s) err=%s\n", raddr, err)
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		pipe(out, in, outRAddr, pry.metrics.bytes(directionUpload), pry.upload)
+
+		wg.Done()
+	}()
+
+	pipe(in, out, inRAddr, pry.metrics.bytes(directionDownload), pry.download)
+
+	wg.Wait()
+
+	in.Close()
+
+	out.Close()
+}
+
+// Half-close conn if it supports it, close it otherwise
+func closeWrite(conn io.Closer) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return conn.Close()
+}
+
 // Create new packets realy
-func newPacketRelay() packetRelay {
-	return packetRelay{wg: &sync.WaitGroup{}}
+func newPacketRelay(res *resolver) packetRelay {
+	return packetRelay{wg: &sync.WaitGroup{}, resolver: res, dial: config.Dial{Timeout: config.DefaultDialTimeout}}
 }
 
 // Make valid string address from addr + port
 func makeAddr(addr netip.Addr, port uint16) string {
 	return netip.AddrPortFrom(addr, port).String()
 }
+
+// Get ip address of tcp or udp peer
+func clientAddr(addr net.Addr) netip.Addr {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.AddrPort().Addr().Unmap()
+	case *net.UDPAddr:
+		return addr.AddrPort().Addr().Unmap()
+	}
+
+	return netip.Addr{}
+}
+
+// Make valid string address from host name or ip address + port
+func makeHostAddr(host string, port uint16) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
@@ -25,6 +25,7 @@ package relay
 
 import (
 	"context"
+	"grelay/internal/config"
 	"io"
 	"math/rand"
 	"net"
@@ -39,6 +40,8 @@ import (
 type mockConfig struct{}
 
 type connMock struct {
+	// Guards counters and closed, relay reads, writes and closes conn concurrently
+	mu       sync.Mutex
 	readCnt  int
 	writeCnt int
 	read     func(int) (n int, err error)
@@ -71,10 +74,25 @@ func TestReleay(t *testing.T) {
 			return 5, nil
 		}
 
-		in := &connMock{read: mockFunc, write: mockFunc}
-		out := &connMock{read: mockFunc, write: mockFunc}
+		// in is not drained until out is read, otherwise out could be closed before it is read at all
+		outRead, once := make(chan struct{}), &sync.Once{}
 
-		rel := newPacketRelay()
+		inRead := func(cnt int) (n int, err error) {
+			if cnt > 1000 {
+				<-outRead
+			}
+			return mockFunc(cnt)
+		}
+
+		outReadOnce := func(cnt int) (n int, err error) {
+			once.Do(func() { close(outRead) })
+			return mockFunc(cnt)
+		}
+
+		in := &connMock{read: inRead, write: mockFunc}
+		out := &connMock{read: outReadOnce, write: mockFunc}
+
+		rel := newPacketRelay(newResolver(config.Resolver{}))
 
 		rel.realyPackets(in, "in-remote-addr", out, "out-remote-addr")
 
@@ -99,11 +117,11 @@ func TestReleay(t *testing.T) {
 
 		wch, rch := make(chan []byte, 1), make(chan []byte, 1)
 
-		rel := newPacketRelay()
+		rel := newPacketRelay(newResolver(config.Resolver{}))
 
 		rch <- make([]byte, 1)
 
-		go rel.relay(cm, "remote-addr", rch, wch)
+		go rel.relay(cm, &connMock{}, "remote-addr", rch, wch, nil, nil)
 
 		<-wch
 
@@ -125,18 +143,41 @@ func TestReleay(t *testing.T) {
 			return 5, nil
 		}
 
-		in := &connMock{read: mockFunc, write: mockFunc}
-		out := &connMock{read: mockFunc, write: mockFunc}
+		// in is not drained until out is read, otherwise out could be closed before it is read at all
+		outRead, once := make(chan struct{}), &sync.Once{}
+
+		inRead := func(cnt int) (n int, err error) {
+			if cnt > 1000 {
+				<-outRead
+			}
+			return mockFunc(cnt)
+		}
+
+		outReadOnce := func(cnt int) (n int, err error) {
+			once.Do(func() { close(outRead) })
+			return mockFunc(cnt)
+		}
+
+		in := &connMock{read: inRead, write: mockFunc}
+		out := &connMock{read: outReadOnce, write: mockFunc}
 
-		rel := newPacketRelay()
+		rel := newPacketRelay(newResolver(config.Resolver{}))
 
-		go rel.realyPackets(in, "in-remote-addr", out, "out-remote-addr")
+		done := make(chan struct{})
+
+		go func() {
+			rel.realyPackets(in, "in-remote-addr", out, "out-remote-addr")
+			close(done)
+		}()
 
 		rnd := rand.NewSource(time.Now().Unix())
 		ms := rnd.Int63() % 3000
 
 		time.Sleep(time.Duration(ms) * time.Millisecond)
 
+		// relay routines could be not started yet after short sleep
+		<-done
+
 		rel.wg.Wait()
 
 		assert.LessOrEqual(t, 1, in.readCnt)
@@ -152,7 +193,7 @@ func TestReleay(t *testing.T) {
 
 		ctx, cancel := context.WithCancel(context.Background())
 
-		rel := newPacketRelay()
+		rel := newPacketRelay(newResolver(config.Resolver{}))
 
 		wg := &sync.WaitGroup{}
 
@@ -202,7 +243,7 @@ func TestReleay(t *testing.T) {
 
 		ctx, cancel := context.WithCancel(context.Background())
 
-		rel := newPacketRelay()
+		rel := newPacketRelay(newResolver(config.Resolver{}))
 
 		wg := &sync.WaitGroup{}
 
@@ -230,6 +271,126 @@ func TestReleay(t *testing.T) {
 	})
 }
 
+func TestHalfClose(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success_spliced_request_response", func(t *testing.T) {
+		t.Parallel()
+
+		const localAddress, remoteAddress = "127.0.0.1:53500", "127.0.0.1:53501"
+
+		listener := runTCPServer(t, remoteAddress, nil, serveHalfClose)
+		defer listener.Close()
+
+		// listener is bound before relay is served
+		stop := runTimeoutRelay(t, localAddress, remoteAddress, connTimeouts{})
+		defer stop()
+
+		conn, err := net.Dial("tcp", localAddress)
+		if assert.NoError(t, err) {
+			assertHalfClose(t, conn.(*net.TCPConn), "request")
+
+			conn.Close()
+		}
+	})
+
+	t.Run("Success_channel_request_response", func(t *testing.T) {
+		t.Parallel()
+
+		client, in := tcpPair(t)
+		defer client.Close()
+
+		out, server := tcpPair(t)
+
+		go serveHalfClose(server)
+
+		rel := newPacketRelay(newResolver(config.Resolver{}))
+
+		done := make(chan struct{})
+
+		// wrapped connections are not spliced but still could be half-closed
+		go func() {
+			rel.realyPackets(struct{ *net.TCPConn }{in.(*net.TCPConn)}, "in", struct{ *net.TCPConn }{out.(*net.TCPConn)}, "out")
+			close(done)
+		}()
+
+		assertHalfClose(t, client.(*net.TCPConn), "request")
+
+		client.Close()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			assert.Fail(t, "relay is not finished")
+		}
+	})
+}
+
+func TestRelayError(t *testing.T) {
+	t.Parallel()
+
+	wrap := func(conn net.Conn) io.ReadWriteCloser {
+		return struct{ *net.TCPConn }{conn.(*net.TCPConn)}
+	}
+
+	tests := map[string]struct {
+		// Wrapped connections are not spliced
+		wrap func(net.Conn) io.ReadWriteCloser
+		// Client is reset instead of server
+		client bool
+	}{
+		"spliced client reset": {client: true},
+		"spliced server reset": {},
+		"channel client reset": {wrap: wrap, client: true},
+		"channel server reset": {wrap: wrap},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			client, in := tcpPair(t)
+			out, server := tcpPair(t)
+
+			t.Cleanup(func() {
+				client.Close()
+				server.Close()
+			})
+
+			var inConn, outConn io.ReadWriteCloser = in, out
+			if test.wrap != nil {
+				inConn, outConn = test.wrap(in), test.wrap(out)
+			}
+
+			rel := newPacketRelay(newResolver(config.Resolver{}))
+
+			done := make(chan struct{})
+
+			go func() {
+				rel.realyPackets(inConn, "in", outConn, "out")
+				close(done)
+			}()
+
+			reset, alive := server, client
+			if test.client {
+				reset, alive = client, server
+			}
+
+			// close with zero linger sends reset, relay fails to read from its side
+			reset.(*net.TCPConn).SetLinger(0)
+			reset.Close()
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				assert.Fail(t, "relay is not finished by error")
+			}
+
+			assertClosed(t, alive, time.Second)
+		})
+	}
+}
+
 func TestUtils(t *testing.T) {
 	t.Parallel()
 
@@ -242,44 +403,100 @@ func TestUtils(t *testing.T) {
 
 // Mockup io.ReaderWriteCloser
 func (conn *connMock) Read(b []byte) (n int, err error) {
+	conn.mu.Lock()
+
 	if conn.closed {
+		conn.mu.Unlock()
 		return 0, io.EOF
 	}
 
 	conn.readCnt++
+	cnt := conn.readCnt
+
+	conn.mu.Unlock()
+
 	if conn.read != nil {
-		return conn.read(conn.readCnt)
+		return conn.read(cnt)
 	}
 
 	return 5, nil
 }
 
 func (conn *connMock) Write(b []byte) (n int, err error) {
+	conn.mu.Lock()
+
 	if conn.closed {
+		conn.mu.Unlock()
 		return 0, io.EOF
 	}
 
 	conn.writeCnt++
+	cnt := conn.writeCnt
+
+	conn.mu.Unlock()
+
 	if conn.write != nil {
-		return conn.write(conn.writeCnt)
+		return conn.write(cnt)
 	}
 
 	return 5, nil
 }
 
 func (conn *connMock) Close() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
 	conn.closed = true
 	return nil
 }
 
-func (mockConfig) Local() netip.Addr {
-	return netip.MustParseAddr("127.0.0.1")
+func (mockConfig) Resolver() config.Resolver {
+	return config.Resolver{}
 }
 
-func (mockConfig) Remote() netip.Addr {
-	return netip.MustParseAddr("127.0.0.1")
+func (mockConfig) Metrics() config.Metrics {
+	return config.Metrics{}
 }
 
-func (mockConfig) Ports() []uint16 {
-	return []uint16{30000}
+func (mockConfig) Limits() config.Limits {
+	return config.Limits{}
+}
+
+func (mockConfig) Bandwidth() config.Bandwidth {
+	return config.Bandwidth{}
+}
+
+func (mockConfig) Routes() []config.Route {
+	return []config.Route{
+		{
+			Name:       "tcp and udp",
+			Local:      netip.MustParseAddr("127.0.0.1"),
+			Remotes:    []string{"127.0.0.1"},
+			Balance:    config.BalanceRoundRobin,
+			Ports:      []config.Port{{Local: 30000, Remote: 30001, Network: config.NetworkTCP}, {Local: 30000, Remote: 30001, Network: config.NetworkUDP}},
+			UDPTimeout: time.Second,
+		},
+		{
+			Name:    "tcp",
+			Local:   netip.MustParseAddr("127.0.0.1"),
+			Remotes: []string{"localhost", "127.0.0.1"},
+			Balance: config.BalanceLeastConn,
+			Ports:   []config.Port{{Local: 30002, Remote: 30003, Network: config.NetworkTCP}},
+		},
+	}
+}
+
+// Send request, half-close conn and check response is received after that
+func assertHalfClose(t *testing.T, conn *net.TCPConn, request string) {
+	_, err := conn.Write([]byte(request))
+	assert.NoError(t, err)
+
+	assert.NoError(t, conn.CloseWrite())
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	response, err := io.ReadAll(conn)
+
+	assert.NoError(t, err)
+	assert.EqualValues(t, "response:"+request, string(response))
 }
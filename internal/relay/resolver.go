@@ -0,0 +1,122 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"grelay/internal/config"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Resolves remote host names and caches them for configured ttl
+type resolver struct {
+	cfg      config.Resolver
+	resolver *net.Resolver
+	// Guards cache
+	mu *sync.Mutex
+	// Resolved addresses by host name
+	cache map[string]resolvedHost
+}
+
+// Cached addresses of host
+type resolvedHost struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// Create resolver which uses dns server from cfg or system one
+func newResolver(cfg config.Resolver) *resolver {
+	res := &resolver{
+		cfg:      cfg,
+		resolver: net.DefaultResolver,
+		mu:       &sync.Mutex{},
+		cache:    map[string]resolvedHost{},
+	}
+
+	if cfg.Address.IsValid() {
+		dialer, address := &net.Dialer{}, cfg.Address.String()
+
+		res.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+	}
+
+	return res
+}
+
+// Resolve host to its addresses, ip address is returned as is
+func (res *resolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	if addrs, ok := res.cached(host); ok {
+		return addrs, nil
+	}
+
+	addrs, err := res.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		log.Printf("resolver: failed to resolve %s err=%s\n", host, err)
+		return nil, err
+	}
+
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+
+	log.Printf("resolver: %s resolved to %v\n", host, addrs)
+
+	if res.cfg.CacheTTL > 0 {
+		res.mu.Lock()
+		res.cache[host] = resolvedHost{addrs: addrs, expires: time.Now().Add(res.cfg.CacheTTL)}
+		res.mu.Unlock()
+	}
+
+	return addrs, nil
+}
+
+// Get not expired addresses of host from cache
+func (res *resolver) cached(host string) ([]netip.Addr, bool) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	rh, ok := res.cache[host]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(rh.expires) {
+		delete(res.cache, host)
+		return nil, false
+	}
+
+	return rh.addrs, true
+}
@@ -0,0 +1,160 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"grelay/internal/config"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolver(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Ip_address_as_is", func(t *testing.T) {
+		t.Parallel()
+
+		addrs, err := newResolver(config.Resolver{}).lookup(context.Background(), "10.0.0.1")
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, []netip.Addr{netip.MustParseAddr("10.0.0.1")}, addrs)
+	})
+
+	t.Run("Custom_server_and_cache", func(t *testing.T) {
+		t.Parallel()
+
+		queries := &atomic.Int32{}
+
+		dns := runDNSServer(t, "127.0.0.1:53053", netip.MustParseAddr("10.1.2.3"), queries)
+		defer dns.Close()
+
+		res := newResolver(config.Resolver{Address: netip.MustParseAddrPort("127.0.0.1:53053"), CacheTTL: time.Minute})
+
+		for i := 0; i < 3; i++ {
+			addrs, err := res.lookup(context.Background(), "db.test")
+
+			assert.NoError(t, err)
+			assert.EqualValues(t, []netip.Addr{netip.MustParseAddr("10.1.2.3")}, addrs)
+		}
+
+		// one A and one AAAA query for first lookup only
+		assert.LessOrEqual(t, queries.Load(), int32(2))
+	})
+
+	t.Run("Cache_expired", func(t *testing.T) {
+		t.Parallel()
+
+		queries := &atomic.Int32{}
+
+		dns := runDNSServer(t, "127.0.0.1:53054", netip.MustParseAddr("10.1.2.4"), queries)
+		defer dns.Close()
+
+		res := newResolver(config.Resolver{Address: netip.MustParseAddrPort("127.0.0.1:53054"), CacheTTL: time.Minute})
+
+		res.cache["db.test"] = resolvedHost{addrs: []netip.Addr{netip.MustParseAddr("10.9.9.9")}, expires: time.Now().Add(-time.Second)}
+
+		addrs, err := res.lookup(context.Background(), "db.test")
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, []netip.Addr{netip.MustParseAddr("10.1.2.4")}, addrs)
+		assert.Less(t, int32(0), queries.Load())
+	})
+
+	t.Run("No_cache", func(t *testing.T) {
+		t.Parallel()
+
+		queries := &atomic.Int32{}
+
+		dns := runDNSServer(t, "127.0.0.1:53055", netip.MustParseAddr("10.1.2.5"), queries)
+		defer dns.Close()
+
+		res := newResolver(config.Resolver{Address: netip.MustParseAddrPort("127.0.0.1:53055")})
+
+		for i := 0; i < 2; i++ {
+			_, err := res.lookup(context.Background(), "db.test")
+			assert.NoError(t, err)
+		}
+
+		assert.Empty(t, res.cache)
+		assert.Less(t, int32(2), queries.Load())
+	})
+}
+
+// Run dns server which answers ip on every A query and nothing on other ones
+func runDNSServer(t *testing.T, addr string, ip netip.Addr, queries *atomic.Int32) net.PacketConn {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		assert.FailNow(t, "failed to open dns server")
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+
+		for {
+			read, raddr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			queries.Add(1)
+
+			// skip header and question name to get query type
+			end := 12
+			for end < read && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+
+			qtype := binary.BigEndian.Uint16(buf[end+1:])
+			question := buf[12 : end+5]
+
+			resp := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(buf))
+			// response, recursion available, one question
+			resp = append(resp, 0x81, 0x80, 0, 1)
+
+			if qtype != 1 {
+				resp = append(resp, 0, 0, 0, 0, 0, 0)
+				resp = append(resp, question...)
+				conn.WriteTo(resp, raddr)
+				continue
+			}
+
+			resp = append(resp, 0, 1, 0, 0, 0, 0)
+			resp = append(resp, question...)
+			// name pointer to question, type A, class IN, ttl 60, 4 bytes of address
+			resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			resp = append(resp, ip.AsSlice()...)
+
+			conn.WriteTo(resp, raddr)
+		}
+	}()
+
+	return conn
+}
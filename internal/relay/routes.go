@@ -0,0 +1,463 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"grelay/internal/config"
+	"io"
+	"log"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Set of running routes which could be changed on the fly
+type Relay struct {
+	// Relayed connections are closed once ctx is done
+	ctx context.Context
+	// Guards routes
+	mu *sync.Mutex
+	// Tracks goroutines of all started routes
+	wg *sync.WaitGroup
+	// Running routes by name
+	routes map[string]*runningRoute
+	// Resolver of remote hosts, routes keep resolver they were started with so they are restarted once it is changed
+	resolver *resolver
+	// Limiter shared by all routes, route limiters are chained to it
+	limiter *connLimiter
+	// Bandwidth from clients to remotes shared by all routes
+	upload *tokenBucket
+	// Bandwidth from remotes to clients shared by all routes
+	download *tokenBucket
+	// Banned clients of all routes
+	bans *banList
+	// Running metrics endpoint
+	metrics config.Metrics
+	// Stop metrics endpoint
+	stopMetrics context.CancelFunc
+}
+
+// Route with bound listeners
+type runningRoute struct {
+	route config.Route
+	// Listeners of every route port
+	listeners []io.Closer
+	// Filter of clients shared by route ports
+	acl *acl
+	// Stop background tasks of route
+	cancel context.CancelFunc
+}
+
+// Result of config apply
+type ReloadResult struct {
+	// Routes which were started
+	Added []string
+	// Routes which were stopped, their connections are drained
+	Removed []string
+	// Routes which are kept running as is
+	Unchanged []string
+	// Routes whose acl was replaced in place, they are kept running
+	Updated []string
+	// Routes which failed to start, previous version of changed route is kept running
+	Failed []string
+}
+
+// Create new relay without routes, all routes are stopped once ctx is done
+func New(ctx context.Context) *Relay {
+	return &Relay{
+		ctx:      ctx,
+		mu:       &sync.Mutex{},
+		wg:       &sync.WaitGroup{},
+		routes:   map[string]*runningRoute{},
+		limiter:  newConnLimiter(config.Limits{}, nil),
+		upload:   newTokenBucket(0),
+		download: newTokenBucket(0),
+		bans:     newBanList(),
+	}
+}
+
+// Make running routes match config.
+// Removed and changed routes stop accepting while their live connections are left to drain,
+// then added and changed routes are started. Unchanged routes are not touched unless resolver is changed.
+// Changed route failing to start is restarted with its previous version, so bad reload does not take it down.
+func (rly *Relay) Apply(cfg Config) ReloadResult {
+	rly.mu.Lock()
+	defer rly.mu.Unlock()
+
+	result := ReloadResult{}
+
+	// every running route is restarted to pick new resolver
+	restart := false
+
+	if rly.resolver == nil || rly.resolver.cfg != cfg.Resolver() {
+		restart = rly.resolver != nil && len(rly.routes) > 0
+		rly.resolver = newResolver(cfg.Resolver())
+	}
+
+	if restart {
+		log.Printf("relay: restart routes with new resolver %+v", cfg.Resolver())
+	}
+
+	rly.limiter.update(cfg.Limits())
+
+	rly.upload.setRate(cfg.Bandwidth().Upload)
+	rly.download.setRate(cfg.Bandwidth().Download)
+
+	if cfg.Metrics() != rly.metrics {
+		rly.applyMetrics(cfg.Metrics())
+	}
+
+	routes := map[string]config.Route{}
+
+	for _, route := range cfg.Routes() {
+		routes[route.Name] = route
+	}
+
+	// previous versions of changed routes
+	previous := map[string]config.Route{}
+
+	for name, rr := range rly.routes {
+		route, ok := routes[name]
+
+		if ok && !restart && reflect.DeepEqual(route, rr.route) {
+			continue
+		}
+
+		if ok && !restart && reflect.DeepEqual(withoutACL(route), withoutACL(rr.route)) {
+			log.Printf("relay: update acl of route %s", route)
+
+			rr.acl.update(route.ACL)
+			rr.route = route
+
+			result.Updated = append(result.Updated, name)
+			continue
+		}
+
+		log.Printf("relay: stop route %s", rr.route)
+
+		rr.stop()
+
+		delete(rly.routes, name)
+
+		if ok {
+			previous[name] = rr.route
+			continue
+		}
+
+		result.Removed = append(result.Removed, name)
+	}
+
+	for _, route := range cfg.Routes() {
+		if _, ok := rly.routes[route.Name]; ok {
+			if slices.Contains(result.Updated, route.Name) {
+				continue
+			}
+
+			result.Unchanged = append(result.Unchanged, route.Name)
+			continue
+		}
+
+		prev, changed := previous[route.Name]
+
+		rr, err := rly.startRoute(route)
+		if err != nil {
+			log.Printf("relay: failed to start route %s err=%s", route, err)
+
+			result.Failed = append(result.Failed, route.Name)
+
+			if !changed {
+				continue
+			}
+
+			if rr, err = rly.startRoute(prev); err != nil {
+				log.Printf("relay: failed to restart previous route %s err=%s", prev, err)
+
+				result.Removed = append(result.Removed, route.Name)
+				continue
+			}
+
+			log.Printf("relay: keep previous route %s", prev)
+
+			rly.routes[route.Name] = rr
+			continue
+		}
+
+		rly.routes[route.Name] = rr
+
+		if changed {
+			result.Removed = append(result.Removed, route.Name)
+		}
+
+		result.Added = append(result.Added, route.Name)
+	}
+
+	log.Printf("relay: config applied added=%v removed=%v updated=%v unchanged=%v failed=%v",
+		result.Added, result.Removed, result.Updated, result.Unchanged, result.Failed)
+
+	return result
+}
+
+// Active bans of clients exceeding accept rate of routes
+func (rly *Relay) Bans() []Ban {
+	return rly.bans.list(time.Now())
+}
+
+// Lift bans of client on every route, all bans are lifted if client is not valid.
+// Number of lifted bans is returned.
+func (rly *Relay) Unban(client netip.Addr) int {
+	return rly.bans.unban(client.Unmap())
+}
+
+// Wait until ctx is done and all routes are stopped
+func (rly *Relay) Wait() {
+	<-rly.ctx.Done()
+
+	rly.wg.Wait()
+}
+
+// Restart metrics endpoint, endpoint is stopped if address is not valid.
+// Failed endpoint is retried on next apply.
+func (rly *Relay) applyMetrics(cfg config.Metrics) {
+	if rly.stopMetrics != nil {
+		rly.stopMetrics()
+		rly.stopMetrics = nil
+	}
+
+	rly.metrics = config.Metrics{}
+
+	if !cfg.Address.IsValid() {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(rly.ctx)
+
+	if err := serveMetrics(ctx, cfg, rly.bans, rly.wg); err != nil {
+		log.Printf("relay: failed to start metrics endpoint err=%s", err)
+		cancel()
+		return
+	}
+
+	rly.metrics = cfg
+	rly.stopMetrics = cancel
+}
+
+// Bind listeners on every port of route and start relaying, nothing is left bound on error
+func (rly *Relay) startRoute(route config.Route) (*runningRoute, error) {
+	log.Printf("relay: start route %s", route)
+
+	ctx, cancel := context.WithCancel(rly.ctx)
+
+	rr := &runningRoute{route: route, acl: newACL(route.ACL), cancel: cancel}
+
+	// limits of route are shared by its ports
+	limiter := newConnLimiter(route.Limits, rly.limiter)
+
+	accept := newAcceptLimiter(route.Name, route.AcceptRate, rly.bans)
+
+	var terminator *tlsTerminator
+
+	if route.TLS.CertFile != "" {
+		var err error
+
+		if terminator, err = newTLSTerminator(route.TLS); err != nil {
+			rr.stop()
+			return nil, err
+		}
+	}
+
+	var origin *tls.Config
+
+	if route.RemoteTLS.Enabled {
+		var err error
+
+		if origin, err = newOriginTLS(route.RemoteTLS); err != nil {
+			rr.stop()
+			return nil, err
+		}
+
+		if origin.InsecureSkipVerify {
+			log.Printf("relay: WARNING route %s does not verify certificates of remotes, tls is insecure", route.Name)
+		}
+	}
+
+	upload := rateLimit{newTokenBucket(route.Bandwidth.Upload), rly.upload}
+	download := rateLimit{newTokenBucket(route.Bandwidth.Download), rly.download}
+
+	serves := []func(){}
+
+	// upstream of hosts on remote port, health checks connect over tcp so only tcp ports are checked
+	newPortUpstream := func(hosts []string, port config.Port) (*upstream, error) {
+		remotes := make([]string, 0, len(hosts))
+
+		for _, host := range hosts {
+			remotes = append(remotes, makeHostAddr(host, port.Remote))
+		}
+
+		balancer, err := newBalancer(route.Balance)
+		if err != nil {
+			return nil, err
+		}
+
+		ups := newUpstream(remotes, balancer, route.HealthCheck)
+
+		if route.HealthCheck.Interval > 0 && port.Network == config.NetworkTCP {
+			serves = append(serves, func() { ups.runHealthChecks(ctx, rly.resolver, rly.wg) })
+		}
+
+		return ups, nil
+	}
+
+	for _, port := range route.Ports {
+		local := makeAddr(route.Local, port.Local)
+
+		ups, err := newPortUpstream(route.Remotes, port)
+		if err != nil {
+			rr.stop()
+			return nil, err
+		}
+
+		if port.Network == config.NetworkUDP {
+			conn, err := bindDatagram(local)
+			if err != nil {
+				rr.stop()
+				return nil, err
+			}
+
+			rr.listeners = append(rr.listeners, conn)
+
+			dry := newDatagramRelay(route.UDPTimeout, rly.resolver)
+
+			dry.metrics = newPortMetrics(route.Name, port)
+			dry.acl = rr.acl
+			dry.limiter = limiter
+			dry.accept = accept
+
+			serves = append(serves, func() { dry.serve(rly.ctx, conn, local, ups) })
+
+			continue
+		}
+
+		bind := bindConn
+
+		// tproxy delivers connections to foreign addresses to transparent socket only
+		if route.Mode == config.ModeTransparent && route.Transparent.Method == config.TransparentTProxy {
+			bind = bindTransparentConn
+		}
+
+		listener, err := bind(rly.ctx, local)
+		if err != nil {
+			rr.stop()
+			return nil, err
+		}
+
+		// header precedes tls of client
+		if route.ProxyProtocol.Accept != "" {
+			listener = newProxyListener(listener, route.ProxyProtocol)
+		}
+
+		if terminator != nil {
+			listener = tls.NewListener(listener, terminator.config())
+		}
+
+		rr.listeners = append(rr.listeners, listener)
+
+		pry := newPacketRelay(rly.resolver)
+
+		pry.metrics = newPortMetrics(route.Name, port)
+		pry.timeouts = newConnTimeouts(route)
+		pry.udpTimeout = route.UDPTimeout
+		pry.dial = route.Dial
+		pry.acl = rr.acl
+		pry.limiter = limiter
+		pry.accept = accept
+		pry.sendProxy = route.ProxyProtocol.Send
+		pry.origin = origin
+		pry.bandwidth = route.Bandwidth
+		pry.upload = upload
+		pry.download = download
+
+		switch route.Mode {
+		case config.ModeSNI:
+			pry.hosts = newHostRouter(parseTLSHost, ErrClientHello)
+		case config.ModeHTTP:
+			pry.hosts = newHostRouter(parseHTTPHost, ErrHTTPRequest)
+		case config.ModeSOCKS5:
+			pry.tunnel = newTunnel(socksHandshake, route.Tunnel)
+		case config.ModeConnect:
+			pry.tunnel = newTunnel(connectHandshake, route.Tunnel)
+		case config.ModeTransparent:
+			pry.transparent = newTransparentRouter(route.Transparent, netip.AddrPortFrom(route.Local, port.Local))
+		}
+
+		if pry.hosts != nil {
+			for _, host := range route.Hosts {
+				hostUps, err := newPortUpstream(host.Remotes, port)
+				if err != nil {
+					rr.stop()
+					return nil, err
+				}
+
+				pry.hosts.add(host.Host, host.Path, hostUps)
+			}
+
+			if len(route.Remotes) != 0 {
+				pry.hosts.fallback = ups
+			}
+		}
+
+		serves = append(serves, func() { pry.serve(rly.ctx, listener, local, ups) })
+	}
+
+	for _, serve := range serves {
+		rly.wg.Add(1)
+
+		go func() {
+			serve()
+
+			rly.wg.Done()
+		}()
+	}
+
+	return rr, nil
+}
+
+// Route with acl left out, routes differing by acl only are updated in place
+func withoutACL(route config.Route) config.Route {
+	route.ACL = config.ACL{}
+
+	return route
+}
+
+// Close listeners of route, accepted connections are kept until they complete
+func (rr *runningRoute) stop() {
+	rr.cancel()
+
+	for _, listener := range rr.listeners {
+		listener.Close()
+	}
+}
@@ -0,0 +1,281 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Config mock with fixed routes
+type routesConfig []config.Route
+
+func TestRelayApply(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success_diff_and_drain", func(t *testing.T) {
+		const remoteAddress = "127.0.0.1:53001"
+
+		echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+		defer echo.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		rly := New(ctx)
+
+		result := rly.Apply(routesConfig{testRoute("a", 53100, 53001), testRoute("b", 53101, 53001)})
+
+		assert.EqualValues(t, ReloadResult{Added: []string{"a", "b"}}, result)
+
+		conn, err := net.Dial("tcp", "127.0.0.1:53100")
+		if !assert.NoError(t, err) {
+			cancel()
+			return
+		}
+
+		defer conn.Close()
+
+		assertEcho(t, conn, "ping")
+
+		failed := testRoute("d", 53103, 53001)
+		failed.Local = netip.MustParseAddr("10.255.255.1")
+
+		result = rly.Apply(routesConfig{testRoute("b", 53101, 53001), testRoute("c", 53102, 53001), failed})
+
+		assert.EqualValues(t, ReloadResult{
+			Added:     []string{"c"},
+			Removed:   []string{"a"},
+			Unchanged: []string{"b"},
+			Failed:    []string{"d"},
+		}, result)
+
+		// connection of removed route is drained
+		assertEcho(t, conn, "pong")
+
+		_, err = net.Dial("tcp", "127.0.0.1:53100")
+		assert.Error(t, err)
+
+		for _, addr := range []string{"127.0.0.1:53101", "127.0.0.1:53102"} {
+			conn, err := net.Dial("tcp", addr)
+			if assert.NoError(t, err) {
+				assertEcho(t, conn, "ping")
+				conn.Close()
+			}
+		}
+
+		cancel()
+
+		rly.Wait()
+	})
+
+	t.Run("Unknown_balancer_failed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		rly := New(ctx)
+
+		route := testRoute("a", 53120, 53021)
+		route.Balance = "not-registered"
+
+		assert.EqualValues(t, ReloadResult{Failed: []string{"a"}}, rly.Apply(routesConfig{route}))
+
+		cancel()
+
+		rly.Wait()
+	})
+
+	t.Run("ACL_updated_in_place", func(t *testing.T) {
+		const remoteAddress = "127.0.0.1:53031"
+
+		echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+		defer echo.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		rly := New(ctx)
+
+		route := testRoute("a", 53130, 53031)
+		route.ACL = config.ACL{Deny: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+
+		assert.EqualValues(t, ReloadResult{Added: []string{"a"}}, rly.Apply(routesConfig{route}))
+
+		conn, err := net.Dial("tcp", "127.0.0.1:53130")
+		if assert.NoError(t, err) {
+			// denied client is closed without relaying
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			_, err = conn.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, io.EOF)
+
+			conn.Close()
+		}
+
+		route.ACL = config.ACL{Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}}
+
+		assert.EqualValues(t, ReloadResult{Updated: []string{"a"}}, rly.Apply(routesConfig{route}))
+
+		conn, err = net.Dial("tcp", "127.0.0.1:53130")
+		if assert.NoError(t, err) {
+			assertEcho(t, conn, "ping")
+			conn.Close()
+		}
+
+		cancel()
+
+		rly.Wait()
+	})
+
+	t.Run("Changed_route_restarted", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		rly := New(ctx)
+
+		route := testRoute("a", 53110, 53011)
+
+		assert.EqualValues(t, ReloadResult{Added: []string{"a"}}, rly.Apply(routesConfig{route}))
+
+		route.Ports = append(route.Ports, config.Port{Local: 53111, Remote: 53011, Network: config.NetworkUDP})
+
+		assert.EqualValues(t, ReloadResult{Added: []string{"a"}, Removed: []string{"a"}}, rly.Apply(routesConfig{route}))
+
+		assert.EqualValues(t, ReloadResult{Unchanged: []string{"a"}}, rly.Apply(routesConfig{route}))
+
+		cancel()
+
+		rly.Wait()
+	})
+
+	t.Run("Failed_change_keeps_previous_route", func(t *testing.T) {
+		const remoteAddress = "127.0.0.1:53041"
+
+		echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+		defer echo.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		rly := New(ctx)
+
+		route := testRoute("a", 53140, 53041)
+
+		assert.EqualValues(t, ReloadResult{Added: []string{"a"}}, rly.Apply(routesConfig{route}))
+
+		changed := route
+		changed.Balance = "not-registered"
+
+		assert.EqualValues(t, ReloadResult{Failed: []string{"a"}}, rly.Apply(routesConfig{changed}))
+
+		conn, err := net.Dial("tcp", "127.0.0.1:53140")
+		if assert.NoError(t, err) {
+			assertEcho(t, conn, "ping")
+			conn.Close()
+		}
+
+		// previous version is running, so fixed config does not change it
+		assert.EqualValues(t, ReloadResult{Unchanged: []string{"a"}}, rly.Apply(routesConfig{route}))
+
+		cancel()
+
+		rly.Wait()
+	})
+
+	t.Run("Changed_resolver_restarts_routes", func(t *testing.T) {
+		const remoteAddress = "127.0.0.1:53051"
+
+		echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+		defer echo.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		rly := New(ctx)
+
+		routes := routesConfig{testRoute("a", 53150, 53051)}
+
+		assert.EqualValues(t, ReloadResult{Added: []string{"a"}}, rly.Apply(routes))
+
+		cfg := resolverConfig{routesConfig: routes, resolver: config.Resolver{CacheTTL: time.Minute}}
+
+		assert.EqualValues(t, ReloadResult{Added: []string{"a"}, Removed: []string{"a"}}, rly.Apply(cfg))
+		assert.EqualValues(t, cfg.resolver, rly.resolver.cfg)
+
+		conn, err := net.Dial("tcp", "127.0.0.1:53150")
+		if assert.NoError(t, err) {
+			assertEcho(t, conn, "ping")
+			conn.Close()
+		}
+
+		assert.EqualValues(t, ReloadResult{Unchanged: []string{"a"}}, rly.Apply(cfg))
+
+		cancel()
+
+		rly.Wait()
+	})
+}
+
+// Config mock with fixed routes and resolver
+type resolverConfig struct {
+	routesConfig
+	resolver config.Resolver
+}
+
+func (cfg resolverConfig) Resolver() config.Resolver {
+	return cfg.resolver
+}
+
+func (cfg routesConfig) Routes() []config.Route {
+	return cfg
+}
+
+func (cfg routesConfig) Resolver() config.Resolver {
+	return config.Resolver{}
+}
+
+func (cfg routesConfig) Metrics() config.Metrics {
+	return config.Metrics{}
+}
+
+func (cfg routesConfig) Limits() config.Limits {
+	return config.Limits{}
+}
+
+func (cfg routesConfig) Bandwidth() config.Bandwidth {
+	return config.Bandwidth{}
+}
+
+// Route on loopback with single tcp port
+func testRoute(name string, local, remote uint16) config.Route {
+	return config.Route{
+		Name:       name,
+		Local:      netip.MustParseAddr("127.0.0.1"),
+		Remotes:    []string{"127.0.0.1"},
+		Balance:    config.BalanceRoundRobin,
+		Ports:      []config.Port{{Local: local, Remote: remote, Network: config.NetworkTCP}},
+		UDPTimeout: time.Second,
+	}
+}
@@ -0,0 +1,175 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Types of tls protocol messages making up client hello
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+	extensionServerName      = 0
+	serverNameTypeHost       = 0
+	// Max size of tls record payload
+	maxRecordSize = 1 << 14
+)
+
+// Reader of length prefixed fields of tls messages
+type helloReader []byte
+
+// Parse server name of tls client hello as host without path
+func parseTLSHost(data []byte) (string, string, error) {
+	host, err := parseServerName(data)
+
+	return host, "", err
+}
+
+// Parse server name of tls client hello, it is empty if client has not sent it.
+// Hello could be fragmented over several records, errIncomplete is returned until it is read completely.
+func parseServerName(data []byte) (string, error) {
+	hello := []byte{}
+
+	for {
+		if len(data) < 5 {
+			return "", errIncomplete
+		}
+
+		// record type, legacy version 3.x and length
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+
+		if data[0] != recordTypeHandshake || data[1] != 3 || size == 0 || size > maxRecordSize {
+			return "", ErrClientHello
+		}
+
+		if len(data) < 5+size {
+			return "", errIncomplete
+		}
+
+		hello, data = append(hello, data[5:5+size]...), data[5+size:]
+
+		if len(hello) < 4 {
+			continue
+		}
+
+		if hello[0] != handshakeTypeClientHello {
+			return "", ErrClientHello
+		}
+
+		if length := int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3]); len(hello) >= 4+length {
+			return helloServerName(hello[4 : 4+length])
+		}
+	}
+}
+
+// Find server name extension of client hello body
+func helloServerName(body []byte) (string, error) {
+	r := helloReader(body)
+
+	// legacy version and random
+	if _, ok := r.bytes(2 + 32); !ok {
+		return "", ErrClientHello
+	}
+
+	// session id, cipher suites and compression methods
+	for _, lenSize := range []int{1, 2, 1} {
+		if _, ok := r.vector(lenSize); !ok {
+			return "", ErrClientHello
+		}
+	}
+
+	if len(r) == 0 {
+		return "", nil
+	}
+
+	extensions, ok := r.vector(2)
+	if !ok {
+		return "", ErrClientHello
+	}
+
+	for len(extensions) > 0 {
+		extType, ok1 := extensions.bytes(2)
+		ext, ok2 := extensions.vector(2)
+
+		if !ok1 || !ok2 {
+			return "", ErrClientHello
+		}
+
+		if binary.BigEndian.Uint16(extType) != extensionServerName {
+			continue
+		}
+
+		names, ok := ext.vector(2)
+		if !ok {
+			return "", ErrClientHello
+		}
+
+		for len(names) > 0 {
+			nameType, ok1 := names.bytes(1)
+			name, ok2 := names.vector(2)
+
+			if !ok1 || !ok2 {
+				return "", ErrClientHello
+			}
+
+			if nameType[0] == serverNameTypeHost {
+				return strings.TrimSuffix(strings.ToLower(string(name)), "."), nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// Take next n bytes
+func (r *helloReader) bytes(n int) ([]byte, bool) {
+	if n > len(*r) {
+		return nil, false
+	}
+
+	b := (*r)[:n]
+	*r = (*r)[n:]
+
+	return b, true
+}
+
+// Take next bytes prefixed by their length of lenSize bytes
+func (r *helloReader) vector(lenSize int) (helloReader, bool) {
+	prefix, ok := r.bytes(lenSize)
+	if !ok {
+		return nil, false
+	}
+
+	n := 0
+
+	for _, b := range prefix {
+		n = n<<8 | int(b)
+	}
+
+	v, ok := r.bytes(n)
+
+	return helloReader(v), ok
+}
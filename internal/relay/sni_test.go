@@ -0,0 +1,242 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Conn which captures written bytes and fails reads
+type helloCapture struct {
+	net.Conn
+	written []byte
+}
+
+func TestParseServerName(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success_server_name", func(t *testing.T) {
+		t.Parallel()
+
+		hello := clientHello(t, "Git.Example.com")
+
+		host, err := parseServerName(hello)
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, "git.example.com", host)
+	})
+
+	t.Run("Success_no_server_name", func(t *testing.T) {
+		t.Parallel()
+
+		host, err := parseServerName(clientHello(t, ""))
+
+		assert.NoError(t, err)
+		assert.Empty(t, host)
+	})
+
+	t.Run("Success_fragmented_records", func(t *testing.T) {
+		t.Parallel()
+
+		hello := clientHello(t, "git.example.com")
+
+		// split handshake message over records of 100 bytes
+		body, fragmented := hello[5:], []byte{}
+
+		for len(body) > 0 {
+			n := min(len(body), 100)
+
+			fragmented = append(fragmented, recordTypeHandshake, 3, 1, byte(n>>8), byte(n))
+			fragmented = append(fragmented, body[:n]...)
+
+			body = body[n:]
+		}
+
+		host, err := parseServerName(fragmented)
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, "git.example.com", host)
+	})
+
+	t.Run("Incomplete", func(t *testing.T) {
+		t.Parallel()
+
+		hello := clientHello(t, "git.example.com")
+
+		for n := 0; n < len(hello); n++ {
+			if _, err := parseServerName(hello[:n]); !errors.Is(err, errIncomplete) {
+				assert.Fail(t, "incomplete hello is parsed", "size %d err %v", n, err)
+				return
+			}
+		}
+	})
+
+	t.Run("Not_tls_failed", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := parseServerName([]byte("GET / HTTP/1.1\r\nHost: git.example.com\r\n\r\n"))
+
+		assert.ErrorIs(t, err, ErrClientHello)
+	})
+
+	t.Run("Malformed_hello_failed", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := parseServerName([]byte{recordTypeHandshake, 3, 1, 0, 6, handshakeTypeClientHello, 0, 0, 2, 3, 3})
+
+		assert.ErrorIs(t, err, ErrClientHello)
+	})
+}
+
+func TestSNIRouting(t *testing.T) {
+	t.Parallel()
+
+	certs := newTestCerts(t)
+
+	// remotes differ by address and share remote port, they are told apart by served certificate
+	for _, name := range []string{"git", "wildcard", "default"} {
+		certs.issue(t, name, name)
+	}
+
+	backends := map[string]string{"git": "127.0.0.1", "wildcard": "127.0.0.2", "default": "127.0.0.3"}
+
+	for name, addr := range backends {
+		echo := runTCPServer(t, addr+":24201", &tls.Config{Certificates: []tls.Certificate{certs.keyPair(t, name)}}, serveEcho)
+
+		// parallel subtests complete after parent returns
+		t.Cleanup(func() { echo.Close() })
+	}
+
+	sniRoute := func(name string, local uint16, fallback []string) config.Route {
+		route := testRoute(name, local, 24201)
+		route.Mode = config.ModeSNI
+		route.Remotes = fallback
+		route.Hosts = []config.HostRoute{
+			{Host: "git.example.com", Remotes: []string{backends["git"]}},
+			{Host: "*.example.com", Remotes: []string{backends["wildcard"]}},
+		}
+
+		return route
+	}
+
+	t.Run("Success_routed_by_server_name", func(t *testing.T) {
+		t.Parallel()
+
+		stop := runRouteRelay(t, sniRoute("sni", 24200, []string{backends["default"]}))
+		defer stop()
+
+		tests := map[string]string{
+			"git.example.com":  "git",
+			"wiki.example.com": "wildcard",
+			"other.org":        "default",
+			"":                 "default",
+		}
+
+		for host, backend := range tests {
+			conn, err := tls.Dial("tcp", "127.0.0.1:24200", &tls.Config{ServerName: host, InsecureSkipVerify: true})
+			if !assert.NoError(t, err, host) {
+				continue
+			}
+
+			assert.EqualValues(t, backend, conn.ConnectionState().PeerCertificates[0].Subject.CommonName, host)
+
+			assertEcho(t, conn, "ping")
+
+			conn.Close()
+		}
+	})
+
+	t.Run("Unknown_host_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		route := sniRoute("sni-no-default", 24202, nil)
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		_, err := tls.Dial("tcp", "127.0.0.1:24202", &tls.Config{ServerName: "other.org", InsecureSkipVerify: true})
+		assert.Error(t, err)
+
+		rejected := connRejected.With(route.Name, route.Ports[0].String(), rejectHost)
+
+		assert.Eventually(t, func() bool { return rejected.Value() == 1 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Not_tls_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		route := sniRoute("sni-plain", 24203, []string{backends["default"]})
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24203")
+		if assert.NoError(t, err) {
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: git.example.com\r\n\r\n"))
+
+			assertClosed(t, conn, time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 1, connRejected.With(route.Name, route.Ports[0].String(), rejectHello).Value())
+	})
+}
+
+// Capture client hello of tls client which sends server name
+func clientHello(t *testing.T, serverName string) []byte {
+	capture := &helloCapture{}
+
+	cfg := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+
+	// handshake fails on first read once hello is written
+	tls.Client(capture, cfg).Handshake()
+
+	if len(capture.written) == 0 {
+		assert.FailNow(t, "client hello is not captured")
+	}
+
+	return capture.written
+}
+
+func (hc *helloCapture) Write(b []byte) (int, error) {
+	hc.written = append(hc.written, b...)
+	return len(b), nil
+}
+
+func (hc *helloCapture) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (hc *helloCapture) Close() error {
+	return nil
+}
@@ -0,0 +1,557 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"grelay/internal/config"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Versions of socks5 protocol and its password authentication
+const (
+	socksVersion     = 0x05
+	socksAuthVersion = 0x01
+)
+
+// Authentication methods of socks5 client
+const (
+	socksNoAuth       = 0x00
+	socksPasswordAuth = 0x02
+	socksNoAcceptable = 0xff
+)
+
+// Commands of socks5 client
+const (
+	socksConnect   = 0x01
+	socksAssociate = 0x03
+)
+
+// Address types of socks5 request
+const (
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+)
+
+// Reply codes of socks5 server
+const (
+	socksSucceeded        = 0x00
+	socksFailure          = 0x01
+	socksNotAllowed       = 0x02
+	socksNetUnreachable   = 0x03
+	socksHostUnreachable  = 0x04
+	socksRefused          = 0x05
+	socksNotSupported     = 0x07
+	socksAddrNotSupported = 0x08
+)
+
+// Negotiate authentication with socks5 client and read its request, see RFC 1928 and RFC 1929.
+// Client is replied if request is not supported, otherwise it has to be replied by request.
+func socksHandshake(conn net.Conn, cfg config.Tunnel) (*tunnelRequest, error) {
+	head := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+	}
+
+	if head[0] != socksVersion {
+		return nil, fmt.Errorf("%w: socks version %d", ErrTunnelRequest, head[0])
+	}
+
+	methods := make([]byte, head[1])
+
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+	}
+
+	method := byte(socksNoAuth)
+	if len(cfg.Users) != 0 {
+		method = socksPasswordAuth
+	}
+
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return nil, fmt.Errorf("%w: no acceptable auth method", ErrTunnelAuth)
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+
+	req := &tunnelRequest{}
+
+	if method == socksPasswordAuth {
+		var err error
+
+		if req.user, err = socksAuthenticate(conn, cfg.Users); err != nil {
+			return nil, err
+		}
+	}
+
+	head = make([]byte, 3)
+
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+	}
+
+	if head[0] != socksVersion {
+		return nil, fmt.Errorf("%w: socks version %d", ErrTunnelRequest, head[0])
+	}
+
+	var err error
+
+	if req.host, req.port, err = readSocksAddr(conn); errors.Is(err, errSocksAddrType) {
+		conn.Write(socksReply(socksAddrNotSupported, netip.AddrPort{}))
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.reply = func(bound netip.AddrPort, err error) error {
+		_, werr := conn.Write(socksReply(socksReplyCode(err), bound))
+		return werr
+	}
+
+	switch {
+	case head[1] == socksConnect:
+	case head[1] == socksAssociate && cfg.UDP:
+		req.udp = true
+	default:
+		conn.Write(socksReply(socksNotSupported, netip.AddrPort{}))
+		return nil, fmt.Errorf("%w: socks command %d is not supported", ErrTunnelRequest, head[1])
+	}
+
+	return req, nil
+}
+
+// Not supported address type of socks5 request
+var errSocksAddrType = fmt.Errorf("%w: address type is not supported", ErrTunnelRequest)
+
+// Check username and password of client, name of authenticated user is returned
+func socksAuthenticate(conn net.Conn, users map[string]string) (string, error) {
+	head := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+	}
+
+	if head[0] != socksAuthVersion {
+		return "", fmt.Errorf("%w: auth version %d", ErrTunnelRequest, head[0])
+	}
+
+	// length of password follows user name, both are up to 255 bytes
+	user := make([]byte, int(head[1])+1)
+
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+	}
+
+	password := make([]byte, user[len(user)-1])
+
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+	}
+
+	name := string(user[:len(user)-1])
+
+	if !authenticate(users, name, string(password)) {
+		conn.Write([]byte{socksAuthVersion, 0x01})
+		return "", fmt.Errorf("%w: user %q", ErrTunnelAuth, name)
+	}
+
+	if _, err := conn.Write([]byte{socksAuthVersion, 0x00}); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Read address of socks5 request or datagram header, domain name is returned as is
+func readSocksAddr(r io.Reader) (string, uint16, error) {
+	atyp := make([]byte, 1)
+
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+	}
+
+	var addr []byte
+
+	switch atyp[0] {
+	case socksIPv4:
+		addr = make([]byte, 4+2)
+	case socksIPv6:
+		addr = make([]byte, 16+2)
+	case socksDomain:
+		if _, err := io.ReadFull(r, atyp); err != nil {
+			return "", 0, fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+		}
+
+		addr = make([]byte, int(atyp[0])+2)
+	default:
+		return "", 0, errSocksAddrType
+	}
+
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, fmt.Errorf("%w: %w", ErrTunnelRequest, err)
+	}
+
+	host, port := addr[:len(addr)-2], binary.BigEndian.Uint16(addr[len(addr)-2:])
+
+	if ip, ok := netip.AddrFromSlice(host); ok && atyp[0] != socksDomain {
+		return ip.Unmap().String(), port, nil
+	}
+
+	if len(host) == 0 {
+		return "", 0, fmt.Errorf("%w: empty domain name", ErrTunnelRequest)
+	}
+
+	return string(host), port, nil
+}
+
+// Append socks5 address, invalid address is sent as 0.0.0.0:0
+func appendSocksAddr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+
+	switch {
+	case ip.Is4():
+		b = append(append(b, socksIPv4), ip.AsSlice()...)
+	case ip.Is6():
+		b = append(append(b, socksIPv6), ip.AsSlice()...)
+	default:
+		b = append(b, socksIPv4, 0, 0, 0, 0)
+	}
+
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// Reply of socks5 server with address bound toward destination
+func socksReply(code byte, bound netip.AddrPort) []byte {
+	return appendSocksAddr([]byte{socksVersion, code, 0x00}, bound)
+}
+
+// Reply code of connect result
+func socksReplyCode(err error) byte {
+	switch {
+	case err == nil:
+		return socksSucceeded
+	case errors.Is(err, ErrDestination):
+		return socksNotAllowed
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetUnreachable
+	}
+
+	switch dialFailureReason(err) {
+	case dialFailRefused:
+		return socksRefused
+	case dialFailUnresolved, dialFailTimeout:
+		return socksHostUnreachable
+	}
+
+	return socksFailure
+}
+
+// Relay datagrams of socks5 client via new udp socket until its tcp connection is closed.
+// Datagrams are accepted from address of client only, they are sent to allowed destinations and
+// only destinations client has sent datagrams to could reply.
+func (pry packetRelay) associate(ctx context.Context, inConn net.Conn, req *tunnelRequest) {
+	sock := socketConn(inConn)
+
+	local, peer := tcpAddrPort(sock.LocalAddr()), tcpAddrPort(sock.RemoteAddr())
+
+	// clients send datagrams to the same address they have connected to
+	clientConn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(local.Addr(), 0)))
+	if err != nil {
+		log.Printf("pkt_relay: failed to bind udp socket of client %s err=%s", inConn.RemoteAddr(), err)
+		req.reply(netip.AddrPort{}, err)
+		return
+	}
+
+	defer clientConn.Close()
+
+	outConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("pkt_relay: failed to bind udp socket toward destinations of client %s err=%s", inConn.RemoteAddr(), err)
+		req.reply(netip.AddrPort{}, err)
+		return
+	}
+
+	defer outConn.Close()
+
+	bound := unmapAddrPort(clientConn.LocalAddr().(*net.UDPAddr).AddrPort())
+
+	if err := req.reply(bound, nil); err != nil {
+		log.Printf("pkt_relay: failed to reply client %s err=%s", inConn.RemoteAddr(), err)
+		return
+	}
+
+	log.Printf("pkt_relay: associate udp of client %s via %s", inConn.RemoteAddr(), bound)
+
+	defer pry.metrics.relaying()()
+
+	asn := newSocksAssociation(peer.Addr().Unmap(), pry.udpTimeout)
+
+	// client asks to fix its address unless it is not known yet
+	if addr, err := netip.ParseAddr(req.host); err == nil && !addr.IsUnspecified() && req.port != 0 {
+		asn.client = netip.AddrPortFrom(addr.Unmap(), req.port)
+	}
+
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		pry.associateDestinations(ctx, clientConn, outConn, asn)
+
+		wg.Done()
+	}()
+
+	wg.Add(1)
+	go func() {
+		pry.associateReplies(clientConn, outConn, asn)
+
+		wg.Done()
+	}()
+
+	// association lives as long as tcp connection of client, data sent over it is discarded
+	stop := context.AfterFunc(ctx, func() { inConn.Close() })
+
+	io.Copy(io.Discard, inConn)
+
+	stop()
+
+	clientConn.Close()
+
+	outConn.Close()
+
+	wg.Wait()
+
+	log.Printf("pkt_relay: finish udp association of client %s", inConn.RemoteAddr())
+}
+
+// Udp association of socks5 client
+type socksAssociation struct {
+	// Guards fields below
+	mu *sync.Mutex
+	// Ip address of client tcp connection
+	peer netip.Addr
+	// Udp address of client, it is fixed by first datagram if not asked by client
+	client netip.AddrPort
+	// Idle timeout of destinations, they are forgotten once expired
+	timeout time.Duration
+	// Last time expired destinations were removed
+	swept time.Time
+	// Allowed destination address by requested one
+	resolved map[string]socksDestination
+	// Last time datagram was sent to destination
+	sent map[netip.AddrPort]time.Time
+}
+
+// Resolved destination of socks5 association
+type socksDestination struct {
+	addr netip.AddrPort
+	// Last time datagram was sent to destination by requested address
+	used time.Time
+}
+
+// Create association of client connected from peer, destinations expire after timeout of inactivity
+func newSocksAssociation(peer netip.Addr, timeout time.Duration) *socksAssociation {
+	return &socksAssociation{
+		mu:       &sync.Mutex{},
+		peer:     peer,
+		timeout:  timeout,
+		swept:    time.Now(),
+		resolved: map[string]socksDestination{},
+		sent:     map[netip.AddrPort]time.Time{},
+	}
+}
+
+// Relay datagrams of client to destinations in their headers, fragmented and not allowed ones are dropped
+func (pry packetRelay) associateDestinations(ctx context.Context, clientConn, outConn *net.UDPConn, asn *socksAssociation) {
+	upload := pry.metrics.bytes(directionUpload)
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		read, src, err := clientConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+
+		src = unmapAddrPort(src)
+
+		if !asn.accepts(src) {
+			log.Printf("pkt_relay: drop datagram of unknown client %s", src)
+			continue
+		}
+
+		// reserved bytes and fragment number precede destination
+		if read < 4 || buf[2] != 0 {
+			log.Printf("pkt_relay: drop malformed or fragmented datagram of client %s", src)
+			continue
+		}
+
+		r := bytes.NewReader(buf[3:read])
+
+		host, port, err := readSocksAddr(r)
+		if err != nil {
+			log.Printf("pkt_relay: drop datagram of client %s err=%s", src, err)
+			continue
+		}
+
+		dst, err := pry.associateDestination(ctx, asn, host, port)
+		if err != nil {
+			log.Printf("pkt_relay: drop datagram of client %s err=%s", src, err)
+			continue
+		}
+
+		n, err := outConn.WriteToUDPAddrPort(buf[read-r.Len():read], dst)
+
+		upload.Add(uint64(n))
+
+		if err != nil {
+			log.Printf("pkt_relay: client(%s)->%s fail to relay err=%s", src, dst, err)
+		}
+	}
+}
+
+// Resolve destination of datagram once per association and remember it is sent to
+func (pry packetRelay) associateDestination(ctx context.Context, asn *socksAssociation, host string, port uint16) (netip.AddrPort, error) {
+	key, now := makeHostAddr(host, port), time.Now()
+
+	asn.mu.Lock()
+	dst, ok := asn.resolved[key]
+	ok = ok && now.Sub(dst.used) < asn.timeout
+	if ok {
+		asn.resolved[key] = socksDestination{addr: dst.addr, used: now}
+		asn.sent[dst.addr] = now
+	}
+	asn.mu.Unlock()
+
+	if ok {
+		return dst.addr, nil
+	}
+
+	addrs, err := pry.tunnel.resolve(ctx, pry.resolver, pry.dial.Timeout, host, port)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	asn.mu.Lock()
+	asn.expire(now)
+	asn.resolved[key] = socksDestination{addr: addrs[0], used: now}
+	asn.sent[addrs[0]] = now
+	asn.mu.Unlock()
+
+	return addrs[0], nil
+}
+
+// Relay datagrams of destinations client has sent to back to client with header of their source
+func (pry packetRelay) associateReplies(clientConn, outConn *net.UDPConn, asn *socksAssociation) {
+	download := pry.metrics.bytes(directionDownload)
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		read, src, err := outConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+
+		src = unmapAddrPort(src)
+
+		asn.mu.Lock()
+		client, known := asn.client, asn.active(src, time.Now())
+		asn.mu.Unlock()
+
+		if !known || !client.IsValid() {
+			log.Printf("pkt_relay: drop datagram of unknown destination %s", src)
+			continue
+		}
+
+		datagram := append(appendSocksAddr([]byte{0x00, 0x00, 0x00}, src), buf[:read]...)
+
+		if _, err := clientConn.WriteToUDPAddrPort(datagram, client); err == nil {
+			download.Add(uint64(read))
+		} else {
+			log.Printf("pkt_relay: %s->client(%s) fail to relay err=%s", src, client, err)
+		}
+	}
+}
+
+// Check whether datagram was sent to destination within timeout, called under lock
+func (asn *socksAssociation) active(dst netip.AddrPort, now time.Time) bool {
+	last, ok := asn.sent[dst]
+
+	return ok && now.Sub(last) < asn.timeout
+}
+
+// Remove destinations idle at least timeout, called under lock.
+// Sweep is done once per timeout at most, so client sending to many destinations does not pay for it on every datagram.
+func (asn *socksAssociation) expire(now time.Time) {
+	if now.Sub(asn.swept) < asn.timeout {
+		return
+	}
+
+	asn.swept = now
+
+	for key, dst := range asn.resolved {
+		if now.Sub(dst.used) >= asn.timeout {
+			delete(asn.resolved, key)
+		}
+	}
+
+	for dst := range asn.sent {
+		if !asn.active(dst, now) {
+			delete(asn.sent, dst)
+		}
+	}
+}
+
+// Check whether datagram is sent by client, address of client is fixed by its first datagram
+func (asn *socksAssociation) accepts(src netip.AddrPort) bool {
+	asn.mu.Lock()
+	defer asn.mu.Unlock()
+
+	if src.Addr() != asn.peer {
+		return false
+	}
+
+	if !asn.client.IsValid() {
+		asn.client = src
+	}
+
+	return asn.client == src
+}
@@ -0,0 +1,553 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocksHandshake(t *testing.T) {
+	t.Parallel()
+
+	connect := func(atyp byte, addr ...byte) string {
+		return string(append([]byte{socksVersion, socksConnect, 0x00, atyp}, addr...))
+	}
+
+	users := map[string]string{"alice": "secret"}
+
+	longest := strings.Repeat("u", 255)
+
+	tests := map[string]struct {
+		request string
+		cfg     config.Tunnel
+		host    string
+		port    uint16
+		user    string
+		udp     bool
+		replies string
+		err     error
+	}{
+		"connect ipv4": {
+			request: "\x05\x01\x00" + connect(socksIPv4, 10, 0, 0, 1, 0x00, 0x16),
+			host:    "10.0.0.1",
+			port:    22,
+			replies: "\x05\x00",
+		},
+		"connect ipv6": {
+			request: "\x05\x02\x02\x00" + connect(socksIPv6, append(netip.MustParseAddr("fd00::1").AsSlice(), 0x01, 0xbb)...),
+			host:    "fd00::1",
+			port:    443,
+			replies: "\x05\x00",
+		},
+		"connect domain": {
+			request: "\x05\x01\x00" + connect(socksDomain, append([]byte("\x0bexample.com"), 0x01, 0xbb)...),
+			host:    "example.com",
+			port:    443,
+			replies: "\x05\x00",
+		},
+		"connect with password": {
+			request: "\x05\x02\x00\x02" + "\x01\x05alice\x06secret" + connect(socksIPv4, 10, 0, 0, 1, 0x00, 0x16),
+			cfg:     config.Tunnel{Users: users},
+			host:    "10.0.0.1",
+			port:    22,
+			user:    "alice",
+			replies: "\x05\x02\x01\x00",
+		},
+		"connect with longest user and password": {
+			request: "\x05\x01\x02" + "\x01\xff" + longest + "\xff" + longest + connect(socksIPv4, 10, 0, 0, 1, 0x00, 0x16),
+			cfg:     config.Tunnel{Users: map[string]string{longest: longest}},
+			host:    "10.0.0.1",
+			port:    22,
+			user:    longest,
+			replies: "\x05\x02\x01\x00",
+		},
+		"associate": {
+			request: "\x05\x01\x00" + string([]byte{socksVersion, socksAssociate, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0}),
+			cfg:     config.Tunnel{UDP: true},
+			host:    "0.0.0.0",
+			udp:     true,
+			replies: "\x05\x00",
+		},
+		"wrong password failed": {
+			request: "\x05\x01\x02" + "\x01\x05alice\x05secre",
+			cfg:     config.Tunnel{Users: users},
+			replies: "\x05\x02\x01\x01",
+			err:     ErrTunnelAuth,
+		},
+		"unknown user failed": {
+			request: "\x05\x01\x02" + "\x01\x03bob\x06secret",
+			cfg:     config.Tunnel{Users: users},
+			replies: "\x05\x02\x01\x01",
+			err:     ErrTunnelAuth,
+		},
+		"no acceptable method failed": {
+			request: "\x05\x01\x00",
+			cfg:     config.Tunnel{Users: users},
+			replies: "\x05\xff",
+			err:     ErrTunnelAuth,
+		},
+		"socks4 failed": {
+			request: "\x04\x01\x00\x16\x0a\x00\x00\x01\x00",
+			err:     ErrTunnelRequest,
+		},
+		"bind failed": {
+			request: "\x05\x01\x00" + string([]byte{socksVersion, 0x02, 0x00, socksIPv4, 10, 0, 0, 1, 0x00, 0x16}),
+			replies: "\x05\x00" + string(socksReply(socksNotSupported, netip.AddrPort{})),
+			err:     ErrTunnelRequest,
+		},
+		"associate disabled failed": {
+			request: "\x05\x01\x00" + string([]byte{socksVersion, socksAssociate, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0}),
+			replies: "\x05\x00" + string(socksReply(socksNotSupported, netip.AddrPort{})),
+			err:     ErrTunnelRequest,
+		},
+		"address type failed": {
+			request: "\x05\x01\x00" + connect(0x05, 10, 0, 0, 1, 0x00, 0x16),
+			replies: "\x05\x00" + string(socksReply(socksAddrNotSupported, netip.AddrPort{})),
+			err:     ErrTunnelRequest,
+		},
+		"empty domain failed": {
+			request: "\x05\x01\x00" + connect(socksDomain, 0x00, 0x01, 0xbb),
+			replies: "\x05\x00",
+			err:     ErrTunnelRequest,
+		},
+		"incomplete request failed": {
+			request: "\x05\x01\x00" + connect(socksIPv4, 10, 0),
+			replies: "\x05\x00",
+			err:     ErrTunnelRequest,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := tcpPair(t)
+			defer client.Close()
+			defer server.Close()
+
+			client.Write([]byte(test.request))
+			client.(*net.TCPConn).CloseWrite()
+
+			req, err := socksHandshake(server, test.cfg)
+
+			assert.ErrorIs(t, err, test.err)
+
+			if err == nil {
+				assert.EqualValues(t, test.host, req.host)
+				assert.EqualValues(t, test.port, req.port)
+				assert.EqualValues(t, test.user, req.user)
+				assert.EqualValues(t, test.udp, req.udp)
+
+				assert.NoError(t, req.reply(netip.MustParseAddrPort("10.0.0.2:40000"), nil))
+
+				test.replies += string(socksReply(socksSucceeded, netip.MustParseAddrPort("10.0.0.2:40000")))
+			}
+
+			// nothing is left unread, so server is closed without reset
+			server.SetReadDeadline(time.Now().Add(time.Second))
+			io.Copy(io.Discard, server)
+			server.Close()
+
+			client.SetReadDeadline(time.Now().Add(time.Second))
+
+			replies, err := io.ReadAll(client)
+
+			assert.NoError(t, err)
+			assert.EqualValues(t, []byte(test.replies), replies)
+		})
+	}
+}
+
+func TestSocksReplyCode(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		err  error
+		code byte
+	}{
+		"succeeded":        {code: socksSucceeded},
+		"not allowed":      {err: fmt.Errorf("%w: port 22", ErrDestination), code: socksNotAllowed},
+		"refused":          {err: errors.Join(ErrRemoteConn, syscall.ECONNREFUSED), code: socksRefused},
+		"net unreachable":  {err: errors.Join(ErrRemoteConn, syscall.ENETUNREACH), code: socksNetUnreachable},
+		"unresolved":       {err: errors.Join(ErrRemoteConn, &net.DNSError{Err: "no such host", IsNotFound: true}), code: socksHostUnreachable},
+		"timeout":          {err: errors.Join(ErrRemoteConn, os.ErrDeadlineExceeded), code: socksHostUnreachable},
+		"connection limit": {err: ErrConnLimit, code: socksFailure},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.EqualValues(t, test.code, socksReplyCode(test.err))
+		})
+	}
+}
+
+func TestSocksAssociationExpire(t *testing.T) {
+	t.Parallel()
+
+	const timeout = 100 * time.Millisecond
+
+	pry := newPacketRelay(newResolver(config.Resolver{}))
+
+	pry.tunnel = newTunnel(socksHandshake, config.Tunnel{Destinations: config.ACL{Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}})
+
+	asn := newSocksAssociation(netip.MustParseAddr("127.0.0.1"), timeout)
+
+	idle := netip.MustParseAddrPort("127.0.0.1:24510")
+
+	for _, dst := range []netip.AddrPort{idle, netip.MustParseAddrPort("127.0.0.2:24510")} {
+		addr, err := pry.associateDestination(context.Background(), asn, dst.Addr().String(), dst.Port())
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, dst, addr)
+	}
+
+	assert.True(t, asn.active(idle, time.Now()))
+
+	// destination in use is kept, idle one is removed by sweep of the next new destination
+	for range 3 {
+		time.Sleep(timeout / 2)
+
+		_, err := pry.associateDestination(context.Background(), asn, "127.0.0.2", 24510)
+		assert.NoError(t, err)
+	}
+
+	assert.False(t, asn.active(idle, time.Now()))
+
+	_, err := pry.associateDestination(context.Background(), asn, "127.0.0.3", 24510)
+	assert.NoError(t, err)
+
+	assert.Len(t, asn.resolved, 2)
+	assert.NotContains(t, asn.resolved, idle.String())
+	assert.Len(t, asn.sent, 2)
+	assert.NotContains(t, asn.sent, idle)
+}
+
+func TestSOCKS5(t *testing.T) {
+	t.Parallel()
+
+	echo := runTCPServer(t, "127.0.0.1:24501", nil, serveEcho)
+	udpEcho := runUDPEcho(t, "127.0.0.1:24502")
+
+	// parallel subtests complete after parent returns
+	t.Cleanup(func() {
+		echo.Close()
+		udpEcho.Close()
+	})
+
+	socksRoute := func(name string, port uint16, tunnel config.Tunnel) config.Route {
+		route := testRoute(name, port, port)
+		route.Mode = config.ModeSOCKS5
+		route.Remotes = nil
+
+		tunnel.Destinations = config.ACL{Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+		tunnel.Timeout = time.Second
+		route.Tunnel = tunnel
+
+		return route
+	}
+
+	t.Run("Success_connect", func(t *testing.T) {
+		t.Parallel()
+
+		route := socksRoute("socks-connect", 24500, config.Tunnel{})
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		for _, host := range []string{"127.0.0.1", "localhost"} {
+			conn, err := net.Dial("tcp", "127.0.0.1:24500")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			code, bound, err := socksRequest(conn, "", "", socksConnect, host, 24501)
+
+			assert.NoError(t, err)
+			assert.EqualValues(t, socksSucceeded, code)
+			assert.EqualValues(t, "127.0.0.1", bound.Addr().String())
+
+			assertEcho(t, conn, "ping")
+
+			conn.Close()
+		}
+	})
+
+	t.Run("Destination_denied", func(t *testing.T) {
+		t.Parallel()
+
+		route := socksRoute("socks-denied", 24503, config.Tunnel{Ports: []config.PortRange{{First: 24501, Last: 24502}}})
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		for _, dst := range []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:24501"), netip.MustParseAddrPort("127.0.0.1:24509")} {
+			conn, err := net.Dial("tcp", "127.0.0.1:24503")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			code, _, err := socksRequest(conn, "", "", socksConnect, dst.Addr().String(), dst.Port())
+
+			assert.NoError(t, err)
+			assert.EqualValues(t, socksNotAllowed, code)
+
+			assertClosed(t, conn, time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 2, connRejected.With(route.Name, route.Ports[0].String(), rejectDest).Value())
+	})
+
+	t.Run("Destination_refused", func(t *testing.T) {
+		t.Parallel()
+
+		route := socksRoute("socks-refused", 24504, config.Tunnel{})
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24504")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		code, _, err := socksRequest(conn, "", "", socksConnect, "127.0.0.1", 24509)
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, socksRefused, code)
+
+		assert.EqualValues(t, 1, dialFailures.With(route.Name, route.Ports[0].String(), dialFailRefused).Value())
+	})
+
+	t.Run("Success_authenticated", func(t *testing.T) {
+		t.Parallel()
+
+		route := socksRoute("socks-auth", 24505, config.Tunnel{Users: map[string]string{"alice": "secret"}})
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24505")
+		if assert.NoError(t, err) {
+			_, _, err = socksRequest(conn, "alice", "wrong", socksConnect, "127.0.0.1", 24501)
+
+			assert.ErrorIs(t, err, ErrTunnelAuth)
+
+			conn.Close()
+		}
+
+		conn, err = net.Dial("tcp", "127.0.0.1:24505")
+		if assert.NoError(t, err) {
+			_, _, err = socksRequest(conn, "", "", socksConnect, "127.0.0.1", 24501)
+
+			assert.ErrorIs(t, err, ErrTunnelAuth)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 2, connRejected.With(route.Name, route.Ports[0].String(), rejectAuth).Value())
+
+		conn, err = net.Dial("tcp", "127.0.0.1:24505")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		code, _, err := socksRequest(conn, "alice", "secret", socksConnect, "127.0.0.1", 24501)
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, socksSucceeded, code)
+
+		assertEcho(t, conn, "ping")
+	})
+
+	t.Run("Malformed_request_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		route := socksRoute("socks-malformed", 24506, config.Tunnel{})
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		// silent client is closed by timeout, request of socks4 is read up to its version
+		for _, request := range []string{"\x04\x01", ""} {
+			conn, err := net.Dial("tcp", "127.0.0.1:24506")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			conn.Write([]byte(request))
+
+			assertClosed(t, conn, 2*time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 2, connRejected.With(route.Name, route.Ports[0].String(), rejectTunnel).Value())
+	})
+
+	t.Run("Success_udp_associate", func(t *testing.T) {
+		t.Parallel()
+
+		route := socksRoute("socks-udp", 24507, config.Tunnel{UDP: true})
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24507")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		code, bound, err := socksRequest(conn, "", "", socksAssociate, "0.0.0.0", 0)
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, socksSucceeded, code)
+
+		udpConn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(bound))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer udpConn.Close()
+
+		// denied destination is dropped, allowed one is echoed back with its address
+		for _, dst := range []string{"10.0.0.1:24502", "127.0.0.1:24502"} {
+			header := appendSocksAddr([]byte{0x00, 0x00, 0x00}, netip.MustParseAddrPort(dst))
+
+			_, err = udpConn.Write(append(header, "ping"...))
+			assert.NoError(t, err)
+		}
+
+		buf := make([]byte, maxDatagramSize)
+
+		udpConn.SetReadDeadline(time.Now().Add(time.Second))
+
+		read, err := udpConn.Read(buf)
+
+		assert.NoError(t, err)
+		assert.EqualValues(t, append(appendSocksAddr([]byte{0x00, 0x00, 0x00}, netip.MustParseAddrPort("127.0.0.1:24502")), "ping"...), buf[:read])
+
+		// association is done along with tcp connection
+		conn.Close()
+
+		time.Sleep(100 * time.Millisecond)
+
+		udpConn.Write(append(appendSocksAddr([]byte{0x00, 0x00, 0x00}, netip.MustParseAddrPort("127.0.0.1:24502")), "ping"...))
+
+		udpConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+		_, err = udpConn.Read(buf)
+
+		assert.Error(t, err)
+	})
+}
+
+// Negotiate with socks5 server over conn and send request of cmd to destination, reply code and bound address are returned.
+// Server is authenticated by password if user is set.
+func socksRequest(conn net.Conn, user, password string, cmd byte, host string, port uint16) (byte, netip.AddrPort, error) {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	method := byte(socksNoAuth)
+	if user != "" {
+		method = socksPasswordAuth
+	}
+
+	reply := make([]byte, 2)
+
+	conn.Write([]byte{socksVersion, 0x01, method})
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+
+	if reply[1] != method {
+		return 0, netip.AddrPort{}, ErrTunnelAuth
+	}
+
+	if user != "" {
+		conn.Write(append(append(append([]byte{socksAuthVersion, byte(len(user))}, user...), byte(len(password))), password...))
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+
+		if reply[1] != 0x00 {
+			return 0, netip.AddrPort{}, ErrTunnelAuth
+		}
+	}
+
+	request := []byte{socksVersion, cmd, 0x00}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		request = appendSocksAddr(request, netip.AddrPortFrom(addr, port))
+	} else {
+		request = binary.BigEndian.AppendUint16(append(append(request, socksDomain, byte(len(host))), host...), port)
+	}
+
+	conn.Write(request)
+
+	reply = make([]byte, 3)
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+
+	bhost, bport, err := readSocksAddr(conn)
+	if err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+
+	bound, _ := netip.ParseAddr(bhost)
+
+	if !bytes.Equal(reply[:1], []byte{socksVersion}) {
+		return 0, netip.AddrPort{}, ErrTunnelRequest
+	}
+
+	return reply[1], netip.AddrPortFrom(bound, bport), nil
+}
@@ -0,0 +1,147 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"grelay/internal/config"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Idle timeout is checked this many times per timeout
+const idleChecks = 4
+
+// Reasons to close relayed connection by timeouts
+const (
+	closeIdleTimeout  = "idle_timeout"
+	closeMaxLifetime  = "max_lifetime"
+	closeWriteTimeout = "write_timeout"
+)
+
+// Timeouts of relayed tcp connection, zero disables timeout
+type connTimeouts struct {
+	// No data is relayed in either direction
+	idle time.Duration
+	// Connection lives since it is relayed
+	lifetime time.Duration
+	// Write to either side is blocked
+	write time.Duration
+}
+
+// Watch of single relayed connection enforcing its timeouts
+type connWatch struct {
+	connTimeouts
+	started time.Time
+	// Unix nanoseconds of last relayed data
+	lastActive atomic.Int64
+}
+
+// Timeouts of route connections
+func newConnTimeouts(route config.Route) connTimeouts {
+	return connTimeouts{idle: route.IdleTimeout, lifetime: route.MaxLifetime, write: route.WriteTimeout}
+}
+
+// Create watch of connection started now, nil if no timeout is set
+func newConnWatch(timeouts connTimeouts) *connWatch {
+	if timeouts == (connTimeouts{}) {
+		return nil
+	}
+
+	watch := &connWatch{connTimeouts: timeouts, started: time.Now()}
+
+	watch.lastActive.Store(watch.started.UnixNano())
+
+	return watch
+}
+
+// Mark connection as active
+func (watch *connWatch) touch() {
+	if watch == nil {
+		return
+	}
+
+	watch.lastActive.Store(time.Now().UnixNano())
+}
+
+// Deadline of read which is interrupted to report activity, zero if idle timeout is not set
+func (watch *connWatch) readDeadline() time.Time {
+	if watch == nil || watch.idle == 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(watch.idle / idleChecks)
+}
+
+// Set deadline of next write to conn if write timeout is set
+func (watch *connWatch) setWriteDeadline(conn io.Writer) error {
+	if watch == nil || watch.write == 0 {
+		return nil
+	}
+
+	if dl, ok := conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return dl.SetWriteDeadline(time.Now().Add(watch.write))
+	}
+
+	return nil
+}
+
+// Block until ctx is done or some timeout is hit, reason of timeout is returned.
+// Empty reason is returned if ctx is done.
+func (watch *connWatch) wait(ctx context.Context) string {
+	if watch == nil {
+		<-ctx.Done()
+		return ""
+	}
+
+	var tick, expire <-chan time.Time
+
+	if watch.idle > 0 {
+		ticker := time.NewTicker(watch.idle / idleChecks)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	if watch.lifetime > 0 {
+		timer := time.NewTimer(watch.lifetime - time.Since(watch.started))
+		defer timer.Stop()
+
+		expire = timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-expire:
+			return closeMaxLifetime
+		case <-tick:
+			if time.Since(time.Unix(0, watch.lastActive.Load())) >= watch.idle {
+				return closeIdleTimeout
+			}
+		}
+	}
+}
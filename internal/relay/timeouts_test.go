@@ -0,0 +1,222 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"grelay/internal/config"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnTimeouts(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Idle_connection_closed", func(t *testing.T) {
+		t.Parallel()
+
+		const localAddress, remoteAddress = "127.0.0.1:53600", "127.0.0.1:53601"
+
+		echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+		defer echo.Close()
+
+		stop := runTimeoutRelay(t, localAddress, remoteAddress, connTimeouts{idle: 200 * time.Millisecond})
+		defer stop()
+
+		conn, err := net.Dial("tcp", localAddress)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		assertEcho(t, conn, "ping")
+
+		started := time.Now()
+
+		assertClosed(t, conn, 2*time.Second)
+
+		assert.GreaterOrEqual(t, time.Since(started), 200*time.Millisecond)
+		assert.Less(t, time.Since(started), time.Second)
+	})
+
+	t.Run("Active_connection_kept", func(t *testing.T) {
+		t.Parallel()
+
+		const localAddress, remoteAddress = "127.0.0.1:53602", "127.0.0.1:53603"
+
+		echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+		defer echo.Close()
+
+		stop := runTimeoutRelay(t, localAddress, remoteAddress, connTimeouts{idle: 200 * time.Millisecond})
+		defer stop()
+
+		conn, err := net.Dial("tcp", localAddress)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		for i := 0; i < 10; i++ {
+			assertEcho(t, conn, "ping")
+
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+
+	t.Run("Max_lifetime", func(t *testing.T) {
+		t.Parallel()
+
+		const localAddress, remoteAddress = "127.0.0.1:53604", "127.0.0.1:53605"
+
+		echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+		defer echo.Close()
+
+		stop := runTimeoutRelay(t, localAddress, remoteAddress, connTimeouts{idle: time.Minute, lifetime: 300 * time.Millisecond})
+		defer stop()
+
+		conn, err := net.Dial("tcp", localAddress)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		started := time.Now()
+
+		for time.Since(started) < 200*time.Millisecond {
+			assertEcho(t, conn, "ping")
+
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		assertClosed(t, conn, time.Second)
+
+		assert.Less(t, time.Since(started), 600*time.Millisecond)
+	})
+
+	t.Run("Write_timeout", func(t *testing.T) {
+		t.Parallel()
+
+		const localAddress, remoteAddress = "127.0.0.1:53606", "127.0.0.1:53607"
+
+		// remote accepts but never reads
+		listener, err := net.Listen("tcp", remoteAddress)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer listener.Close()
+
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+
+			time.Sleep(5 * time.Second)
+		}()
+
+		stop := runTimeoutRelay(t, localAddress, remoteAddress, connTimeouts{write: 200 * time.Millisecond})
+		defer stop()
+
+		conn, err := net.Dial("tcp", localAddress)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		go func() {
+			chunk := make([]byte, 64*1024)
+
+			for {
+				if _, err := conn.Write(chunk); err != nil {
+					return
+				}
+			}
+		}()
+
+		assertClosed(t, conn, 3*time.Second)
+	})
+}
+
+func TestConnWatch(t *testing.T) {
+	t.Parallel()
+
+	t.Run("No_timeouts", func(t *testing.T) {
+		t.Parallel()
+
+		watch := newConnWatch(connTimeouts{})
+
+		assert.Nil(t, watch)
+		assert.True(t, watch.readDeadline().IsZero())
+		assert.NoError(t, watch.setWriteDeadline(io.Discard))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.EqualValues(t, "", watch.wait(ctx))
+	})
+
+	t.Run("Idle_reason", func(t *testing.T) {
+		t.Parallel()
+
+		watch := newConnWatch(connTimeouts{idle: 40 * time.Millisecond})
+
+		assert.EqualValues(t, closeIdleTimeout, watch.wait(context.Background()))
+	})
+
+	t.Run("Lifetime_reason", func(t *testing.T) {
+		t.Parallel()
+
+		watch := newConnWatch(connTimeouts{idle: time.Minute, lifetime: 40 * time.Millisecond})
+
+		assert.EqualValues(t, closeMaxLifetime, watch.wait(context.Background()))
+	})
+
+	t.Run("Route_timeouts", func(t *testing.T) {
+		t.Parallel()
+
+		route := config.Route{IdleTimeout: time.Minute, MaxLifetime: time.Hour, WriteTimeout: time.Second}
+
+		assert.EqualValues(t, connTimeouts{idle: time.Minute, lifetime: time.Hour, write: time.Second}, newConnTimeouts(route))
+	})
+}
+
+// Run packet relay with timeouts, returned func stops it
+func runTimeoutRelay(t *testing.T, local, remote string, timeouts connTimeouts) func() {
+	pry := newPacketRelay(newResolver(config.Resolver{}))
+
+	pry.timeouts = timeouts
+
+	return runPacketRelay(t, pry, local, remote)
+}
@@ -0,0 +1,243 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"grelay/internal/config"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Timeout of tls handshake with client
+const handshakeTimeout = 10 * time.Second
+
+// Tls termination of route, certificate and client CAs are reloaded once their files change
+type tlsTerminator struct {
+	cfg config.TLS
+	// Guards loaded files
+	mu *sync.Mutex
+	// Config of handshakes with loaded files
+	current *tls.Config
+	// Modification stamps of loaded files by path
+	stamps map[string]fileStamp
+}
+
+// Modification stamp of file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Create termination and load its files
+func newTLSTerminator(cfg config.TLS) (*tlsTerminator, error) {
+	tt := &tlsTerminator{cfg: cfg, mu: &sync.Mutex{}}
+
+	if err := tt.load(); err != nil {
+		return nil, err
+	}
+
+	return tt, nil
+}
+
+// Server config which picks up changed files on every handshake
+func (tt *tlsTerminator) config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return tt.reload(), nil
+		},
+	}
+}
+
+// Reload files if any of them is changed, previous files are kept if new ones are not valid
+func (tt *tlsTerminator) reload() *tls.Config {
+	tt.mu.Lock()
+	changed := false
+
+	for path, stamp := range tt.stamps {
+		if current, err := statFile(path); err != nil || current != stamp {
+			changed = true
+			break
+		}
+	}
+
+	tt.mu.Unlock()
+
+	if changed {
+		if err := tt.load(); err != nil {
+			log.Printf("tls: failed to reload certificate %s, keep previous one err=%s", tt.cfg.CertFile, err)
+		} else {
+			log.Printf("tls: reload certificate %s", tt.cfg.CertFile)
+		}
+	}
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	return tt.current
+}
+
+// Load certificate and client CAs
+func (tt *tlsTerminator) load() error {
+	paths := []string{tt.cfg.CertFile, tt.cfg.KeyFile}
+
+	if tt.cfg.ClientCAFile != "" {
+		paths = append(paths, tt.cfg.ClientCAFile)
+	}
+
+	// stamps are taken before loading so change during loading is picked up by next handshake
+	stamps := map[string]fileStamp{}
+
+	for _, path := range paths {
+		stamp, err := statFile(path)
+		if err != nil {
+			return errors.Join(ErrTLSFile, err)
+		}
+
+		stamps[path] = stamp
+	}
+
+	cert, err := tls.LoadX509KeyPair(tt.cfg.CertFile, tt.cfg.KeyFile)
+	if err != nil {
+		return errors.Join(ErrTLSFile, err)
+	}
+
+	current := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tt.cfg.MinVersion,
+		CipherSuites: tt.cfg.CipherSuites,
+	}
+
+	if tt.cfg.ClientCAFile != "" {
+		if current.ClientCAs, err = loadCertPool(tt.cfg.ClientCAFile); err != nil {
+			return err
+		}
+
+		current.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tt.current = current
+	tt.stamps = stamps
+
+	return nil
+}
+
+// Load pem bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Join(ErrTLSFile, err)
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w: no certificate found in %s", ErrTLSFile, path)
+	}
+
+	return pool, nil
+}
+
+// Get modification stamp of file
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Create client config of tls origination toward remotes and load its files
+func newOriginTLS(cfg config.RemoteTLS) (*tls.Config, error) {
+	origin := &tls.Config{
+		ServerName:         cfg.ServerName,
+		MinVersion:         cfg.MinVersion,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		origin.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Join(ErrTLSFile, err)
+		}
+
+		origin.Certificates = []tls.Certificate{cert}
+	}
+
+	return origin, nil
+}
+
+// Wrap connection to remoteAddr in tls and complete handshake until ctx is done.
+// Host of remoteAddr is used as server name unless it is set in config.
+func originate(ctx context.Context, conn net.Conn, remoteAddr string, origin *tls.Config) (*tls.Conn, error) {
+	if origin.ServerName == "" {
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		origin = origin.Clone()
+		origin.ServerName = host
+	}
+
+	if origin.InsecureSkipVerify {
+		log.Printf("conn: WARNING certificate of %s is not verified, tls connection is insecure\n", remoteAddr)
+	}
+
+	tconn := tls.Client(conn, origin)
+
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRemoteTLS, err)
+	}
+
+	return tconn, nil
+}
+
+// Complete tls handshake with client within handshake timeout
+func handshake(ctx context.Context, conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	return conn.HandshakeContext(ctx)
+}
@@ -0,0 +1,421 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"grelay/internal/config"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Self-signed CA with server and client certificates issued by it, all written to pem files of dir
+type testCerts struct {
+	dir string
+	ca  *x509.Certificate
+	key *ecdsa.PrivateKey
+	// Pool with CA only
+	pool *x509.CertPool
+}
+
+func TestTLSTermination(t *testing.T) {
+	t.Parallel()
+
+	const remoteAddress = "127.0.0.1:24001"
+
+	echo := runTCPServer(t, remoteAddress, nil, serveEcho)
+
+	// parallel subtests complete after parent returns
+	t.Cleanup(func() { echo.Close() })
+
+	certs := newTestCerts(t)
+
+	certs.issue(t, "server", "server")
+	certs.issue(t, "client", "client")
+
+	t.Run("Success_terminated", func(t *testing.T) {
+		t.Parallel()
+
+		route := testRoute("tls", 24000, 24001)
+		route.TLS = certs.serverTLS("server")
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:24000", &tls.Config{RootCAs: certs.pool})
+		if assert.NoError(t, err) {
+			assertEcho(t, conn, "ping")
+			conn.Close()
+		}
+	})
+
+	t.Run("Client_certificate_required", func(t *testing.T) {
+		t.Parallel()
+
+		route := testRoute("mtls", 24002, 24001)
+		route.TLS = certs.serverTLS("server")
+		route.TLS.ClientCAFile = filepath.Join(certs.dir, "ca.pem")
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:24002", &tls.Config{RootCAs: certs.pool})
+		if err == nil {
+			// tls 1.3 client learns about rejected certificate on first read
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			_, err = conn.Read(make([]byte, 1))
+
+			conn.Close()
+		}
+
+		assert.Error(t, err)
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:24002", &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.keyPair(t, "client")}})
+		if assert.NoError(t, err) {
+			assertEcho(t, conn, "ping")
+			conn.Close()
+		}
+	})
+
+	t.Run("Min_version", func(t *testing.T) {
+		t.Parallel()
+
+		route := testRoute("tls13", 24003, 24001)
+		route.TLS = certs.serverTLS("server")
+		route.TLS.MinVersion = tls.VersionTLS13
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		_, err := tls.Dial("tcp", "127.0.0.1:24003", &tls.Config{RootCAs: certs.pool, MaxVersion: tls.VersionTLS12})
+		assert.Error(t, err)
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:24003", &tls.Config{RootCAs: certs.pool})
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, tls.VersionTLS13, conn.ConnectionState().Version)
+			conn.Close()
+		}
+	})
+
+	t.Run("Certificate_reloaded", func(t *testing.T) {
+		t.Parallel()
+
+		certs := newTestCerts(t)
+
+		first := certs.issue(t, "server", "server")
+
+		route := testRoute("reload", 24004, 24001)
+		route.TLS = certs.serverTLS("server")
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		assert.EqualValues(t, first.SerialNumber, servedCertificate(t, "127.0.0.1:24004", certs.pool).SerialNumber)
+
+		second := certs.issue(t, "server", "server")
+
+		// make sure stamps differ even on coarse file system clock
+		future := time.Now().Add(time.Minute)
+
+		for _, name := range []string{"server.pem", "server.key"} {
+			os.Chtimes(filepath.Join(certs.dir, name), future, future)
+		}
+
+		assert.EqualValues(t, second.SerialNumber, servedCertificate(t, "127.0.0.1:24004", certs.pool).SerialNumber)
+
+		// broken file is not picked up
+		os.WriteFile(filepath.Join(certs.dir, "server.pem"), []byte("broken"), 0o600)
+
+		assert.EqualValues(t, second.SerialNumber, servedCertificate(t, "127.0.0.1:24004", certs.pool).SerialNumber)
+	})
+
+	t.Run("Missing_files_failed", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		rly := New(ctx)
+
+		route := testRoute("missing", 24005, 24001)
+		route.TLS = config.TLS{CertFile: filepath.Join(certs.dir, "none.pem"), KeyFile: filepath.Join(certs.dir, "none.key")}
+
+		assert.EqualValues(t, ReloadResult{Failed: []string{"missing"}}, rly.Apply(routesConfig{route}))
+
+		cancel()
+
+		rly.Wait()
+	})
+}
+
+func TestTLSOrigination(t *testing.T) {
+	t.Parallel()
+
+	const remoteAddress, mtlsAddress = "127.0.0.1:24101", "127.0.0.1:24103"
+
+	certs := newTestCerts(t)
+
+	certs.issue(t, "server", "server")
+	certs.issue(t, "client", "client")
+
+	echo := runTCPServer(t, remoteAddress, &tls.Config{Certificates: []tls.Certificate{certs.keyPair(t, "server")}}, serveEcho)
+
+	mtls := runTCPServer(t, mtlsAddress, &tls.Config{
+		Certificates: []tls.Certificate{certs.keyPair(t, "server")},
+		ClientCAs:    certs.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, serveEcho)
+
+	// parallel subtests complete after parent returns
+	t.Cleanup(func() {
+		echo.Close()
+		mtls.Close()
+	})
+
+	caFile := filepath.Join(certs.dir, "ca.pem")
+
+	// other CA which has not issued certificate of remote
+	unknown := newTestCerts(t)
+
+	tests := map[string]struct {
+		local  uint16
+		remote uint16
+		tls    config.RemoteTLS
+		ok     bool
+	}{
+		"Success_verified_by_ca": {
+			local:  24100,
+			remote: 24101,
+			tls:    config.RemoteTLS{Enabled: true, CAFile: caFile},
+			ok:     true,
+		},
+		"Unknown_ca_failed": {
+			local:  24102,
+			remote: 24101,
+			tls:    config.RemoteTLS{Enabled: true, CAFile: filepath.Join(unknown.dir, "ca.pem")},
+			ok:     false,
+		},
+		"Success_insecure_skip_verify": {
+			local:  24104,
+			remote: 24101,
+			tls:    config.RemoteTLS{Enabled: true, InsecureSkipVerify: true},
+			ok:     true,
+		},
+		"Success_server_name": {
+			local:  24105,
+			remote: 24101,
+			tls:    config.RemoteTLS{Enabled: true, CAFile: caFile, ServerName: "server"},
+			ok:     true,
+		},
+		"Server_name_mismatch_failed": {
+			local:  24106,
+			remote: 24101,
+			tls:    config.RemoteTLS{Enabled: true, CAFile: caFile, ServerName: "other"},
+			ok:     false,
+		},
+		"Client_certificate_missing_failed": {
+			local:  24107,
+			remote: 24103,
+			tls:    config.RemoteTLS{Enabled: true, CAFile: caFile},
+			ok:     false,
+		},
+		"Success_client_certificate": {
+			local:  24108,
+			remote: 24103,
+			tls: config.RemoteTLS{
+				Enabled:  true,
+				CAFile:   caFile,
+				CertFile: filepath.Join(certs.dir, "client.pem"),
+				KeyFile:  filepath.Join(certs.dir, "client.key"),
+			},
+			ok: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			route := testRoute(name, test.local, test.remote)
+			route.RemoteTLS = test.tls
+			route.RemoteTLS.MinVersion = config.DefaultTLSMinVersion
+
+			stop := runRouteRelay(t, route)
+			defer stop()
+
+			conn, err := net.Dial("tcp", makeAddr(route.Local, test.local))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			defer conn.Close()
+
+			if test.ok {
+				assertEcho(t, conn, "ping")
+				return
+			}
+
+			// relay drops client once handshake with remote fails, with tls 1.3 remote could reject it after that
+			assertClosed(t, conn, time.Second)
+		})
+	}
+
+	t.Run("Missing_files_failed", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		rly := New(ctx)
+
+		route := testRoute("missing", 24109, 24101)
+		route.RemoteTLS = config.RemoteTLS{Enabled: true, CAFile: filepath.Join(certs.dir, "none.pem")}
+
+		assert.EqualValues(t, ReloadResult{Failed: []string{"missing"}}, rly.Apply(routesConfig{route}))
+
+		cancel()
+
+		rly.Wait()
+	})
+}
+
+// Create CA and write it to ca.pem of temp dir
+func newTestCerts(t *testing.T) *testCerts {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		assert.FailNow(t, "failed to generate CA key")
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "grelay test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		assert.FailNow(t, "failed to create CA")
+	}
+
+	ca, _ := x509.ParseCertificate(der)
+
+	certs := &testCerts{dir: t.TempDir(), ca: ca, key: key, pool: x509.NewCertPool()}
+
+	certs.pool.AddCert(ca)
+
+	certs.write(t, "ca.pem", "CERTIFICATE", der)
+
+	return certs
+}
+
+// Issue certificate for loopback signed by CA and write it to name.pem and name.key
+func (tc *testCerts) issue(t *testing.T, name, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		assert.FailNow(t, "failed to generate key")
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, tc.ca, &key.PublicKey, tc.key)
+	if err != nil {
+		assert.FailNow(t, "failed to issue certificate")
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	tc.write(t, name+".key", "EC PRIVATE KEY", keyDer)
+	tc.write(t, name+".pem", "CERTIFICATE", der)
+
+	cert, _ := x509.ParseCertificate(der)
+
+	return cert
+}
+
+// Termination config of certificate issued as name
+func (tc *testCerts) serverTLS(name string) config.TLS {
+	return config.TLS{
+		CertFile:   filepath.Join(tc.dir, name+".pem"),
+		KeyFile:    filepath.Join(tc.dir, name+".key"),
+		MinVersion: config.DefaultTLSMinVersion,
+	}
+}
+
+// Load certificate issued as name
+func (tc *testCerts) keyPair(t *testing.T, name string) tls.Certificate {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(tc.dir, name+".pem"), filepath.Join(tc.dir, name+".key"))
+	if err != nil {
+		assert.FailNow(t, "failed to load key pair")
+	}
+
+	return cert
+}
+
+// Write pem block to file of dir
+func (tc *testCerts) write(t *testing.T, name, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+
+	if err := os.WriteFile(filepath.Join(tc.dir, name), data, 0o600); err != nil {
+		assert.FailNow(t, "failed to write pem file")
+	}
+}
+
+// Get leaf certificate served on addr
+func servedCertificate(t *testing.T, addr string, pool *x509.CertPool) *x509.Certificate {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+	if !assert.NoError(t, err) {
+		return &x509.Certificate{}
+	}
+
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0]
+}
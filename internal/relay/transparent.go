@@ -0,0 +1,104 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"fmt"
+	"grelay/internal/config"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// Lookup of original destination of redirected client socket
+type originalDstLookup func(conn net.Conn) (netip.AddrPort, error)
+
+// Router of redirected clients to their original destinations
+type transparentRouter struct {
+	lookup originalDstLookup
+	// Remapping of original destinations
+	rules []config.TransparentRule
+	// Address of listener, clients connected to it directly are not redirected ones
+	listener netip.AddrPort
+}
+
+// Create router recovering original destinations by method of cfg
+func newTransparentRouter(cfg config.Transparent, listener netip.AddrPort) *transparentRouter {
+	tr := &transparentRouter{lookup: redirectedDst, rules: cfg.Rules, listener: listener}
+
+	if cfg.Method == config.TransparentTProxy {
+		tr.lookup = tproxyDst
+	}
+
+	return tr
+}
+
+// Get original destination of client and remote it is connected to, remote is remapped by first matching rule
+func (tr *transparentRouter) route(conn net.Conn) (netip.AddrPort, string, error) {
+	dst, err := tr.lookup(socketConn(conn))
+	if err != nil {
+		return netip.AddrPort{}, "", err
+	}
+
+	dst = unmapAddrPort(dst)
+
+	// client would be relayed to listener again and again
+	if dst == tr.listener || tr.listener.Addr().IsUnspecified() && dst.Addr().IsLoopback() && dst.Port() == tr.listener.Port() {
+		return netip.AddrPort{}, "", fmt.Errorf("%w: client is connected to listener %s directly", ErrOriginalDst, dst)
+	}
+
+	for _, rule := range tr.rules {
+		if !rule.Match.Contains(dst.Addr()) {
+			continue
+		}
+
+		if len(rule.Ports) != 0 && !slices.ContainsFunc(rule.Ports, func(ports config.PortRange) bool { return ports.Contains(dst.Port()) }) {
+			continue
+		}
+
+		host, port := dst.Addr().String(), dst.Port()
+
+		if rule.Remote != "" {
+			host = rule.Remote
+		}
+
+		if rule.Port != 0 {
+			port = rule.Port
+		}
+
+		return dst, makeHostAddr(host, port), nil
+	}
+
+	return dst, dst.String(), nil
+}
+
+// Connection delivered by tproxy keeps original destination as its local address
+func tproxyDst(conn net.Conn) (netip.AddrPort, error) {
+	dst := tcpAddrPort(conn.LocalAddr())
+	if !dst.IsValid() {
+		return netip.AddrPort{}, fmt.Errorf("%w: local address %s is not tcp one", ErrOriginalDst, conn.LocalAddr())
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,144 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// Socket options missing in syscall
+const (
+	// SO_ORIGINAL_DST of SOL_IP and IP6T_SO_ORIGINAL_DST of SOL_IPV6
+	soOriginalDst = 80
+	// IPV6_TRANSPARENT of SOL_IPV6
+	ipv6Transparent = 75
+)
+
+// Original destination of client redirected by netfilter, it is kept by conntrack
+func redirectedDst(conn net.Conn) (netip.AddrPort, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("%w: %T is not socket", ErrOriginalDst, conn)
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, errors.Join(ErrOriginalDst, err)
+	}
+
+	level := originalDstLevel(conn)
+
+	var dst netip.AddrPort
+	var serr error
+
+	err = raw.Control(func(fd uintptr) {
+		if level == syscall.SOL_IP {
+			var mreq *syscall.IPv6Mreq
+
+			// sockaddr_in fits mreq, its port and address are in network byte order
+			if mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); serr == nil {
+				sa := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4]))
+			}
+
+			return
+		}
+
+		var info *syscall.IPv6MTUInfo
+
+		// sockaddr_in6 fits mtu info
+		if info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); serr == nil {
+			port := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port))
+		}
+	})
+
+	switch {
+	case err != nil:
+		return netip.AddrPort{}, errors.Join(ErrOriginalDst, err)
+	case errors.Is(serr, syscall.ENOENT):
+		return netip.AddrPort{}, fmt.Errorf("%w: connection is not redirected by netfilter: %w", ErrOriginalDst, serr)
+	case errors.Is(serr, syscall.ENOPROTOOPT):
+		return netip.AddrPort{}, fmt.Errorf("%w: conntrack of netfilter is not available: %w", ErrOriginalDst, serr)
+	case serr != nil:
+		return netip.AddrPort{}, fmt.Errorf("%w: %w", ErrOriginalDst, serr)
+	}
+
+	return dst, nil
+}
+
+// Level of original destination option of conn, ipv4 clients of dual-stack listener have mapped local addresses
+// and are tracked by ipv4 conntrack
+func originalDstLevel(conn net.Conn) int {
+	if tcpAddrPort(conn.LocalAddr()).Addr().Unmap().Is4() {
+		return syscall.SOL_IP
+	}
+
+	return syscall.SOL_IPV6
+}
+
+// Create tcp listener bound to addr which accepts connections to foreign addresses delivered by tproxy
+func bindTransparentConn(ctx context.Context, addr string) (net.Listener, error) {
+	log.Printf("listener: start transparent listening on addr=%s\n", addr)
+
+	lc := &net.ListenConfig{
+		Control: func(network, _ string, c syscall.RawConn) error {
+			var serr error
+
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+					return
+				}
+
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+
+			if errors.Is(serr, syscall.EPERM) {
+				return fmt.Errorf("%w: transparent socket requires CAP_NET_ADMIN: %w", ErrTransparent, serr)
+			}
+
+			if serr != nil {
+				return fmt.Errorf("%w: %w", ErrTransparent, serr)
+			}
+
+			return err
+		},
+	}
+
+	listener, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		log.Printf("listener: failed to listen addr=%s, err=%s\n", addr, err)
+		return nil, errors.Join(ErrListenAddr, err)
+	}
+
+	return listener, nil
+}
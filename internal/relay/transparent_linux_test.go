@@ -0,0 +1,98 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginalDstLevel(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		network string
+		listen  string
+		dial    string
+		level   int
+	}{
+		"IPv4_listener": {
+			network: "tcp4",
+			listen:  "127.0.0.1:0",
+			dial:    "127.0.0.1",
+			level:   syscall.SOL_IP,
+		},
+		"IPv4_client_of_dual_stack_listener": {
+			network: "tcp",
+			listen:  "[::]:0",
+			dial:    "127.0.0.1",
+			level:   syscall.SOL_IP,
+		},
+		"IPv6_client": {
+			network: "tcp6",
+			listen:  "[::1]:0",
+			dial:    "::1",
+			level:   syscall.SOL_IPV6,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			listener, err := net.Listen(test.network, test.listen)
+			if err != nil {
+				t.Skipf("listener is not available: %s", err)
+			}
+
+			defer listener.Close()
+
+			_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+			client, err := net.Dial("tcp", net.JoinHostPort(test.dial, port))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			defer client.Close()
+
+			server, err := listener.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			defer server.Close()
+
+			assert.EqualValues(t, test.level, originalDstLevel(server), server.LocalAddr().String())
+
+			// conntrack has no redirect entry of plain loopback connection
+			_, err = redirectedDst(server)
+
+			assert.ErrorIs(t, err, ErrOriginalDst)
+		})
+	}
+}
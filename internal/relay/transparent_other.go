@@ -0,0 +1,48 @@
+//go:build !linux
+
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"runtime"
+)
+
+// Original destinations of redirected clients are kept by netfilter of linux only
+func redirectedDst(net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, fmt.Errorf("%w: redirected connections are not supported on %s", ErrOriginalDst, runtime.GOOS)
+}
+
+// Transparent sockets are supported on linux only
+func bindTransparentConn(_ context.Context, addr string) (net.Listener, error) {
+	log.Printf("listener: failed to listen addr=%s, err=transparent socket is not supported\n", addr)
+
+	return nil, fmt.Errorf("%w: transparent socket is not supported on %s", ErrTransparent, runtime.GOOS)
+}
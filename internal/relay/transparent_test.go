@@ -0,0 +1,241 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"errors"
+	"grelay/internal/config"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransparentRoute(t *testing.T) {
+	t.Parallel()
+
+	listener := netip.MustParseAddrPort("127.0.0.1:3128")
+
+	rules := []config.TransparentRule{
+		{Match: netip.MustParsePrefix("10.0.0.0/8"), Ports: []config.PortRange{{First: 80, Last: 80}}, Remote: "web.internal"},
+		{Match: netip.MustParsePrefix("10.0.0.0/8"), Port: 8443},
+		{Match: netip.MustParsePrefix("::/0"), Remote: "fallback", Port: 8080},
+	}
+
+	tests := map[string]struct {
+		dst      string
+		err      error
+		listener netip.AddrPort
+		remote   string
+		wantErr  error
+	}{
+		"Success_no_rule": {
+			dst:    "192.168.1.1:22",
+			remote: "192.168.1.1:22",
+		},
+		"Success_remote_by_port": {
+			dst:    "10.1.2.3:80",
+			remote: "web.internal:80",
+		},
+		"Success_port_by_prefix": {
+			dst:    "10.1.2.3:443",
+			remote: "10.1.2.3:8443",
+		},
+		"Success_unmapped_ipv4": {
+			dst:    "[::ffff:10.1.2.3]:443",
+			remote: "10.1.2.3:8443",
+		},
+		"Success_ipv6": {
+			dst:    "[2001:db8::1]:443",
+			remote: "fallback:8080",
+		},
+		"Loop_to_listener": {
+			dst:     "127.0.0.1:3128",
+			wantErr: ErrOriginalDst,
+		},
+		"Loop_to_unspecified_listener": {
+			dst:      "127.0.0.2:3128",
+			listener: netip.MustParseAddrPort("0.0.0.0:3128"),
+			wantErr:  ErrOriginalDst,
+		},
+		"Failed_lookup": {
+			err:     ErrOriginalDst,
+			wantErr: ErrOriginalDst,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tr := newTransparentRouter(config.Transparent{Rules: rules}, listener)
+
+			if test.listener.IsValid() {
+				tr.listener = test.listener
+			}
+
+			tr.lookup = func(net.Conn) (netip.AddrPort, error) {
+				if test.err != nil {
+					return netip.AddrPort{}, test.err
+				}
+
+				return netip.MustParseAddrPort(test.dst), nil
+			}
+
+			dst, remote, err := tr.route(nil)
+
+			if test.wantErr != nil {
+				assert.ErrorIs(t, err, test.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.EqualValues(t, unmapAddrPort(netip.MustParseAddrPort(test.dst)), dst)
+			assert.EqualValues(t, test.remote, remote)
+		})
+	}
+}
+
+func TestTransparentProxy(t *testing.T) {
+	t.Parallel()
+
+	echo := runTCPServer(t, "127.0.0.1:24701", nil, serveEcho)
+
+	// parallel subtests complete after parent returns
+	t.Cleanup(func() { echo.Close() })
+
+	t.Run("Success_original_dst", func(t *testing.T) {
+		t.Parallel()
+
+		stop := runTransparentRelay(t, "transparent", 24700, nil, func(net.Conn) (netip.AddrPort, error) {
+			return netip.MustParseAddrPort("127.0.0.1:24701"), nil
+		})
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24700")
+		if assert.NoError(t, err) {
+			assertEcho(t, conn, "ping")
+
+			conn.Close()
+		}
+	})
+
+	t.Run("Success_remapped_dst", func(t *testing.T) {
+		t.Parallel()
+
+		rules := []config.TransparentRule{{Match: netip.MustParsePrefix("10.0.0.0/8"), Remote: "localhost", Port: 24701}}
+
+		stop := runTransparentRelay(t, "transparent-remapped", 24702, rules, func(net.Conn) (netip.AddrPort, error) {
+			return netip.MustParseAddrPort("10.0.0.1:80"), nil
+		})
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24702")
+		if assert.NoError(t, err) {
+			assertEcho(t, conn, "ping")
+
+			conn.Close()
+		}
+	})
+
+	t.Run("Failed_lookup", func(t *testing.T) {
+		t.Parallel()
+
+		stop := runTransparentRelay(t, "transparent-failed", 24703, nil, func(net.Conn) (netip.AddrPort, error) {
+			return netip.AddrPort{}, ErrOriginalDst
+		})
+		defer stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:24703")
+		if assert.NoError(t, err) {
+			assertClosed(t, conn, time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 1, connRejected.With("transparent-failed", "24703/tcp", rejectOrigDst).Value())
+	})
+
+	t.Run("TProxy_loop_rejected", func(t *testing.T) {
+		t.Parallel()
+
+		listener, err := bindTransparentConn(context.Background(), "127.0.0.1:24704")
+		if errors.Is(err, ErrTransparent) {
+			t.Skipf("transparent socket is not available: %s", err)
+		}
+
+		if assert.NoError(t, err) {
+			listener.Close()
+		}
+
+		route := testRoute("transparent-tproxy", 24704, 24704)
+		route.Mode = config.ModeTransparent
+		route.Remotes = nil
+		route.Transparent = config.Transparent{Method: config.TransparentTProxy}
+
+		stop := runRouteRelay(t, route)
+		defer stop()
+
+		// connection which is not delivered by tproxy keeps listener as its destination
+		conn, err := net.Dial("tcp", "127.0.0.1:24704")
+		if assert.NoError(t, err) {
+			assertClosed(t, conn, time.Second)
+
+			conn.Close()
+		}
+
+		assert.EqualValues(t, 1, connRejected.With("transparent-tproxy", "24704/tcp", rejectOrigDst).Value())
+	})
+
+	t.Run("Not_redirected", func(t *testing.T) {
+		t.Parallel()
+
+		client, server := tcpPair(t)
+		defer client.Close()
+		defer server.Close()
+
+		// conntrack either has no redirect entry or keeps destination as it is
+		dst, err := redirectedDst(server)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrOriginalDst)
+			return
+		}
+
+		assert.EqualValues(t, tcpAddrPort(server.LocalAddr()), dst)
+	})
+}
+
+// Run transparent relay on local port of loopback, original destinations of clients are got by lookup
+func runTransparentRelay(t *testing.T, name string, port uint16, rules []config.TransparentRule, lookup originalDstLookup) func() {
+	pry := newPacketRelay(newResolver(config.Resolver{}))
+
+	pry.metrics = newPortMetrics(name, config.Port{Local: port, Remote: port, Network: config.NetworkTCP})
+	pry.transparent = newTransparentRouter(config.Transparent{Rules: rules}, netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port))
+	pry.transparent.lookup = lookup
+
+	return runPacketRelay(t, pry, makeAddr(netip.MustParseAddr("127.0.0.1"), port))
+}
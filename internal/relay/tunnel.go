@@ -0,0 +1,170 @@
+/**
+ *
+ * MIT License
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"grelay/internal/config"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Handshake of tunnel client asking for its destination
+type tunnelHandshake func(conn net.Conn, cfg config.Tunnel) (*tunnelRequest, error)
+
+// Destination asked by tunnel client
+type tunnelRequest struct {
+	// Host name or ip address of destination
+	host string
+	port uint16
+	// Authenticated user, empty if clients are not authenticated
+	user string
+	// Datagrams of client are relayed instead of its stream
+	udp bool
+	// Bytes sent by client along with request, they are replayed to destination
+	buffered []byte
+	// Reply client with result of connecting to destination, bound is local address used toward destination
+	reply func(bound netip.AddrPort, err error) error
+}
+
+// Tunnels of clients to allowed destinations they ask for
+type tunnel struct {
+	handshake tunnelHandshake
+	cfg       config.Tunnel
+	// Filter of destination addresses
+	destinations *acl
+}
+
+// Create tunnels negotiated by handshake
+func newTunnel(handshake tunnelHandshake, cfg config.Tunnel) *tunnel {
+	return &tunnel{handshake: handshake, cfg: cfg, destinations: newACL(cfg.Destinations)}
+}
+
+// Read request of client, it has to be received within timeout of tunnel
+func (tun *tunnel) accept(conn net.Conn) (*tunnelRequest, error) {
+	if err := conn.SetDeadline(time.Now().Add(tun.cfg.Timeout)); err != nil {
+		return nil, err
+	}
+
+	defer conn.SetDeadline(time.Time{})
+
+	return tun.handshake(conn, tun.cfg)
+}
+
+// Resolve destination to its allowed addresses within timeout, ErrDestination is returned if none of them is allowed
+func (tun *tunnel) resolve(ctx context.Context, res *resolver, timeout time.Duration, host string, port uint16) ([]netip.AddrPort, error) {
+	if !tun.permitsPort(port) {
+		return nil, fmt.Errorf("%w: port %d", ErrDestination, port)
+	}
+
+	if timeout <= 0 {
+		timeout = config.DefaultDialTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addrs, err := res.lookup(ctx, host)
+	if err != nil {
+		return nil, errors.Join(ErrRemoteConn, err)
+	}
+
+	allowed := []netip.AddrPort{}
+
+	for _, addr := range addrs {
+		if tun.destinations.permits(addr) {
+			allowed = append(allowed, netip.AddrPortFrom(addr.Unmap(), port))
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrDestination, makeHostAddr(host, port))
+	}
+
+	return allowed, nil
+}
+
+// Upstream of allowed addresses of destination asked by client, they are tried in order on retries
+func (tun *tunnel) upstream(ctx context.Context, res *resolver, timeout time.Duration, req *tunnelRequest) (*upstream, error) {
+	addrs, err := tun.resolve(ctx, res, timeout, req.host, req.port)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes := make([]string, 0, len(addrs))
+
+	for _, addr := range addrs {
+		remotes = append(remotes, addr.String())
+	}
+
+	return newUpstream(remotes, &roundRobinBalancer{}, config.HealthCheck{}), nil
+}
+
+// Check whether destination port is allowed, any port is allowed if ports are not set
+func (tun *tunnel) permitsPort(port uint16) bool {
+	if len(tun.cfg.Ports) == 0 {
+		return true
+	}
+
+	for _, ports := range tun.cfg.Ports {
+		if ports.Contains(port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check password of user, unknown user takes the same time as wrong password
+func authenticate(users map[string]string, user, password string) bool {
+	expected, ok := users[user]
+
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 && ok
+}
+
+// Socket of client connection, tls and proxy protocol are unwrapped
+func socketConn(conn net.Conn) net.Conn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+
+	return conn
+}
+
+func (req *tunnelRequest) String() string {
+	if req.user == "" {
+		return makeHostAddr(req.host, req.port)
+	}
+
+	return fmt.Sprintf("%s of user %q", makeHostAddr(req.host, req.port), req.user)
+}